@@ -6,12 +6,17 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	iscsiLib "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/terrycain/qnap-csi/driver"
+	"github.com/terrycain/qnap-csi/qnap"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 func main() {
@@ -21,10 +26,29 @@ func main() {
 		logLevel      = flag.String("log-level", "info", "Log level (info/warn/fatal/error)")
 		version       = flag.Bool("version", false, "Print the version and exit")
 		controller    = flag.Bool("controller", false, "Serve controller driver, else it will operate as node driver")
-		prefix        = flag.String("prefix", driver.DefaultVolumePrefix, "Naming prefix")
+		prefix        = flag.String("prefix", driver.DefaultVolumePrefix, "Prefix of the names of targets, LUNs and shared folders the controller creates")
+		clusterID     = flag.String("cluster-id", "", "Up to 12 lowercase letters and numbers identifying the cluster, needed when clusters share a QNAP")
 		nodeID        = flag.String("node-id", "", "Node ID")
 		portal        = flag.String("portal", "", "Portal Address (IP:PORT)")
+		extraPortals  = flag.String("portals", "", "Comma separated extra portal addresses of the QNAP, nodes log in to all of them and use multipath")
 		storagePoolID = flag.Int("storage-pool-id", 1, "Storage Pool ID")
+		nfsServer     = flag.String("nfs-server", "", "Address nodes mount NFS volumes from, defaults to the portal's IP")
+		nfsNetworks   = flag.String("nfs-networks", "", "Comma separated IPs or CIDR networks of the cluster's nodes, NFS volumes are exported to them")
+		smbServer     = flag.String("smb-server", "", "Address nodes mount SMB volumes from, defaults to the portal's IP")
+		tlsCAFile     = flag.String("tls-ca-file", "", "PEM CA bundle used to verify the QNAP's certificate instead of the system roots")
+		tlsCertFile   = flag.String("tls-cert-file", "", "PEM client certificate presented to the QNAP")
+		tlsKeyFile    = flag.String("tls-key-file", "", "PEM client certificate key")
+		tlsMinVersion = flag.String("tls-min-version", "1.2", "Minimum TLS version (1.0/1.1/1.2/1.3)")
+		tlsInsecure   = flag.Bool("tls-insecure-skip-verify", false, "Don't verify the QNAP's certificate")
+		gcInterval    = flag.Duration("gc-interval", 0, "How often the controller looks for orphaned targets, LUNs and shared folders, 0 disables it")
+		gcGracePeriod = flag.Duration("gc-grace-period", time.Hour, "How long a target, LUN or shared folder must be orphaned before it is deleted")
+		gcDelete      = flag.Bool("gc-delete", false, "Delete orphaned targets, LUNs and shared folders (with their SMB users), otherwise they are only logged")
+		kubeconfig    = flag.String("kubeconfig", "", "Kubeconfig used to list PVs and store CHAP secrets, defaults to the in-cluster config")
+		backendsFile  = flag.String("backends-config", "", "Backend config file for using several QNAPs, replaces the url, portal, storage-pool-id and tls flags")
+		nodeBackends  = flag.String("backends", driver.DefaultBackendName, "Comma separated backends this node can reach")
+		chapNamespace = flag.String("chap-secret-namespace", "", "Namespace the controller stores generated CHAP credentials in, empty disables CHAP")
+		smbNamespace  = flag.String("smb-secret-namespace", "", "Namespace the controller stores SMB volumes' credentials in, empty disables SMB")
+		metricsAddr   = flag.String("metrics-address", "", "Address to serve Prometheus metrics on, e.g. :9808, empty disables metrics")
 	)
 	flag.Parse()
 
@@ -45,13 +69,81 @@ func main() {
 		log.Fatal().Msg("Node ID must be specified")
 	}
 
+	tlsOptions := qnap.TLSOptions{
+		CAFile:             *tlsCAFile,
+		CertFile:           *tlsCertFile,
+		KeyFile:            *tlsKeyFile,
+		MinVersion:         *tlsMinVersion,
+		InsecureSkipVerify: *tlsInsecure,
+	}
+
 	if *controller {
-		username := os.Getenv("QNAP_USERNAME")
-		password := os.Getenv("QNAP_PASSWORD")
+		// Without a config file the flags describe a single backend
+		backendsConfig := driver.BackendsConfig{
+			Backends: []driver.BackendConfig{{
+				Name:          driver.DefaultBackendName,
+				URL:           *qnapURL,
+				Portal:        *portal,
+				Portals:       splitList(*extraPortals),
+				StoragePoolID: *storagePoolID,
+				NFSServer:     *nfsServer,
+				NFSNetworks:   splitList(*nfsNetworks),
+				SMBServer:     *smbServer,
+				Username:      os.Getenv("QNAP_USERNAME"),
+				Password:      os.Getenv("QNAP_PASSWORD"),
+				TLS:           tlsOptions,
+			}},
+		}
+		if *backendsFile != "" {
+			if backendsConfig, err = driver.LoadBackendsConfig(*backendsFile); err != nil {
+				log.Fatal().Err(err).Msg("Failed to load backend config")
+			}
+		}
+
+		for _, backend := range backendsConfig.Backends {
+			if strings.HasPrefix(strings.ToLower(backend.URL), "http://") {
+				log.Warn().Str("backend", backend.Name).Msg("QNAP URL is not HTTPS, credentials will be sent in plain text")
+			}
+			if backend.TLS.InsecureSkipVerify {
+				log.Warn().Str("backend", backend.Name).Msg("QNAP certificate verification is disabled")
+			}
+		}
+
 		log.Debug().Msg("Initiating controller driver")
-		if drv, err = driver.NewDriver(*endpoint, *qnapURL, username, password, *controller, *prefix, *nodeID, *portal, *storagePoolID); err != nil {
+		if drv, err = driver.NewDriver(*endpoint, backendsConfig, *controller, *prefix, *nodeID, nil); err != nil {
 			log.Fatal().Err(err).Msg("Failed to init CSI driver")
 		}
+
+		if err = drv.SetClusterID(*clusterID); err != nil {
+			log.Fatal().Err(err).Msg("Failed to set cluster ID")
+		}
+
+		var kubeClient kubernetes.Interface
+		var kubeErr error
+		if *gcInterval > 0 || *chapNamespace != "" || *smbNamespace != "" {
+			kubeClient, kubeErr = newKubeClient(*kubeconfig)
+		}
+
+		if *chapNamespace != "" {
+			if kubeErr != nil {
+				log.Fatal().Err(kubeErr).Msg("Failed to create Kubernetes client for storing CHAP secrets")
+			}
+			drv.EnableCHAP(kubeClient, *chapNamespace)
+		}
+
+		if *smbNamespace != "" {
+			if kubeErr != nil {
+				log.Fatal().Err(kubeErr).Msg("Failed to create Kubernetes client for storing SMB secrets")
+			}
+			drv.EnableSMB(kubeClient, *smbNamespace)
+		}
+
+		if *gcInterval > 0 {
+			if kubeErr != nil {
+				log.Warn().Err(kubeErr).Msg("Failed to create Kubernetes client, garbage collector won't look for volumes without a PV")
+			}
+			drv.EnableGC(driver.GCOptions{Interval: *gcInterval, GracePeriod: *gcGracePeriod, Delete: *gcDelete}, kubeClient)
+		}
 	} else {
 		if *logLevel == "debug" {
 			iscsiLib.EnableDebugLogging(os.Stdout)
@@ -59,16 +151,43 @@ func main() {
 
 		// Node mode doesnt require qnap access
 		log.Debug().Msg("Initiating node driver")
-		if drv, err = driver.NewDriver(*endpoint, *qnapURL, "", "", *controller, *prefix, *nodeID, *portal, *storagePoolID); err != nil {
+		if drv, err = driver.NewDriver(*endpoint, driver.BackendsConfig{}, *controller, *prefix, *nodeID, splitList(*nodeBackends)); err != nil {
 			log.Fatal().Err(err).Msg("Failed to init CSI driver")
 		}
 	}
 
+	if *metricsAddr != "" {
+		drv.EnableMetrics(*metricsAddr)
+	}
+
 	if err = run(drv); err != nil {
 		log.Error().Err(err).Msg("Failed to run CSI driver")
 	}
 }
 
+func splitList(list string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func newKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	// With no kubeconfig this falls back to the in-cluster config
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return clientset, nil
+}
+
 func run(drv *driver.Driver) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -0,0 +1,321 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/terrycain/qnap-csi/qnap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DefaultBackendName is the name of the backend configured with flags rather than a config file. Volume IDs from
+	// before multiple backends were supported have no backend in them and belong to the default backend.
+	DefaultBackendName = "default"
+
+	// Each backend gets its own topology key, a node which can reach several NAS units has a segment for each.
+	topologyKeyPrefix = "topology." + DefaultDriverName + "/"
+
+	// volumeIDSeparator goes between the backend and the target name in volume IDs.
+	volumeIDSeparator = "/"
+)
+
+// backendNameRegex keeps backend names usable in topology keys and volume IDs.
+var backendNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// BackendConfig describes a NAS the controller can provision volumes on.
+type BackendConfig struct {
+	Name string `json:"name"`
+	// URL of the NAS's web UI
+	URL string `json:"url"`
+	// Portal is the iSCSI portal nodes connect to, IP:PORT
+	Portal string `json:"portal"`
+	// Portals are the NAS's other iSCSI portals, e.g. on its other NICs. Nodes log in to every portal and use a
+	// multipath device
+	Portals       []string `json:"portals"`
+	StoragePoolID int      `json:"storagePoolID"`
+	// NFSServer is the address nodes mount NFS volumes from, defaults to the portal's IP
+	NFSServer string `json:"nfsServer"`
+	// NFSNetworks are the IPs and CIDR networks of the cluster's nodes, NFS volumes are only exported to them
+	NFSNetworks []string `json:"nfsNetworks"`
+	// SMBServer is the address nodes mount SMB volumes from, defaults to the portal's IP
+	SMBServer string `json:"smbServer"`
+	// Username and Password can be given directly, or read from files so they can come from a mounted Secret
+	Username     string          `json:"username"`
+	Password     string          `json:"password"`
+	UsernameFile string          `json:"usernameFile"`
+	PasswordFile string          `json:"passwordFile"`
+	TLS          qnap.TLSOptions `json:"tls"`
+}
+
+// BackendsConfig is the controller's backend config file.
+type BackendsConfig struct {
+	// DefaultBackend is used when a volume doesn't ask for a particular backend, defaults to the first one
+	DefaultBackend string          `json:"defaultBackend"`
+	Backends       []BackendConfig `json:"backends"`
+}
+
+// LoadBackendsConfig reads a YAML or JSON backend config file, including any credentials files it refers to.
+func LoadBackendsConfig(path string) (BackendsConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return BackendsConfig{}, err
+	}
+
+	var config BackendsConfig
+	if err = yaml.UnmarshalStrict(data, &config); err != nil {
+		return BackendsConfig{}, fmt.Errorf("failed to parse backend config %s: %w", path, err)
+	}
+
+	for i := range config.Backends {
+		backend := &config.Backends[i]
+		if backend.UsernameFile != "" {
+			if backend.Username, err = readCredentialFile(backend.UsernameFile); err != nil {
+				return BackendsConfig{}, err
+			}
+		}
+		if backend.PasswordFile != "" {
+			if backend.Password, err = readCredentialFile(backend.PasswordFile); err != nil {
+				return BackendsConfig{}, err
+			}
+		}
+	}
+
+	return config, nil
+}
+
+func readCredentialFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read credentials: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// backend is a NAS and the client used to talk to it.
+type backend struct {
+	name          string
+	client        *qnap.Client
+	portal        string
+	portals       []string
+	storagePoolID int
+	nfsServer     string
+	nfsNetworks   []string
+	smbServer     string
+}
+
+// newBackends creates a client for each backend, returning them by name along with the default backend's name.
+func newBackends(config BackendsConfig) (map[string]*backend, string, error) {
+	if len(config.Backends) == 0 {
+		return nil, "", errors.New("no backends configured")
+	}
+
+	backends := map[string]*backend{}
+	for _, backendConfig := range config.Backends {
+		if !backendNameRegex.MatchString(backendConfig.Name) {
+			return nil, "", fmt.Errorf("invalid backend name %q, must be a lowercase DNS label", backendConfig.Name)
+		}
+		if _, ok := backends[backendConfig.Name]; ok {
+			return nil, "", fmt.Errorf("backend %s is configured more than once", backendConfig.Name)
+		}
+
+		client, err := qnap.NewClientWithTLS(backendConfig.Username, backendConfig.Password, backendConfig.URL, backendConfig.TLS)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to create client for backend %s: %w", backendConfig.Name, err)
+		}
+
+		for _, portal := range backendConfig.Portals {
+			if err = validatePortal(portal); err != nil {
+				return nil, "", fmt.Errorf("invalid portal for backend %s: %w", backendConfig.Name, err)
+			}
+		}
+
+		for _, network := range backendConfig.NFSNetworks {
+			if err = validateNFSNetwork(network); err != nil {
+				return nil, "", fmt.Errorf("invalid NFS network for backend %s: %w", backendConfig.Name, err)
+			}
+		}
+
+		// The NAS serves NFS and SMB on the same addresses as iSCSI
+		portalHost := backendConfig.Portal
+		if host, _, err := net.SplitHostPort(backendConfig.Portal); err == nil {
+			portalHost = host
+		}
+		nfsServer := backendConfig.NFSServer
+		if nfsServer == "" {
+			nfsServer = portalHost
+		}
+		smbServer := backendConfig.SMBServer
+		if smbServer == "" {
+			smbServer = portalHost
+		}
+
+		storagePoolID := backendConfig.StoragePoolID
+		if storagePoolID == 0 {
+			storagePoolID = 1
+		}
+
+		backends[backendConfig.Name] = &backend{
+			name:          backendConfig.Name,
+			client:        client,
+			portal:        backendConfig.Portal,
+			portals:       backendConfig.Portals,
+			storagePoolID: storagePoolID,
+			nfsServer:     nfsServer,
+			nfsNetworks:   backendConfig.NFSNetworks,
+			smbServer:     smbServer,
+		}
+	}
+
+	defaultBackend := config.DefaultBackend
+	if defaultBackend == "" {
+		defaultBackend = config.Backends[0].Name
+	}
+	if _, ok := backends[defaultBackend]; !ok {
+		return nil, "", fmt.Errorf("default backend %s is not configured", defaultBackend)
+	}
+
+	return backends, defaultBackend, nil
+}
+
+func topologyKey(backendName string) string {
+	return topologyKeyPrefix + backendName
+}
+
+// topology is where volumes on the backend can be used from.
+func (b *backend) topology() *csi.Topology {
+	return &csi.Topology{Segments: map[string]string{topologyKey(b.name): "true"}}
+}
+
+func buildVolumeID(backendName, name string) string {
+	return backendName + volumeIDSeparator + name
+}
+
+// parseVolumeID splits a volume ID into its backend and target name, the backend is empty for volume IDs which
+// predate backends.
+func parseVolumeID(id string) (backendName, name string) {
+	if i := strings.Index(id, volumeIDSeparator); i >= 0 {
+		return id[:i], id[i+len(volumeIDSeparator):]
+	}
+	return "", id
+}
+
+// backendForVolume finds the backend a volume lives on and the volume's target name. Errors returned are gRPC
+// statuses.
+func (d *Driver) backendForVolume(volumeID string) (*backend, string, error) {
+	backendName, name := parseVolumeID(volumeID)
+	if backendName == "" {
+		backendName = d.defaultBackend
+	}
+
+	b, ok := d.backends[backendName]
+	if !ok {
+		return nil, "", status.Errorf(codes.NotFound, "Backend %s of volume %s is not configured", backendName, volumeID)
+	}
+
+	return b, name, nil
+}
+
+// ownedBackendForVolume is backendForVolume for the volume ID an RPC was given, volumes the driver doesn't own are
+// NotFound so they can't be changed through it.
+func (d *Driver) ownedBackendForVolume(rpc, volumeID string) (*backend, string, error) {
+	b, name, err := d.backendForVolume(volumeID)
+	if err != nil {
+		return nil, "", err
+	}
+	if !d.ownsVolume(nasVolumeName(name)) {
+		return nil, "", status.Errorf(codes.NotFound, "%s Volume ID %s not found", rpc, volumeID)
+	}
+	return b, name, nil
+}
+
+// sortedBackends returns the backends ordered by name.
+func (d *Driver) sortedBackends() []*backend {
+	backends := make([]*backend, 0, len(d.backends))
+	for _, b := range d.backends {
+		backends = append(backends, b)
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].name < backends[j].name
+	})
+	return backends
+}
+
+// backendFromTopology returns a backend the topology has access to, or nil if it has none.
+func (d *Driver) backendFromTopology(topology *csi.Topology) *backend {
+	keys := make([]string, 0, len(topology.GetSegments()))
+	for key := range topology.GetSegments() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, topologyKeyPrefix) || topology.GetSegments()[key] != "true" {
+			continue
+		}
+		if b, ok := d.backends[strings.TrimPrefix(key, topologyKeyPrefix)]; ok {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// selectBackend picks the backend for a new volume. A backend named by the StorageClass, or required by the volume's
+// content source (requiredBackend), wins, otherwise the first preferred or requisite topology with access to a
+// backend decides. Errors returned are gRPC statuses.
+func (d *Driver) selectBackend(params map[string]string, requirements *csi.TopologyRequirement, requiredBackend string) (*backend, error) {
+	backendName := params[paramBackend]
+	if requiredBackend != "" {
+		if backendName != "" && backendName != requiredBackend {
+			return nil, status.Errorf(codes.InvalidArgument, "Volume content source is on backend %s, not %s", requiredBackend, backendName)
+		}
+		backendName = requiredBackend
+	}
+
+	if backendName != "" {
+		b, ok := d.backends[backendName]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "Unknown backend %s", backendName)
+		}
+		if !d.topologiesAllow(requirements.GetRequisite(), b) {
+			return nil, status.Errorf(codes.ResourceExhausted, "Backend %s is not accessible from the requisite topology", backendName)
+		}
+		return b, nil
+	}
+
+	topologies := make([]*csi.Topology, 0, len(requirements.GetPreferred())+len(requirements.GetRequisite()))
+	topologies = append(topologies, requirements.GetPreferred()...)
+	topologies = append(topologies, requirements.GetRequisite()...)
+	for _, topology := range topologies {
+		if b := d.backendFromTopology(topology); b != nil {
+			return b, nil
+		}
+	}
+	if len(requirements.GetRequisite()) > 0 {
+		return nil, status.Error(codes.ResourceExhausted, "No backend is accessible from the requisite topology")
+	}
+
+	return d.backends[d.defaultBackend], nil
+}
+
+// topologiesAllow works out if a backend is usable from any of the topologies, no topologies means no constraints.
+func (d *Driver) topologiesAllow(topologies []*csi.Topology, b *backend) bool {
+	if len(topologies) == 0 {
+		return true
+	}
+	for _, topology := range topologies {
+		if topology.GetSegments()[topologyKey(b.name)] == "true" {
+			return true
+		}
+	}
+	return false
+}
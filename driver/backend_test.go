@@ -0,0 +1,222 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/terrycain/qnap-csi/qnap/qnaptest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestMultiBackendDriver(t *testing.T) (*Driver, *qnaptest.Server, *qnaptest.Server) {
+	t.Helper()
+
+	srvA := qnaptest.NewServer(testUsername, testPassword)
+	srvA.LUNCreatingPolls = 0
+	t.Cleanup(srvA.Close)
+	srvB := qnaptest.NewServer(testUsername, testPassword)
+	srvB.LUNCreatingPolls = 0
+	t.Cleanup(srvB.Close)
+
+	config := BackendsConfig{
+		DefaultBackend: "nas-a",
+		Backends:       []BackendConfig{newTestBackendConfig("nas-a", srvA), newTestBackendConfig("nas-b", srvB)},
+	}
+	d, err := NewDriver("unix:///tmp/csi.sock", config, true, DefaultVolumePrefix, "node1", nil)
+	if err != nil {
+		t.Fatalf("failed to init driver: %#v", err)
+	}
+	return d, srvA, srvB
+}
+
+func newTestTopology(backendName string) *csi.Topology {
+	return &csi.Topology{Segments: map[string]string{topologyKey(backendName): "true"}}
+}
+
+func Test_parseVolumeID(t *testing.T) {
+	tests := []struct {
+		input       string
+		wantBackend string
+		wantName    string
+	}{
+		{input: "nas-a/pvc1", wantBackend: "nas-a", wantName: "pvc1"},
+		{input: "pvc1", wantBackend: "", wantName: "pvc1"},
+		{input: "nas-a/pvc1@snap", wantBackend: "nas-a", wantName: "pvc1@snap"},
+	}
+
+	for _, table := range tests {
+		backendName, name := parseVolumeID(table.input)
+		if backendName != table.wantBackend || name != table.wantName {
+			t.Fatalf("expected: %s %s, got: %s %s", table.wantBackend, table.wantName, backendName, name)
+		}
+	}
+}
+
+func TestDriver_selectBackend(t *testing.T) {
+	d, _, _ := newTestMultiBackendDriver(t)
+
+	tests := []struct {
+		params       map[string]string
+		requirements *csi.TopologyRequirement
+		required     string
+		want         string
+		wantCode     codes.Code
+	}{
+		{want: "nas-a"},
+		{params: map[string]string{"backend": "nas-b"}, want: "nas-b"},
+		{params: map[string]string{"backend": "nas-c"}, wantCode: codes.InvalidArgument},
+		{required: "nas-b", want: "nas-b"},
+		{params: map[string]string{"backend": "nas-a"}, required: "nas-b", wantCode: codes.InvalidArgument},
+		{requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{newTestTopology("nas-b")}}, want: "nas-b"},
+		{requirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{newTestTopology("nas-a"), newTestTopology("nas-b")},
+			Preferred: []*csi.Topology{newTestTopology("nas-b")},
+		}, want: "nas-b"},
+		{requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{newTestTopology("nas-c")}}, wantCode: codes.ResourceExhausted},
+		{params: map[string]string{"backend": "nas-a"}, requirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{newTestTopology("nas-b")}}, wantCode: codes.ResourceExhausted},
+	}
+
+	for _, table := range tests {
+		b, err := d.selectBackend(table.params, table.requirements, table.required)
+		if status.Code(err) != table.wantCode {
+			t.Fatalf("%v %v %s: expected: %v, got: %v", table.params, table.requirements, table.required, table.wantCode, err)
+		}
+		if err == nil && b.name != table.want {
+			t.Fatalf("%v %v %s: expected: %s, got: %s", table.params, table.requirements, table.required, table.want, b.name)
+		}
+	}
+}
+
+func TestDriver_CreateVolumeTopology(t *testing.T) {
+	ctx := context.Background()
+	d, srvA, srvB := newTestMultiBackendDriver(t)
+
+	req := newCreateVolumeRequest("pvc-1", 10*giB)
+	req.AccessibilityRequirements = &csi.TopologyRequirement{Requisite: []*csi.Topology{newTestTopology("nas-b")}}
+	resp, err := d.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+	if resp.Volume.VolumeId != "nas-b/csi-pvc1" {
+		t.Fatalf("expected: nas-b/csi-pvc1, got: %s", resp.Volume.VolumeId)
+	}
+	if len(resp.Volume.AccessibleTopology) != 1 || resp.Volume.AccessibleTopology[0].Segments[topologyKey("nas-b")] != "true" {
+		t.Fatalf("unexpected topology %v", resp.Volume.AccessibleTopology)
+	}
+	if len(srvA.Targets()) != 0 || len(srvB.Targets()) != 1 {
+		t.Fatalf("expected the volume on nas-b, have %d and %d targets", len(srvA.Targets()), len(srvB.Targets()))
+	}
+
+	// Clones have to stay on the source's backend
+	clone := newCreateVolumeRequest("pvc-2", 10*giB)
+	clone.VolumeContentSource = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{
+		Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: resp.Volume.VolumeId},
+	}}
+	if resp, err = d.CreateVolume(ctx, clone); err != nil {
+		t.Fatalf("failed to clone volume: %#v", err)
+	}
+	if resp.Volume.VolumeId != "nas-b/csi-pvc2" {
+		t.Fatalf("expected: nas-b/csi-pvc2, got: %s", resp.Volume.VolumeId)
+	}
+
+	if _, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "nas-b/csi-pvc1"}); err != nil {
+		t.Fatalf("failed to delete volume: %#v", err)
+	}
+	if len(srvB.Targets()) != 1 {
+		t.Fatalf("expected 1 target left on nas-b, have %d", len(srvB.Targets()))
+	}
+	if _, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "nas-c/pvc1"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found for an unknown backend, got %#v", err)
+	}
+}
+
+func TestDriver_CreateVolumePortals(t *testing.T) {
+	ctx := context.Background()
+	srv := qnaptest.NewServer(testUsername, testPassword)
+	srv.LUNCreatingPolls = 0
+	t.Cleanup(srv.Close)
+
+	config := newTestBackendConfig(DefaultBackendName, srv)
+	config.Portals = []string{"127.0.0.2:3260"}
+	d, err := NewDriver("unix:///tmp/csi.sock", BackendsConfig{Backends: []BackendConfig{config}}, true, DefaultVolumePrefix, "node1", nil)
+	if err != nil {
+		t.Fatalf("failed to init driver: %#v", err)
+	}
+
+	tests := []struct {
+		name   string
+		params map[string]string
+		want   string
+	}{
+		{name: "pvc-1", want: `["127.0.0.2:3260"]`},
+		{name: "pvc-2", params: map[string]string{"portals": "127.0.0.3:3260,127.0.0.4:3260"}, want: `["127.0.0.3:3260","127.0.0.4:3260"]`},
+		{name: "pvc-3", params: map[string]string{"portals": ""}, want: `[]`},
+	}
+
+	for _, table := range tests {
+		req := newCreateVolumeRequest(table.name, 10*giB)
+		req.Parameters = table.params
+		resp, err := d.CreateVolume(ctx, req)
+		if err != nil {
+			t.Fatalf("failed to create volume: %#v", err)
+		}
+		if resp.Volume.VolumeContext["portals"] != table.want {
+			t.Fatalf("expected: %s, got: %s", table.want, resp.Volume.VolumeContext["portals"])
+		}
+	}
+
+	config.Portals = []string{"nas-a"}
+	if _, err = NewDriver("unix:///tmp/csi.sock", BackendsConfig{Backends: []BackendConfig{config}}, true, DefaultVolumePrefix, "node1", nil); err == nil {
+		t.Fatal("expected an error for a portal that isn't an IP")
+	}
+}
+
+func TestDriver_LegacyVolumeID(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestDriver(t)
+
+	if _, err := d.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 10*giB)); err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+
+	// Volumes created before backends existed have no backend in their ID
+	resp, err := d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: "csi-pvc1", CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB}})
+	if err != nil {
+		t.Fatalf("failed to expand volume: %#v", err)
+	}
+	if resp.CapacityBytes != 20*giB {
+		t.Fatalf("expected: %d, got: %d", 20*giB, resp.CapacityBytes)
+	}
+}
+
+func TestLoadBackendsConfig(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "backends.yaml")
+	config := "defaultBackend: nas-b\nbackends:\n- name: nas-a\n  url: https://nas-a\n- name: nas-b\n  url: https://nas-b\n  username: admin\n  passwordFile: " + passwordFile + "\n"
+	if err := ioutil.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := LoadBackendsConfig(configFile)
+	if err != nil {
+		t.Fatalf("failed to load config: %#v", err)
+	}
+	if got.DefaultBackend != "nas-b" || len(got.Backends) != 2 || got.Backends[1].Password != "secret" {
+		t.Fatalf("unexpected config %#v", got)
+	}
+
+	if err = ioutil.WriteFile(configFile, []byte("backends:\n- name: nas-a\n  uri: https://nas-a\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadBackendsConfig(configFile); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
@@ -0,0 +1,135 @@
+package driver
+
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// CHAPSecretPrefix goes before the PV name to make the name of a volume's CHAP Secret, StorageClasses point nodes
+	// at it with csi.storage.k8s.io/node-stage-secret-name: qnap-chap-${pv.name}
+	CHAPSecretPrefix = "qnap-chap-"
+
+	// Secret keys, the same names open-iscsi uses
+	chapUsernameKey       = "node.session.auth.username"
+	chapPasswordKey       = "node.session.auth.password"
+	mutualCHAPUsernameKey = "node.session.auth.username_in"
+	mutualCHAPPasswordKey = "node.session.auth.password_in"
+
+	// The NAS only accepts CHAP passwords of 12 to 16 characters
+	chapPasswordLength = 16
+	passwordChars      = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// chapCredentials are a target's CHAP credentials, the mutual ones are empty unless mutual CHAP is on.
+type chapCredentials struct {
+	username       string
+	password       string
+	mutualUsername string
+	mutualPassword string
+}
+
+func (c *chapCredentials) mutual() bool {
+	return c.mutualUsername != ""
+}
+
+// secretData is how credentials are stored in a Secret.
+func (c *chapCredentials) secretData() map[string][]byte {
+	data := map[string][]byte{
+		chapUsernameKey: []byte(c.username),
+		chapPasswordKey: []byte(c.password),
+	}
+	if c.mutual() {
+		data[mutualCHAPUsernameKey] = []byte(c.mutualUsername)
+		data[mutualCHAPPasswordKey] = []byte(c.mutualPassword)
+	}
+	return data
+}
+
+func chapCredentialsFromSecret(data map[string][]byte) *chapCredentials {
+	return &chapCredentials{
+		username:       string(data[chapUsernameKey]),
+		password:       string(data[chapPasswordKey]),
+		mutualUsername: string(data[mutualCHAPUsernameKey]),
+		mutualPassword: string(data[mutualCHAPPasswordKey]),
+	}
+}
+
+// EnableCHAP lets StorageClasses ask for CHAP, volumes' credentials are kept in Secrets in namespace.
+func (d *Driver) EnableCHAP(kubeClient kubernetes.Interface, namespace string) {
+	d.chapSecrets = &credentialStore{
+		client:       kubeClient,
+		namespace:    namespace,
+		kind:         "CHAP",
+		owner:        "target",
+		requiredKeys: []string{chapUsernameKey, chapPasswordKey},
+	}
+}
+
+// getOrCreateCHAPCredentials returns the credentials for a new volume's target, or nil if the StorageClass didn't ask
+// for CHAP. They're only generated once, so retries of CreateVolume get the same ones. Errors returned are gRPC
+// statuses.
+func (d *Driver) getOrCreateCHAPCredentials(ctx context.Context, volumeName string, b *backend, targetName string, params lunParameters) (*chapCredentials, error) {
+	if !params.chap {
+		return nil, nil
+	}
+	if d.chapSecrets == nil {
+		return nil, status.Error(codes.FailedPrecondition, "CHAP was requested but the controller has no namespace to store CHAP secrets in")
+	}
+
+	data, _, err := d.chapSecrets.getOrCreate(ctx, CHAPSecretPrefix+volumeName, b.name, targetName, func() (map[string][]byte, error) {
+		credentials, err := newCHAPCredentials(targetName, params.mutualCHAP)
+		if err != nil {
+			return nil, err
+		}
+		return credentials.secretData(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chapCredentialsFromSecret(data), nil
+}
+
+// deleteCHAPCredentials removes a volume's CHAP secret if CHAP is enabled. Errors returned are gRPC statuses.
+func (d *Driver) deleteCHAPCredentials(ctx context.Context, b *backend, targetName string) error {
+	if d.chapSecrets == nil {
+		return nil
+	}
+	return d.chapSecrets.delete(ctx, b.name, targetName)
+}
+
+// newCHAPCredentials generates random credentials for a target, mutual CHAP ones too if asked for.
+func newCHAPCredentials(targetName string, mutual bool) (*chapCredentials, error) {
+	password, err := randomPassword(chapPasswordLength)
+	if err != nil {
+		return nil, err
+	}
+	credentials := &chapCredentials{username: targetName, password: password}
+
+	if mutual {
+		if credentials.mutualPassword, err = randomPassword(chapPasswordLength); err != nil {
+			return nil, err
+		}
+		credentials.mutualUsername = targetName + "target"
+	}
+
+	return credentials, nil
+}
+
+// randomPassword generates a password of letters and numbers, which the NAS takes anywhere it wants a password.
+func randomPassword(length int) (string, error) {
+	password := make([]byte, length)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(passwordChars))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = passwordChars[n.Int64()]
+	}
+	return string(password), nil
+}
@@ -0,0 +1,117 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testCHAPNamespace = "qnap-csi"
+
+func TestDriver_CreateVolumeCHAP(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+	kubeClient := fake.NewSimpleClientset()
+	d.EnableCHAP(kubeClient, testCHAPNamespace)
+
+	req := newCreateVolumeRequest("pvc-1", 10*giB)
+	req.Parameters = map[string]string{"mutualChap": "true"}
+	resp, err := d.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+	if resp.Volume.VolumeContext["sessionCHAPAuth"] != "true" {
+		t.Fatalf("expected the volume context to say CHAP is needed, got %v", resp.Volume.VolumeContext)
+	}
+
+	secret, err := kubeClient.CoreV1().Secrets(testCHAPNamespace).Get(ctx, CHAPSecretPrefix+"pvc-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get CHAP secret: %#v", err)
+	}
+	targets := srv.Targets()
+	if len(targets) != 1 {
+		t.Fatalf("expected 1 target, have %d", len(targets))
+	}
+	if targets[0].CHAPUsername == "" || targets[0].CHAPUsername != string(secret.Data[chapUsernameKey]) || targets[0].CHAPPassword != string(secret.Data[chapPasswordKey]) {
+		t.Fatalf("target and secret CHAP credentials differ, %#v %v", targets[0], secret.Data)
+	}
+	if targets[0].MutualCHAPPassword == "" || targets[0].MutualCHAPPassword != string(secret.Data[mutualCHAPPasswordKey]) {
+		t.Fatalf("target and secret mutual CHAP credentials differ, %#v %v", targets[0], secret.Data)
+	}
+	if len(targets[0].CHAPPassword) != chapPasswordLength {
+		t.Fatalf("expected: %d, got: %d", chapPasswordLength, len(targets[0].CHAPPassword))
+	}
+
+	// Secrets given to the node are what it logs in with
+	diskInfo, err := getISCSIInfo(&csi.NodeStageVolumeRequest{VolumeId: resp.Volume.VolumeId, VolumeContext: resp.Volume.VolumeContext, Secrets: stringData(secret.Data)})
+	if err != nil {
+		t.Fatalf("failed to get ISCSI info: %#v", err)
+	}
+	if diskInfo.sessionSecret.UserName != targets[0].CHAPUsername || diskInfo.sessionSecret.PasswordIn != targets[0].MutualCHAPPassword {
+		t.Fatalf("unexpected session secret %#v", diskInfo.sessionSecret)
+	}
+	if _, err = getISCSIInfo(&csi.NodeStageVolumeRequest{VolumeId: resp.Volume.VolumeId, VolumeContext: resp.Volume.VolumeContext}); err == nil {
+		t.Fatal("expected an error without the CHAP secret")
+	}
+
+	if _, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: resp.Volume.VolumeId}); err != nil {
+		t.Fatalf("failed to delete volume: %#v", err)
+	}
+	secrets, err := kubeClient.CoreV1().Secrets(testCHAPNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list secrets: %#v", err)
+	}
+	if len(secrets.Items) != 0 {
+		t.Fatalf("expected the CHAP secret to be deleted, have %d secrets", len(secrets.Items))
+	}
+}
+
+func TestDriver_CreateVolumeCHAPRetry(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+	d.EnableCHAP(fake.NewSimpleClientset(), testCHAPNamespace)
+
+	// A previous attempt stored credentials and created the target before failing
+	params := lunParameters{chap: true}
+	credentials, err := d.getOrCreateCHAPCredentials(ctx, "pvc-1", d.backends[DefaultBackendName], "csi-pvc1", params)
+	if err != nil {
+		t.Fatalf("failed to create CHAP credentials: %#v", err)
+	}
+	if _, err = d.backends[DefaultBackendName].client.CreateStorageISCSITarget(ctx, "csi-pvc1", false, false, true); err != nil {
+		t.Fatalf("failed to create target: %#v", err)
+	}
+
+	req := newCreateVolumeRequest("pvc-1", 10*giB)
+	req.Parameters = map[string]string{"chap": "true"}
+	if _, err = d.CreateVolume(ctx, req); err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+
+	targets := srv.Targets()
+	if len(targets) != 1 || targets[0].CHAPPassword != credentials.password {
+		t.Fatalf("expected the stored credentials to be reused, got %#v", targets)
+	}
+}
+
+func TestDriver_CreateVolumeCHAPDisabled(t *testing.T) {
+	d, _ := newTestDriver(t)
+
+	req := newCreateVolumeRequest("pvc-1", 10*giB)
+	req.Parameters = map[string]string{"chap": "true"}
+	if _, err := d.CreateVolume(context.Background(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected: %v, got: %v", codes.FailedPrecondition, err)
+	}
+}
+
+func stringData(data map[string][]byte) map[string]string {
+	result := make(map[string]string, len(data))
+	for key, value := range data {
+		result[key] = string(value)
+	}
+	return result
+}
@@ -2,14 +2,20 @@ package driver
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/rs/zerolog/log"
+	"github.com/terrycain/qnap-csi/qnap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 	"k8s.io/apimachinery/pkg/util/sets"
 )
@@ -35,11 +41,14 @@ const (
 	// the size they provided did not satisfy our requirements.
 	defaultVolumeSizeInBytes int64 = 16 * giB
 
+	// rollbackTimeout bounds how long cleaning up after a failed CreateVolume can take.
+	rollbackTimeout = 1 * time.Minute
+
 	// DefaultVolumePrefix is the CSI Volume prefix.
 	DefaultVolumePrefix string = "csi"
 )
 
-// we only support accessModes.ReadWriteOnce for iscsi volumes will change if we support NFS.
+// we only support accessModes.ReadWriteOnce for iscsi volumes, NFS and SMB volumes support sharedFolderAccessModes.
 var supportedAccessMode = &csi.VolumeCapability_AccessMode{
 	Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 }
@@ -53,7 +62,8 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume capabilities must be provided")
 	}
 
-	if violations := validateCapabilities(req.VolumeCapabilities); len(violations) > 0 {
+	// An invalid protocol is reported by parseLUNParameters
+	if violations := validateCapabilities(req.VolumeCapabilities, req.GetParameters()[paramProtocol]); len(violations) > 0 {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume capabilities cannot be satisified: %s", strings.Join(violations, "; ")))
 	}
 
@@ -66,102 +76,348 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	}
 	sizeGB := size / (1 * giB)
 	log.Debug().Int64("raw_size_gib", sizeGB).Msg("Raw size requested in gigabytes")
-	name := cleanISCSIName(req.Name)
+	name := d.volumeName(req.Name)
+	if cleanISCSIName(req.Name) == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume Name %q must contain letters or numbers", req.Name)
+	}
 
-	if err = d.client.Login(); err != nil {
-		log.Error().Err(err).Msg("Failed to login to NAS")
-		return nil, status.Error(codes.Internal, "Failed to login to NAS")
+	sourceBackend, err := d.contentSourceBackend(req.GetVolumeContentSource())
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.selectBackend(req.GetParameters(), req.GetAccessibilityRequirements(), sourceBackend)
+	if err != nil {
+		return nil, err
 	}
+	log.Debug().Str("backend", b.name).Msg("Selected backend")
 
-	// Check volume doesnt already have a target for it
-	targetList, err := d.client.GetStorageISCSITargetList()
+	lunParams, err := parseLUNParameters(req.GetParameters(), b.storagePoolID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case lunParams.nfs:
+		return d.createNFSVolume(ctx, req, b, name, size, lunParams)
+	case lunParams.smb:
+		return d.createSMBVolume(ctx, req, b, name, size, lunParams)
+	}
+
+	// A previous attempt at creating this volume may have got part of the way through, so pick up anything it left
+	target, err := b.getTargetByName(ctx, name)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
-		return nil, status.Error(codes.Internal, "Failed to get list of ISCSI targets")
+		return nil, nasError(err, "Failed to get list of ISCSI targets")
 	}
-	for _, target := range targetList.Targets {
-		if target.Name == name {
-			return nil, status.Error(codes.AlreadyExists, "Volume already exists")
-		}
+	if target != nil && len(target.TargetLUNs) > 0 {
+		return d.existingVolume(ctx, req, b, target, size, lunParams)
+	}
+
+	// A previous attempt may have stored credentials already, the target has to be given the same ones nodes get
+	credentials, err := d.getOrCreateCHAPCredentials(ctx, req.Name, b, name, lunParams)
+	if err != nil {
+		return nil, err
+	}
+
+	existingLUN, err := b.getLUNByName(ctx, name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of ISCSI LUNs")
+		return nil, nasError(err, "Failed to get list of ISCSI LUNs")
 	}
 
 	// By now the volume should be ok to create, so we need a LUN, a target, an initiator, attach lun to target
 	// then wait for lun to be ready
-	targetIndex, err := d.client.CreateStorageISCSITarget(name, false, false, true)
-	if err != nil {
+	var targetIndex int
+	if target != nil {
+		log.Info().Str("name", name).Int("target_index", target.TargetIndex).Msg("Reusing ISCSI target from a previous attempt")
+		targetIndex = target.TargetIndex
+	} else if targetIndex, err = b.client.CreateStorageISCSITarget(ctx, name, false, false, true); err != nil {
 		log.Error().Err(err).Msg("Failed to create ISCSI target")
-		return nil, status.Error(codes.Internal, "Failed to create ISCSI target")
+		return nil, nasError(err, "Failed to create ISCSI target")
 	}
 
-	if err = d.client.CreateStorageISCSIInitiator(targetIndex, false, "", "", false, "", ""); err != nil {
-		_ = d.client.DeleteStorageISCSITarget(targetIndex)
+	// Adding the initiator again is harmless, so there's no need to work out if the previous attempt got this far
+	if credentials != nil {
+		err = b.client.CreateStorageISCSIInitiator(ctx, targetIndex, true, credentials.username, credentials.password, credentials.mutual(), credentials.mutualUsername, credentials.mutualPassword)
+	} else {
+		err = b.client.CreateStorageISCSIInitiator(ctx, targetIndex, false, "", "", false, "", "")
+	}
+	if err != nil {
+		b.rollbackVolume(targetIndex, -1)
 		log.Error().Err(err).Msg("Failed to create ISCSI initator")
-		return nil, status.Error(codes.Internal, "Failed to create ISCSI initator")
+		return nil, nasError(err, "Failed to create ISCSI initator")
 	}
 
-	// Create LUN
-	log.Debug().Msg("Creating LUN")
-	block, err := d.client.CreateStorageISCSIBlockLUN(name, d.storagePoolID, int(sizeGB), false, 512, false, false, false, false)
-	if err != nil {
-		_ = d.client.DeleteStorageISCSITarget(targetIndex)
-		log.Error().Err(err).Msg("Failed to create ISCSI Block based LUN")
-		return nil, status.Error(codes.Internal, "Failed to create ISCSI Block based LUN")
+	// Create LUN, either empty or from an existing snapshot/volume
+	var lunIndex int
+	switch {
+	case existingLUN != nil:
+		log.Info().Str("name", name).Int("lun_index", existingLUN.Index).Msg("Reusing LUN from a previous attempt")
+		lunIndex = existingLUN.Index
+	case req.GetVolumeContentSource() != nil:
+		log.Debug().Msg("Creating LUN from content source")
+		if lunIndex, err = b.createLUNFromContentSource(ctx, name, req.GetVolumeContentSource(), size); err != nil {
+			b.rollbackVolume(targetIndex, -1)
+			return nil, err
+		}
+	default:
+		log.Debug().Msg("Creating LUN")
+		block, lunErr := b.client.CreateStorageISCSIBlockLUN(ctx, name, lunParams.storagePoolID, int(sizeGB), lunParams.thinAllocate, lunParams.sectorSize, lunParams.writeCache, lunParams.fua, lunParams.ssdCache, lunParams.tiering)
+		if lunErr != nil {
+			b.rollbackVolume(targetIndex, -1)
+			log.Error().Err(lunErr).Msg("Failed to create ISCSI Block based LUN")
+			return nil, nasError(lunErr, "Failed to create ISCSI Block based LUN")
+		}
+		lunIndex = block.Result
 	}
 
 	log.Debug().Msg("Waiting for LUN")
 	// Lets wait for the lun to be ready
+	waitStart := time.Now()
 	for {
-		lunInfo, lunErr := d.client.GetStorageISCSILun(block.Result)
+		lunInfo, lunErr := b.client.GetStorageISCSILun(ctx, lunIndex)
 		if lunErr != nil {
 			log.Error().Err(lunErr).Msg("Failed to get ISCSI Block based LUN readiness")
-			return nil, status.Error(codes.Internal, "Failed to get ISCSI Block based LUN readiness")
+			return nil, nasError(lunErr, "Failed to get ISCSI Block based LUN readiness")
 		}
-		if lunInfo.StatusString() == "creating" {
-			time.Sleep(1 * time.Second)
-			continue
+		if lunInfo.StatusString() != "creating" {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			b.rollbackVolume(targetIndex, lunIndex)
+			log.Error().Err(ctx.Err()).Msg("Gave up waiting for ISCSI Block based LUN")
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-time.After(1 * time.Second):
 		}
-		break
+	}
+	d.metrics.observeLUNWait(b.name, time.Since(waitStart))
+
+	if req.GetVolumeContentSource() != nil || existingLUN != nil {
+		// Clones come out the size of their source, so grow them if a bigger volume was asked for. A LUN from a previous
+		// attempt may have been a clone that didn't get grown.
+		if err = b.growClonedLUN(ctx, name, lunIndex, size); err != nil {
+			b.rollbackVolume(targetIndex, lunIndex)
+			return nil, err
+		}
+	}
+
+	// Nothing gets to use the LUN until it's published to a node
+	if err = b.client.SetStorageISCSILUNPermission(ctx, qnap.DefaultPolicyIndex, lunIndex, qnap.LUNPermissionDeny); err != nil {
+		b.rollbackVolume(targetIndex, lunIndex)
+		log.Error().Err(err).Msg("Failed to mask LUN")
+		return nil, nasError(err, "Failed to mask LUN")
 	}
 
 	log.Debug().Msg("Attaching Target to LUN")
-	if err = d.client.AttachStorageISCSITargetLUN(block.Result, targetIndex); err != nil {
-		_ = d.client.DeleteStorageISCSITarget(targetIndex)
-		_ = d.client.DeleteStorageISCSIBlockLUN(block.Result, false)
+	if err = b.client.AttachStorageISCSITargetLUN(ctx, lunIndex, targetIndex); err != nil {
+		b.rollbackVolume(targetIndex, lunIndex)
 		log.Error().Err(err).Msg("Failed to associate LUN with ISCSI target")
-		return nil, status.Error(codes.Internal, "Failed to associate LUN with ISCSI target")
+		return nil, nasError(err, "Failed to associate LUN with ISCSI target")
 	}
 
-	targetList, err = d.client.GetStorageISCSITargetList()
-	if err != nil {
+	if target, err = b.getTargetByName(ctx, name); err != nil {
 		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
-		return nil, status.Error(codes.Internal, "Failed to get list of ISCSI targets")
+		return nil, nasError(err, "Failed to get list of ISCSI targets")
 	}
-	iqn := ""
-	for _, target := range targetList.Targets {
-		if target.Name == name {
-			iqn = target.IQN
-			break
+	if target == nil || target.IQN == "" {
+		log.Error().Msg("Failed to get ISCSI IQN")
+		return nil, status.Error(codes.Internal, "Failed to get ISCSI IQN")
+	}
+
+	return d.createVolumeResponse(b, name, size, target.IQN, req.GetVolumeContentSource(), lunParams), nil
+}
+
+// rollbackVolume removes what a failed CreateVolume managed to create, a lunIndex of -1 means no LUN was created. It
+// doesn't use the request's context as that may be why CreateVolume failed. Anything it fails to remove is left for the
+// orphan garbage collector.
+func (b *backend) rollbackVolume(targetIndex, lunIndex int) {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	if lunIndex >= 0 {
+		if err := b.client.DeleteStorageISCSIBlockLUN(ctx, lunIndex, false); err != nil && !errors.Is(err, qnap.ErrNotFound) {
+			log.Warn().Err(err).Int("lun_index", lunIndex).Msg("Failed to roll back ISCSI Block based LUN")
 		}
 	}
-	if iqn == "" {
-		log.Error().Err(err).Msg("Failed to get ISCSI IQN")
-		return nil, status.Error(codes.Internal, "Failed to get ISCSI IQN")
+	if err := b.client.DeleteStorageISCSITarget(ctx, targetIndex); err != nil && !errors.Is(err, qnap.ErrNotFound) {
+		log.Warn().Err(err).Int("target_index", targetIndex).Msg("Failed to roll back ISCSI target")
+	}
+}
+
+// existingVolume handles CreateVolume being called again for a volume which has already been created, which is fine
+// as long as the volume is compatible with what's being asked for.
+func (d *Driver) existingVolume(ctx context.Context, req *csi.CreateVolumeRequest, b *backend, target *qnap.StorageISCSITargetInfoXML, size int64, params lunParameters) (*csi.CreateVolumeResponse, error) {
+	capacity, err := b.getLUNCapacity(ctx, target.TargetLUNs[0])
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get ISCSI Block based LUN capacity")
+		return nil, nasError(err, "Failed to get ISCSI Block based LUN capacity")
+	}
+
+	limit := req.GetCapacityRange().GetLimitBytes()
+	if capacity < size || (limit > 0 && capacity > limit) {
+		return nil, status.Errorf(codes.AlreadyExists, "Volume already exists with a different size of %s", formatBytes(capacity))
 	}
 
+	log.Info().Str("name", target.Name).Msg("Volume already exists")
+	return d.createVolumeResponse(b, target.Name, capacity, target.IQN, req.GetVolumeContentSource(), params), nil
+}
+
+func (d *Driver) createVolumeResponse(b *backend, name string, capacity int64, iqn string, source *csi.VolumeContentSource, params lunParameters) *csi.CreateVolumeResponse {
+	// Nodes log in to every portal, more than one gets them a multipath device
+	portals := params.portals
+	if portals == nil {
+		portals = b.portals
+	}
+	if portals == nil {
+		portals = []string{}
+	}
+	portalsJSON, _ := json.Marshal(portals)
+
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      name,
-			CapacityBytes: size,
+			VolumeId:      buildVolumeID(b.name, name),
+			CapacityBytes: capacity,
+			ContentSource: source,
 			VolumeContext: map[string]string{
-				"targetPortal": d.portal,
+				"targetPortal": b.portal,
 				"iqn":          iqn,
 				"lun":          "0",
-				"portals":      "[]",
+				"portals":      string(portalsJSON),
 			},
+			AccessibleTopology: []*csi.Topology{b.topology()},
 		},
 	}
+	if params.chap {
+		// Only a flag, the credentials come to nodes as secrets so they aren't kept in the PV
+		resp.Volume.VolumeContext["sessionCHAPAuth"] = "true"
+	}
+	return resp
+}
 
-	return resp, nil
+// contentSourceBackend returns the name of the backend a volume content source is on, clones can only be made on the
+// same NAS. It's empty if there is no content source. Errors returned are gRPC statuses.
+func (d *Driver) contentSourceBackend(source *csi.VolumeContentSource) (string, error) {
+	var sourceVolumeID string
+	switch {
+	case source == nil:
+		return "", nil
+	case source.GetSnapshot() != nil:
+		var err error
+		if sourceVolumeID, _, err = parseSnapshotID(source.GetSnapshot().GetSnapshotId()); err != nil {
+			return "", status.Errorf(codes.NotFound, "Snapshot %s not found", source.GetSnapshot().GetSnapshotId())
+		}
+	case source.GetVolume() != nil:
+		sourceVolumeID = source.GetVolume().GetVolumeId()
+	default:
+		return "", status.Error(codes.InvalidArgument, "Unsupported volume content source")
+	}
+
+	b, _, err := d.ownedBackendForVolume("CreateVolume source", sourceVolumeID)
+	if err != nil {
+		return "", err
+	}
+	return b.name, nil
+}
+
+// createLUNFromContentSource clones a new LUN called name from a snapshot or a volume, returning its index. Volumes are
+// cloned by way of a temporary snapshot. Errors returned are gRPC statuses.
+func (b *backend) createLUNFromContentSource(ctx context.Context, name string, source *csi.VolumeContentSource, size int64) (int, error) {
+	var sourceVolumeID, snapshotName string
+	temporarySnapshot := false
+
+	switch {
+	case source.GetSnapshot() != nil:
+		var err error
+		if sourceVolumeID, snapshotName, err = parseSnapshotID(source.GetSnapshot().GetSnapshotId()); err != nil {
+			return 0, status.Errorf(codes.NotFound, "Snapshot %s not found", source.GetSnapshot().GetSnapshotId())
+		}
+	case source.GetVolume() != nil:
+		sourceVolumeID = source.GetVolume().GetVolumeId()
+		snapshotName = "clone" + name
+		temporarySnapshot = true
+	default:
+		return 0, status.Error(codes.InvalidArgument, "Unsupported volume content source")
+	}
+
+	// contentSourceBackend has already made sure the source is on this backend
+	_, sourceName := parseVolumeID(sourceVolumeID)
+	target, err := b.getTargetByName(ctx, sourceName)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
+		return 0, nasError(err, "Failed to get list of ISCSI targets")
+	}
+	if target == nil || len(target.TargetLUNs) == 0 {
+		return 0, status.Errorf(codes.NotFound, "Source volume %s not found", sourceVolumeID)
+	}
+	sourceLUNIndex := target.TargetLUNs[0]
+
+	sourceSize, err := b.getLUNCapacity(ctx, sourceLUNIndex)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get ISCSI Block based LUN capacity")
+		return 0, nasError(err, "Failed to get ISCSI Block based LUN capacity")
+	}
+	if size < sourceSize {
+		return 0, status.Errorf(codes.OutOfRange, "Requested size %s is smaller than the source size %s", formatBytes(size), formatBytes(sourceSize))
+	}
+
+	snapshot, err := b.getSnapshotByName(ctx, sourceLUNIndex, snapshotName)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of LUN snapshots")
+		return 0, nasError(err, "Failed to get list of LUN snapshots")
+	}
+	if snapshot == nil && temporarySnapshot {
+		log.Debug().Int("lun_index", sourceLUNIndex).Str("snapshot_name", snapshotName).Msg("Creating temporary LUN snapshot for clone")
+		if _, err = b.client.CreateStorageISCSISnapshot(ctx, sourceLUNIndex, snapshotName, false); err != nil {
+			log.Error().Err(err).Msg("Failed to create LUN snapshot")
+			return 0, nasError(err, "Failed to create LUN snapshot")
+		}
+		if snapshot, err = b.getSnapshotByName(ctx, sourceLUNIndex, snapshotName); err != nil {
+			log.Error().Err(err).Msg("Failed to get list of LUN snapshots")
+			return 0, nasError(err, "Failed to get list of LUN snapshots")
+		}
+	}
+	if snapshot == nil {
+		return 0, status.Errorf(codes.NotFound, "Snapshot %s not found", buildSnapshotID(sourceVolumeID, snapshotName))
+	}
+	if temporarySnapshot {
+		// The clone has its own copy of the data, so the snapshot isn't needed anymore, and if cloning failed a retry
+		// takes a new one
+		defer func() {
+			if err := b.client.DeleteStorageISCSISnapshot(ctx, snapshot.ID); err != nil && !errors.Is(err, qnap.ErrNotFound) {
+				log.Warn().Err(err).Int("snapshot_id", snapshot.ID).Msg("Failed to delete temporary LUN snapshot")
+			}
+		}()
+	}
+
+	log.Debug().Int("snapshot_id", snapshot.ID).Msg("Cloning LUN snapshot")
+	lunIndex, err := b.client.CloneStorageISCSISnapshot(ctx, snapshot.ID, name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to clone LUN snapshot")
+		return 0, nasError(err, "Failed to clone LUN snapshot")
+	}
+
+	return lunIndex, nil
+}
+
+// growClonedLUN expands a cloned LUN up to size if needed. Errors returned are gRPC statuses.
+func (b *backend) growClonedLUN(ctx context.Context, name string, lunIndex int, size int64) error {
+	currentSize, err := b.getLUNCapacity(ctx, lunIndex)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get ISCSI Block based LUN capacity")
+		return nasError(err, "Failed to get ISCSI Block based LUN capacity")
+	}
+	if currentSize >= size {
+		return nil
+	}
+
+	log.Debug().Str("name", name).Int64("size_gib", size/giB).Msg("Expanding cloned LUN")
+	if err = b.client.ExpandStorageISCSIBlockLUN(ctx, lunIndex, int(size/giB)); err != nil {
+		log.Error().Err(err).Msg("Failed to expand ISCSI Block based LUN")
+		return nasError(err, "Failed to expand ISCSI Block based LUN")
+	}
+
+	return nil
 }
 
 func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
@@ -169,35 +425,52 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "DeleteVolume Volume ID must be provided")
 	}
 
-	if err := d.client.Login(); err != nil {
-		log.Error().Err(err).Msg("Failed to login to NAS")
-		return nil, status.Error(codes.Internal, "Failed to login to NAS")
+	// An unknown backend is an error rather than a deleted volume, as it's more likely missing from the config
+	b, name, err := d.backendForVolume(req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if !d.ownsVolume(nasVolumeName(name)) {
+		// Made by hand or by another cluster sharing the NAS, so not ours to delete
+		log.Warn().Str("volume_id", req.VolumeId).Msg("Not deleting volume this driver did not create")
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if protocol, share, ok := sharedFolderVolume(name); ok {
+		if err = d.deleteSharedFolderVolume(ctx, b, protocol, share); err != nil {
+			return nil, err
+		}
+		return &csi.DeleteVolumeResponse{}, nil
 	}
 
-	targetList, err := d.client.GetStorageISCSITargetList()
+	targetList, err := b.client.GetStorageISCSITargetList(ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
-		return nil, status.Error(codes.Internal, "Failed to get list of ISCSI targets")
+		return nil, nasError(err, "Failed to get list of ISCSI targets")
 	}
 	for _, target := range targetList.Targets {
-		if target.Name == req.VolumeId {
-			if err = d.client.DeleteStorageISCSITarget(target.TargetIndex); err != nil {
-				log.Error().Err(err).Msg("Failed to delete ISCSI target")
-				return nil, status.Error(codes.Internal, "Failed to delete ISCSI target")
-			}
-
+		if target.Name == name {
+			// LUNs go first, if one fails to delete the target is still there for the retry to find it by
 			for _, targetLUNID := range target.TargetLUNs {
-				if err = d.client.DeleteStorageISCSIBlockLUN(targetLUNID, false); err != nil {
+				if err = b.client.DeleteStorageISCSIBlockLUN(ctx, targetLUNID, false); err != nil && !errors.Is(err, qnap.ErrNotFound) {
 					log.Error().Err(err).Msg("Failed to delete ISCSI Block based LUN")
-					return nil, status.Error(codes.Internal, "Failed to delete ISCSI Block based LUN")
+					return nil, nasError(err, "Failed to delete ISCSI Block based LUN")
 				}
 			}
 
-			return &csi.DeleteVolumeResponse{}, nil
+			if err = b.client.DeleteStorageISCSITarget(ctx, target.TargetIndex); err != nil && !errors.Is(err, qnap.ErrNotFound) {
+				log.Error().Err(err).Msg("Failed to delete ISCSI target")
+				return nil, nasError(err, "Failed to delete ISCSI target")
+			}
+
+			break
 		}
 	}
 
-	// Volume not found, so yolo
+	// Done even if the volume wasn't found, a retry may have got past deleting the target
+	if err = d.deleteCHAPCredentials(ctx, b, name); err != nil {
+		return nil, err
+	}
+
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -210,20 +483,23 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume Capabilities must be provided")
 	}
 
-	if err := d.client.Login(); err != nil {
-		log.Error().Err(err).Msg("Failed to login to NAS")
-		return nil, status.Error(codes.Internal, "Failed to login to NAS")
+	b, name, err := d.ownedBackendForVolume("ValidateVolumeCapabilities", req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if protocol, share, ok := sharedFolderVolume(name); ok {
+		return b.validateSharedFolderCapabilities(ctx, req, protocol, share)
 	}
 
-	resp, err := d.client.GetStorageISCSITargetList()
+	resp, err := b.client.GetStorageISCSITargetList(ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
-		return nil, status.Error(codes.Internal, "Failed to get list of ISCSI targets")
+		return nil, nasError(err, "Failed to get list of ISCSI targets")
 	}
 
 	found := false
 	for _, target := range resp.Targets {
-		if target.Name == req.VolumeId {
+		if target.Name == name {
 			found = true
 			break
 		}
@@ -247,78 +523,221 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 }
 
 func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	// So volume id's can be backfilled, so the plan is to base64 encode a list of "seen" numbers,
-	if err := d.client.Login(); err != nil {
-		log.Error().Err(err).Msg("Failed to login to NAS")
-		return nil, status.Error(codes.Internal, "Failed to login to NAS")
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ListVolumes max entries can not be negative")
 	}
 
-	resp, err := d.client.GetStorageISCSITargetList()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
-		return nil, status.Error(codes.Internal, "Failed to get list of ISCSI targets")
+	// The token is the position of the last volume returned, so volumes created or deleted between pages don't make
+	// later pages skip or repeat others
+	var start *volumeCursor
+	if req.GetStartingToken() != "" {
+		cursor, err := parseVolumeCursor(req.GetStartingToken())
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to parse list volume starting token")
+			return nil, status.Errorf(codes.Aborted, "ListVolumes invalid starting token %s", req.GetStartingToken())
+		}
+		start = &cursor
 	}
 
-	var seenIds *sets.Int
-	if req.GetStartingToken() != "" {
-		seenIds, err = base64SeenIndexesToMap(req.GetStartingToken())
+	// Backends are listed in name order and their volumes in cursor order, so earlier backends have nothing left
+	volumes := make([]listedVolume, 0)
+	for _, b := range d.sortedBackends() {
+		if start != nil && b.name < start.backend {
+			continue
+		}
+
+		backendVolumes, err := b.listVolumes(ctx, d.ownsVolume)
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to parse list volume starting token, ignoring")
-			tmp := sets.NewInt()
-			seenIds = &tmp
+			return nil, err
+		}
+		for _, volume := range backendVolumes {
+			if start == nil || start.less(volume.cursor) {
+				volumes = append(volumes, volume)
+			}
 		}
 	}
 
-	entries := make([]*csi.ListVolumesResponse_Entry, 0)
-	maxEntries := req.GetMaxEntries()
 	nextToken := ""
-	if maxEntries == 0 {
-		maxEntries = int32(len(resp.Targets))
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && len(volumes) > maxEntries {
+		volumes = volumes[:maxEntries]
+		nextToken = volumes[maxEntries-1].cursor.String()
 	}
 
-	for _, target := range resp.Targets {
-		if seenIds.Has(target.TargetIndex) {
-			// Seen this volume before,
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, len(volumes))
+	for _, volume := range volumes {
+		entries = append(entries, volume.entry)
+	}
+
+	result := &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}
+
+	return result, nil
+}
+
+// listedVolume is a volume ListVolumes can return, and its position in the list.
+type listedVolume struct {
+	cursor volumeCursor
+	entry  *csi.ListVolumesResponse_Entry
+}
+
+// listVolumes lists a backend's volumes with their status in cursor order, ISCSI volumes from their target and LUN,
+// NFS and SMB ones from their shared folder. Only targets and shared folders owns says are this driver's are volumes.
+// Errors returned are gRPC statuses.
+func (b *backend) listVolumes(ctx context.Context, owns func(name string) bool) ([]listedVolume, error) {
+	targetList, err := b.client.GetStorageISCSITargetList(ctx)
+	if err != nil {
+		log.Error().Err(err).Str("backend", b.name).Msg("Failed to get list of ISCSI targets")
+		return nil, nasError(err, "Failed to get list of ISCSI targets")
+	}
+	luns, err := b.getLUNsByIndex(ctx)
+	if err != nil {
+		log.Error().Err(err).Str("backend", b.name).Msg("Failed to get list of ISCSI LUNs")
+		return nil, nasError(err, "Failed to get list of ISCSI LUNs")
+	}
+
+	volumes := make([]listedVolume, 0, len(targetList.Targets))
+	for i := range targetList.Targets {
+		target := &targetList.Targets[i]
+		if !owns(target.Name) {
 			continue
 		}
+		volume, publishedNodeIDs, condition := b.iscsiVolume(target, targetLUN(target, luns))
+		volumes = append(volumes, listedVolume{
+			cursor: volumeCursor{backend: b.name, targetIndex: target.TargetIndex},
+			entry: &csi.ListVolumesResponse_Entry{
+				Volume: volume,
+				Status: &csi.ListVolumesResponse_VolumeStatus{PublishedNodeIds: publishedNodeIDs, VolumeCondition: condition},
+			},
+		})
+	}
 
-		// We've not seen the item here
-		if int32(len(entries)) >= maxEntries {
-			// There are more entries to add, but we're full
-			nextToken = seenIndexesToBase64String(seenIds.List())
-			break
+	folderList, err := b.client.GetSharedFolderList(ctx)
+	if err != nil {
+		log.Error().Err(err).Str("backend", b.name).Msg("Failed to get list of shared folders")
+		return nil, nasError(err, "Failed to get list of shared folders")
+	}
+	for i := range folderList.SharedFolders {
+		folder := &folderList.SharedFolders[i]
+		if !owns(folder.Name) {
+			continue
 		}
-
-		// entries, not at limit, add one
-		// TODO(more) go find the LUN attached to the target and get capacity
-		entries = append(entries, &csi.ListVolumesResponse_Entry{
-			Volume: &csi.Volume{
-				VolumeId: target.Name,
-				// Could use volume context for specific values,
+		volume, condition := b.sharedFolderVolume(folder)
+		volumes = append(volumes, listedVolume{
+			cursor: volumeCursor{backend: b.name, share: folder.Name},
+			entry: &csi.ListVolumesResponse_Entry{
+				Volume: volume,
+				Status: &csi.ListVolumesResponse_VolumeStatus{VolumeCondition: condition},
 			},
-			Status: nil,
 		})
-		seenIds.Insert(target.TargetIndex)
 	}
 
-	result := &csi.ListVolumesResponse{
-		Entries:   entries,
-		NextToken: nextToken,
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].cursor.less(volumes[j].cursor)
+	})
+	return volumes, nil
+}
+
+// getLUNsByIndex returns every LUN on the NAS by index.
+func (b *backend) getLUNsByIndex(ctx context.Context) (map[int]*qnap.StorageISCSILUNInfoXML, error) {
+	lunList, err := b.client.GetStorageISCSILunList(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	return result, nil
+	luns := make(map[int]*qnap.StorageISCSILUNInfoXML, len(lunList.LUNs))
+	for i := range lunList.LUNs {
+		luns[lunList.LUNs[i].Index] = &lunList.LUNs[i]
+	}
+	return luns, nil
+}
+
+// targetLUN returns the LUN attached to a target, or nil if it has none.
+func targetLUN(target *qnap.StorageISCSITargetInfoXML, luns map[int]*qnap.StorageISCSILUNInfoXML) *qnap.StorageISCSILUNInfoXML {
+	if len(target.TargetLUNs) == 0 {
+		return nil
+	}
+	return luns[target.TargetLUNs[0]]
+}
+
+// iscsiVolume describes the volume of a target and its LUN, which may be nil, along with the nodes logged in to the
+// target and the volume's condition. Node IDs are initiator names, so they're the initiators of the target's
+// connections, each only once as multipath gives a node several.
+func (b *backend) iscsiVolume(target *qnap.StorageISCSITargetInfoXML, lun *qnap.StorageISCSILUNInfoXML) (*csi.Volume, []string, *csi.VolumeCondition) {
+	volume := &csi.Volume{
+		VolumeId:           buildVolumeID(b.name, target.Name),
+		AccessibleTopology: []*csi.Topology{b.topology()},
+	}
+
+	nodeIDs := sets.NewString()
+	for _, connection := range target.InitiatorConnections {
+		if connection.InitiatorIQN != "" {
+			nodeIDs.Insert(connection.InitiatorIQN)
+		}
+	}
+
+	condition := &csi.VolumeCondition{Message: "Volume is healthy"}
+	switch {
+	case target.StatusString() == "offline":
+		condition = &csi.VolumeCondition{Abnormal: true, Message: "ISCSI target is offline"}
+	case lun == nil:
+		condition = &csi.VolumeCondition{Abnormal: true, Message: "ISCSI target has no LUN"}
+	case lun.StatusString() != "ready":
+		condition = &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("LUN is %s", lun.StatusString())}
+	}
+
+	if lun != nil {
+		if capacity, err := strconv.ParseInt(lun.CapacityBytes, 10, 64); err == nil {
+			volume.CapacityBytes = capacity
+		} else {
+			log.Warn().Err(err).Str("lun", lun.Name).Msg("Failed to parse LUN capacity")
+		}
+	}
+
+	return volume, nodeIDs.List(), condition
+}
+
+// sharedFolderVolume describes the volume of a shared folder, the ones not exported over NFS are shared over SMB. The
+// nodes using them aren't known, the NAS doesn't track NFS clients and SMB volumes have a user of their own rather than
+// one per node.
+func (b *backend) sharedFolderVolume(folder *qnap.SharedFolderInfoXML) (*csi.Volume, *csi.VolumeCondition) {
+	protocol := protocolSMB
+	if folder.NFSEnabled == 1 {
+		protocol = protocolNFS
+	}
+
+	return &csi.Volume{
+		VolumeId:           buildSharedFolderVolumeID(b.name, protocol, folder.Name),
+		CapacityBytes:      int64(folder.QuotaBytes),
+		AccessibleTopology: []*csi.Topology{b.topology()},
+	}, &csi.VolumeCondition{Message: "Volume is healthy"}
 }
 
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	if err := d.client.Login(); err != nil {
-		log.Error().Err(err).Msg("Failed to login to NAS")
-		return nil, status.Error(codes.Internal, "Failed to login to NAS")
+	b, err := d.capacityBackend(req)
+	if err != nil {
+		return nil, err
 	}
 
-	resp, err := d.client.GetStoragePoolSubscription(d.storagePoolID)
+	// Shared folders go on a QNAP volume rather than a pool of their choosing, so only LUNs have options to look at
+	storagePoolID := b.storagePoolID
+	protocol, err := parseProtocol(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	if protocol == protocolISCSI {
+		lunParams, err := parseLUNParameters(req.GetParameters(), b.storagePoolID)
+		if err != nil {
+			return nil, err
+		}
+		storagePoolID = lunParams.storagePoolID
+	}
+
+	resp, err := b.client.GetStoragePoolSubscription(ctx, storagePoolID)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get storage pool size")
-		return nil, status.Error(codes.Internal, "Failed to get storage pool capacity")
+		return nil, nasError(err, "Failed to get storage pool capacity")
 	}
 
 	return &csi.GetCapacityResponse{
@@ -328,6 +747,26 @@ func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (
 	}, nil
 }
 
+// capacityBackend picks the backend GetCapacity reports on, the one named by the StorageClass, otherwise the one the
+// topology segment is for, otherwise the default. Errors returned are gRPC statuses.
+func (d *Driver) capacityBackend(req *csi.GetCapacityRequest) (*backend, error) {
+	if backendName := req.GetParameters()[paramBackend]; backendName != "" {
+		b, ok := d.backends[backendName]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "Unknown backend %s", backendName)
+		}
+		return b, nil
+	}
+
+	if req.GetAccessibleTopology() != nil {
+		if b := d.backendFromTopology(req.GetAccessibleTopology()); b != nil {
+			return b, nil
+		}
+	}
+
+	return d.backends[d.defaultBackend], nil
+}
+
 func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
 	newCap := func(capType csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
 		return &csi.ControllerServiceCapability{
@@ -342,12 +781,16 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 	caps := make([]*csi.ControllerServiceCapability, 0)
 	for _, currentCap := range []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		// csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-		// csi.ControllerServiceCapability_RPC_GET_VOLUME,
-		// csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
-		// csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 	} {
 		caps = append(caps, newCap(currentCap))
 	}
@@ -360,54 +803,653 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 }
 
 func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	// TODO(unimpl)
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Name must be provided")
+	}
+
+	if req.SourceVolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Source Volume ID must be provided")
+	}
+
+	name := d.taggedName(req.Name)
+
+	b, volumeName, err := d.ownedBackendForVolume("CreateSnapshot Source", req.SourceVolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if protocol, _, ok := sharedFolderVolume(volumeName); ok {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateSnapshot Source Volume ID %s is an %s volume, only ISCSI volumes can be snapshotted", req.SourceVolumeId, strings.ToUpper(protocol))
+	}
+	volumeID := buildVolumeID(b.name, volumeName)
+
+	target, err := b.getTargetByName(ctx, volumeName)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
+		return nil, nasError(err, "Failed to get list of ISCSI targets")
+	}
+	if target == nil {
+		return nil, status.Errorf(codes.NotFound, "CreateSnapshot Source Volume ID %s not found", req.SourceVolumeId)
+	}
+	if len(target.TargetLUNs) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "CreateSnapshot Source Volume ID %s has no LUN attached", req.SourceVolumeId)
+	}
+	lunIndex := target.TargetLUNs[0]
+
+	// Snapshot names are unique per LUN, so if it exists this is a retry
+	snapshot, err := b.getSnapshotByName(ctx, lunIndex, name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of LUN snapshots")
+		return nil, nasError(err, "Failed to get list of LUN snapshots")
+	}
+
+	if snapshot == nil {
+		// Names are only unique per LUN on the NAS, but a snapshot name is only ever for one source volume
+		otherVolumeID, err := d.findSnapshotVolume(ctx, name)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get list of LUN snapshots")
+			return nil, nasError(err, "Failed to get list of LUN snapshots")
+		}
+		if otherVolumeID != "" {
+			return nil, status.Errorf(codes.AlreadyExists, "CreateSnapshot Name %s is already a snapshot of volume %s", req.Name, otherVolumeID)
+		}
+
+		log.Debug().Int("lun_index", lunIndex).Str("snapshot_name", name).Msg("Creating LUN snapshot")
+		if _, err = b.client.CreateStorageISCSISnapshot(ctx, lunIndex, name, true); err != nil {
+			log.Error().Err(err).Msg("Failed to create LUN snapshot")
+			return nil, nasError(err, "Failed to create LUN snapshot")
+		}
+
+		if snapshot, err = b.getSnapshotByName(ctx, lunIndex, name); err != nil {
+			log.Error().Err(err).Msg("Failed to get list of LUN snapshots")
+			return nil, nasError(err, "Failed to get list of LUN snapshots")
+		}
+		if snapshot == nil {
+			log.Error().Str("snapshot_name", name).Msg("Created LUN snapshot is missing")
+			return nil, status.Error(codes.Internal, "Created LUN snapshot is missing")
+		}
+	}
+
+	lunSize, err := b.getLUNCapacity(ctx, lunIndex)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get ISCSI Block based LUN capacity")
+		return nil, nasError(err, "Failed to get ISCSI Block based LUN capacity")
+	}
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: newCSISnapshot(volumeID, lunSize, snapshot),
+	}, nil
 }
 
 func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	// TODO(unimpl)
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+	if req.SnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot Snapshot ID must be provided")
+	}
+
+	volumeID, snapshotName, err := parseSnapshotID(req.SnapshotId)
+	if err != nil {
+		// Could never have been one of ours, so it doesn't exist
+		log.Warn().Err(err).Str("snapshot_id", req.SnapshotId).Msg("Invalid snapshot ID, assuming deleted")
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	b, volumeName, err := d.backendForVolume(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if !d.ownsVolume(volumeName) {
+		// Another cluster's snapshot, which as far as this one's concerned doesn't exist
+		log.Warn().Str("snapshot_id", req.SnapshotId).Msg("Not deleting snapshot of a volume this driver did not create")
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	target, err := b.getTargetByName(ctx, volumeName)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
+		return nil, nasError(err, "Failed to get list of ISCSI targets")
+	}
+	if target == nil || len(target.TargetLUNs) == 0 {
+		// Snapshots go when the LUN is deleted
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	snapshot, err := b.getSnapshotByName(ctx, target.TargetLUNs[0], snapshotName)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of LUN snapshots")
+		return nil, nasError(err, "Failed to get list of LUN snapshots")
+	}
+	if snapshot == nil {
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	// Something else may have removed it since it was listed
+	if err = b.client.DeleteStorageISCSISnapshot(ctx, snapshot.ID); err != nil && !errors.Is(err, qnap.ErrNotFound) {
+		log.Error().Err(err).Msg("Failed to delete LUN snapshot")
+		return nil, nasError(err, "Failed to delete LUN snapshot")
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	// TODO(unimpl)
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+	var err error
+	volumeID := req.GetSourceVolumeId()
+	snapshotName := ""
+	if req.GetSnapshotId() != "" {
+		if volumeID, snapshotName, err = parseSnapshotID(req.GetSnapshotId()); err != nil {
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+	}
+
+	backends := d.sortedBackends()
+	volumeName := ""
+	if volumeID != "" {
+		b, name, backendErr := d.backendForVolume(volumeID)
+		if backendErr != nil {
+			// Nothing can exist on a backend which isn't configured
+			return &csi.ListSnapshotsResponse{}, nil
+		}
+		backends = []*backend{b}
+		volumeName = name
+	}
+
+	snapshots := make([]*csi.Snapshot, 0)
+	for _, b := range backends {
+		targetList, err2 := b.client.GetStorageISCSITargetList(ctx)
+		if err2 != nil {
+			log.Error().Err(err2).Str("backend", b.name).Msg("Failed to get list of ISCSI targets")
+			return nil, nasError(err2, "Failed to get list of ISCSI targets")
+		}
+
+		for i := range targetList.Targets {
+			target := &targetList.Targets[i]
+			// Other clusters' volumes and their snapshots are left alone
+			if (volumeName != "" && target.Name != volumeName) || !d.ownsVolume(target.Name) {
+				continue
+			}
+
+			targetSnapshots, err2 := b.listTargetSnapshots(ctx, target)
+			if err2 != nil {
+				log.Error().Err(err2).Msg("Failed to get list of LUN snapshots")
+				return nil, nasError(err2, "Failed to get list of LUN snapshots")
+			}
+
+			for _, snapshot := range targetSnapshots {
+				if snapshotName == "" || strings.HasSuffix(snapshot.SnapshotId, snapshotIDSeparator+snapshotName) {
+					snapshots = append(snapshots, snapshot)
+				}
+			}
+		}
+	}
+
+	// Tokens are just an offset into the list
+	start := 0
+	if req.GetStartingToken() != "" {
+		if start, err = strconv.Atoi(req.GetStartingToken()); err != nil || start < 0 || start > len(snapshots) {
+			return nil, status.Errorf(codes.Aborted, "ListSnapshots invalid starting token %s", req.GetStartingToken())
+		}
+	}
+
+	end := len(snapshots)
+	nextToken := ""
+	if req.GetMaxEntries() > 0 && start+int(req.GetMaxEntries()) < end {
+		end = start + int(req.GetMaxEntries())
+		nextToken = strconv.Itoa(end)
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, end-start)
+	for _, snapshot := range snapshots[start:end] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
 }
 
 func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	// TODO(unimpl)
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Volume ID must be provided")
+	}
+
+	if req.CapacityRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Capacity range must be provided")
+	}
+
+	size, err := extractStorage(req.CapacityRange)
+	if err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
+	}
+	sizeGB := size / (1 * giB)
+
+	// Block volumes have no filesystem to grow so the node has nothing to do
+	_, isBlock := req.GetVolumeCapability().GetAccessType().(*csi.VolumeCapability_Block)
+	nodeExpansionRequired := !isBlock
+
+	b, name, err := d.ownedBackendForVolume("ControllerExpandVolume", req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if _, share, ok := sharedFolderVolume(name); ok {
+		return b.expandSharedFolder(ctx, req.VolumeId, share, size, req.CapacityRange.GetLimitBytes())
+	}
+
+	target, err := b.getTargetByName(ctx, name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
+		return nil, nasError(err, "Failed to get list of ISCSI targets")
+	}
+	if target == nil {
+		return nil, status.Errorf(codes.NotFound, "ControllerExpandVolume Volume ID %s not found", req.VolumeId)
+	}
+	if len(target.TargetLUNs) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "ControllerExpandVolume Volume ID %s has no LUN attached", req.VolumeId)
+	}
+	lunIndex := target.TargetLUNs[0]
+
+	currentSize, err := b.getLUNCapacity(ctx, lunIndex)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get ISCSI Block based LUN capacity")
+		return nil, nasError(err, "Failed to get ISCSI Block based LUN capacity")
+	}
+	if err = checkShrink(req.VolumeId, currentSize, req.CapacityRange.GetLimitBytes()); err != nil {
+		return nil, err
+	}
+
+	if currentSize >= size {
+		// Already big enough, most likely a retry
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         currentSize,
+			NodeExpansionRequired: nodeExpansionRequired,
+		}, nil
+	}
+
+	log.Debug().Int("lun_index", lunIndex).Int64("size_gib", sizeGB).Msg("Expanding LUN")
+	if err = b.client.ExpandStorageISCSIBlockLUN(ctx, lunIndex, int(sizeGB)); err != nil {
+		log.Error().Err(err).Msg("Failed to expand ISCSI Block based LUN")
+		return nil, nasError(err, "Failed to expand ISCSI Block based LUN")
+	}
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         size,
+		NodeExpansionRequired: nodeExpansionRequired,
+	}, nil
+}
+
+// checkShrink returns an OutOfRange status if a volume is already bigger than limit, as volumes can't be shrunk.
+func checkShrink(volumeID string, currentSize, limit int64) error {
+	if limit > 0 && currentSize > limit {
+		return status.Errorf(codes.OutOfRange, "ControllerExpandVolume Volume ID %s is already %s, it can't be shrunk to %s", volumeID, formatBytes(currentSize), formatBytes(limit))
+	}
+	return nil
 }
 
+// ControllerGetVolume describes a volume the same way ListVolumes does, for the external-health-monitor.
 func (d *Driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	// TODO(unimpl)
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume Volume ID must be provided")
+	}
+
+	// ListVolumes doesn't list volumes the driver doesn't own either
+	b, name, err := d.ownedBackendForVolume("ControllerGetVolume", req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, share, ok := sharedFolderVolume(name); ok {
+		folder, err := b.getSharedFolderByName(ctx, share)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get list of shared folders")
+			return nil, nasError(err, "Failed to get list of shared folders")
+		}
+		if folder == nil {
+			return nil, status.Errorf(codes.NotFound, "ControllerGetVolume Volume ID %s not found", req.VolumeId)
+		}
+
+		volume, condition := b.sharedFolderVolume(folder)
+		return &csi.ControllerGetVolumeResponse{
+			Volume: volume,
+			Status: &csi.ControllerGetVolumeResponse_VolumeStatus{VolumeCondition: condition},
+		}, nil
+	}
+
+	target, err := b.getTargetByName(ctx, name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
+		return nil, nasError(err, "Failed to get list of ISCSI targets")
+	}
+	if target == nil {
+		return nil, status.Errorf(codes.NotFound, "ControllerGetVolume Volume ID %s not found", req.VolumeId)
+	}
+
+	luns, err := b.getLUNsByIndex(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of ISCSI LUNs")
+		return nil, nasError(err, "Failed to get list of ISCSI LUNs")
+	}
+
+	volume, publishedNodeIDs, condition := b.iscsiVolume(target, targetLUN(target, luns))
+	return &csi.ControllerGetVolumeResponse{
+		Volume: volume,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{PublishedNodeIds: publishedNodeIDs, VolumeCondition: condition},
+	}, nil
 }
 
+// ControllerPublishVolume lets a node's initiator at a volume's LUN, node IDs are initiator names. LUNs are masked from
+// everything else by the NAS's default ACL policy.
 func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	// TODO(unimpl)
-	// In theory we dont need this
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
+	}
+
+	if req.NodeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Node ID must be provided")
+	}
+
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume capability must be provided")
+	}
+
+	if violations := validateCapabilities([]*csi.VolumeCapability{req.VolumeCapability}, volumeProtocol(req.VolumeId)); len(violations) > 0 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume capabilities cannot be satisified: %s", strings.Join(violations, "; ")))
+	}
+
+	b, name, err := d.ownedBackendForVolume("ControllerPublishVolume", req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	// NFS volumes are exported to the cluster's networks and SMB volumes have their own user when they're created,
+	// there's nothing per node
+	if _, _, ok := sharedFolderVolume(name); ok {
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+
+	if !isInitiatorName(req.NodeId) {
+		// Nodes without an initiator go by their node name, they couldn't log in to the target anyway
+		return nil, status.Errorf(codes.FailedPrecondition, "ControllerPublishVolume Node %s has no ISCSI initiator name, is open-iscsi installed on it?", req.NodeId)
+	}
+
+	target, err := b.getTargetByName(ctx, name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
+		return nil, nasError(err, "Failed to get list of ISCSI targets")
+	}
+	if target == nil || len(target.TargetLUNs) == 0 {
+		return nil, status.Errorf(codes.NotFound, "ControllerPublishVolume Volume ID %s not found", req.VolumeId)
+	}
+	lunIndex := target.TargetLUNs[0]
+
+	policyList, err := b.client.GetStorageISCSIPolicyList(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of ISCSI ACL policies")
+		return nil, nasError(err, "Failed to get list of ISCSI ACL policies")
+	}
+
+	// Volumes are single node, so any other initiator still being let in means it's still published elsewhere
+	var policy *qnap.StorageISCSIPolicyInfoXML
+	for i := range policyList.Policies {
+		current := &policyList.Policies[i]
+		if current.InitiatorIQN == req.NodeId {
+			policy = current
+			continue
+		}
+		if permission, ok := current.LUNPermission(lunIndex); current.Index != qnap.DefaultPolicyIndex && ok && permission != qnap.LUNPermissionDeny {
+			return nil, status.Errorf(codes.FailedPrecondition, "ControllerPublishVolume Volume ID %s is published to node %s", req.VolumeId, current.InitiatorIQN)
+		}
+	}
+
+	policyIndex := 0
+	if policy != nil {
+		policyIndex = policy.Index
+	} else {
+		log.Debug().Str("initiator", req.NodeId).Msg("Creating ISCSI ACL policy")
+		if policyIndex, err = b.client.CreateStorageISCSIPolicy(ctx, d.taggedName(req.NodeId), req.NodeId); err != nil {
+			log.Error().Err(err).Msg("Failed to create ISCSI ACL policy")
+			return nil, nasError(err, "Failed to create ISCSI ACL policy")
+		}
+	}
+
+	// Volumes from before publishing was supported aren't masked yet
+	if err = b.client.SetStorageISCSILUNPermission(ctx, qnap.DefaultPolicyIndex, lunIndex, qnap.LUNPermissionDeny); err != nil {
+		log.Error().Err(err).Msg("Failed to mask LUN")
+		return nil, nasError(err, "Failed to mask LUN")
+	}
+
+	permission := qnap.LUNPermissionReadWrite
+	if req.Readonly {
+		permission = qnap.LUNPermissionReadOnly
+	}
+	log.Debug().Str("initiator", req.NodeId).Int("lun_index", lunIndex).Msg("Allowing initiator access to LUN")
+	if err = b.client.SetStorageISCSILUNPermission(ctx, policyIndex, lunIndex, permission); err != nil {
+		log.Error().Err(err).Msg("Failed to set LUN permission")
+		return nil, nasError(err, "Failed to set LUN permission")
+	}
+
+	return &csi.ControllerPublishVolumeResponse{}, nil
 }
 
+// ControllerUnpublishVolume takes a node's initiator's access to a volume's LUN away, or every initiator's if no node is
+// given.
 func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	// TODO(unimpl)
-	// In theory we dont need this
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume Volume ID must be provided")
+	}
+	b, name, err := d.ownedBackendForVolume("ControllerUnpublishVolume", req.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, ok := sharedFolderVolume(name); ok {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	target, err := b.getTargetByName(ctx, name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of ISCSI targets")
+		return nil, nasError(err, "Failed to get list of ISCSI targets")
+	}
+	if target == nil || len(target.TargetLUNs) == 0 {
+		// Nothing left to have access to
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	lunIndex := target.TargetLUNs[0]
+
+	policyList, err := b.client.GetStorageISCSIPolicyList(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of ISCSI ACL policies")
+		return nil, nasError(err, "Failed to get list of ISCSI ACL policies")
+	}
+
+	for _, policy := range policyList.Policies {
+		if policy.Index == qnap.DefaultPolicyIndex || (req.NodeId != "" && policy.InitiatorIQN != req.NodeId) {
+			continue
+		}
+		if permission, ok := policy.LUNPermission(lunIndex); !ok || permission == qnap.LUNPermissionDeny {
+			continue
+		}
+
+		log.Debug().Str("initiator", policy.InitiatorIQN).Int("lun_index", lunIndex).Msg("Removing initiator access to LUN")
+		if err = b.client.SetStorageISCSILUNPermission(ctx, policy.Index, lunIndex, qnap.LUNPermissionDeny); err != nil && !errors.Is(err, qnap.ErrNotFound) {
+			log.Error().Err(err).Msg("Failed to set LUN permission")
+			return nil, nasError(err, "Failed to set LUN permission")
+		}
+	}
+
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// nasError converts an error from the NAS client into a gRPC status, requests which ran out of time or were cancelled
+// keep that status so the sidecars know to retry, and known NAS result codes get a code matching what went wrong.
+func nasError(err error, msg string) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return status.FromContextError(err).Err()
+	}
+
+	code := codes.Internal
+	switch {
+	case errors.Is(err, qnap.ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, qnap.ErrAlreadyExists):
+		code = codes.AlreadyExists
+	case errors.Is(err, qnap.ErrInvalidPool):
+		code = codes.InvalidArgument
+	case errors.Is(err, qnap.ErrAuth):
+		// The driver's own NAS credentials were refused rather than anything the CO sent, so it's retried like the NAS
+		// being down
+		code = codes.Unavailable
+	}
+
+	return status.Errorf(code, "%s: %v", msg, err)
 }
 
-// validateCapabilities validates the requested capabilities. It returns a list
-// of violations which may be empty if no violatons were found.
-func validateCapabilities(caps []*csi.VolumeCapability) []string {
+// getTargetByName returns the ISCSI target with the given name, or nil if it does not exist.
+func (b *backend) getTargetByName(ctx context.Context, name string) (*qnap.StorageISCSITargetInfoXML, error) {
+	targetList, err := b.client.GetStorageISCSITargetList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range targetList.Targets {
+		if targetList.Targets[i].Name == name {
+			return &targetList.Targets[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// getLUNCapacity returns the size of a LUN in bytes.
+func (b *backend) getLUNCapacity(ctx context.Context, lunIndex int) (int64, error) {
+	lunInfo, err := b.client.GetStorageISCSILun(ctx, lunIndex)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := strconv.ParseInt(lunInfo.CapacityBytes, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse LUN capacity %q: %w", lunInfo.CapacityBytes, err)
+	}
+
+	return size, nil
+}
+
+// getLUNByName returns the LUN with the given name, or nil if it does not exist.
+func (b *backend) getLUNByName(ctx context.Context, name string) (*qnap.StorageISCSILUNInfoXML, error) {
+	lunList, err := b.client.GetStorageISCSILunList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range lunList.LUNs {
+		if lunList.LUNs[i].Name == name {
+			return &lunList.LUNs[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// getSnapshotByName returns the snapshot of a LUN with the given name, or nil if it does not exist.
+func (b *backend) getSnapshotByName(ctx context.Context, lunIndex int, name string) (*qnap.StorageISCSISnapshotInfoXML, error) {
+	snapshotList, err := b.client.GetStorageISCSISnapshotList(ctx, lunIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range snapshotList.Snapshots {
+		if snapshotList.Snapshots[i].Name == name {
+			return &snapshotList.Snapshots[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// findSnapshotVolume returns the ID of the volume with a snapshot called name on any backend, or "" if there isn't one.
+func (d *Driver) findSnapshotVolume(ctx context.Context, name string) (string, error) {
+	for _, b := range d.sortedBackends() {
+		targetList, err := b.client.GetStorageISCSITargetList(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		for _, target := range targetList.Targets {
+			if len(target.TargetLUNs) == 0 || !d.ownsVolume(target.Name) {
+				continue
+			}
+			snapshot, err := b.getSnapshotByName(ctx, target.TargetLUNs[0], name)
+			if err != nil {
+				return "", err
+			}
+			if snapshot != nil {
+				return buildVolumeID(b.name, target.Name), nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// listTargetSnapshots returns all snapshots of the LUN attached to a target, ordered by snapshot ID.
+func (b *backend) listTargetSnapshots(ctx context.Context, target *qnap.StorageISCSITargetInfoXML) ([]*csi.Snapshot, error) {
+	if len(target.TargetLUNs) == 0 {
+		return nil, nil
+	}
+	lunIndex := target.TargetLUNs[0]
+
+	snapshotList, err := b.client.GetStorageISCSISnapshotList(ctx, lunIndex)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshotList.Snapshots) == 0 {
+		return nil, nil
+	}
+
+	lunSize, err := b.getLUNCapacity(ctx, lunIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(snapshotList.Snapshots, func(i, j int) bool {
+		return snapshotList.Snapshots[i].ID < snapshotList.Snapshots[j].ID
+	})
+
+	result := make([]*csi.Snapshot, 0, len(snapshotList.Snapshots))
+	for i := range snapshotList.Snapshots {
+		result = append(result, newCSISnapshot(buildVolumeID(b.name, target.Name), lunSize, &snapshotList.Snapshots[i]))
+	}
+
+	return result, nil
+}
+
+// newCSISnapshot converts a LUN snapshot, the size is that of the LUN as that's the minimum a restored volume can be.
+func newCSISnapshot(volumeID string, lunSize int64, snapshot *qnap.StorageISCSISnapshotInfoXML) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     buildSnapshotID(volumeID, snapshot.Name),
+		SourceVolumeId: volumeID,
+		SizeBytes:      lunSize,
+		CreationTime:   timestamppb.New(time.Unix(snapshot.CreateTime, 0)),
+		ReadyToUse:     snapshot.StatusString() == "ready",
+	}
+}
+
+// validateCapabilities validates the requested capabilities for a volume using protocol, empty meaning ISCSI. It
+// returns a list of violations which may be empty if no violatons were found.
+func validateCapabilities(caps []*csi.VolumeCapability, protocol string) []string {
+	sharedFolder := protocol == protocolNFS || protocol == protocolSMB
 	violations := sets.NewString()
 	for _, currentCap := range caps {
-		if currentCap.GetAccessMode().GetMode() != supportedAccessMode.GetMode() {
-			violations.Insert(fmt.Sprintf("unsupported access mode %s", currentCap.GetAccessMode().GetMode().String()))
+		mode := currentCap.GetAccessMode().GetMode()
+		if (sharedFolder && !sharedFolderAccessModes[mode]) || (!sharedFolder && mode != supportedAccessMode.GetMode()) {
+			violations.Insert(fmt.Sprintf("unsupported access mode %s", mode.String()))
 		}
 
 		accessType := currentCap.GetAccessType()
 		switch accessType.(type) {
 		case *csi.VolumeCapability_Block:
+			if sharedFolder {
+				violations.Insert(fmt.Sprintf("%s volumes can't be used as raw block devices", strings.ToUpper(protocol)))
+			}
 		case *csi.VolumeCapability_Mount:
 		default:
 			violations.Insert("unsupported access type")
@@ -0,0 +1,760 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/terrycain/qnap-csi/qnap"
+	"github.com/terrycain/qnap-csi/qnap/qnaptest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testUsername = "admin"
+	testPassword = "password"
+)
+
+func newTestDriver(t *testing.T) (*Driver, *qnaptest.Server) {
+	t.Helper()
+
+	srv := qnaptest.NewServer(testUsername, testPassword)
+	srv.LUNCreatingPolls = 0
+	t.Cleanup(srv.Close)
+
+	d, err := NewDriver("unix:///tmp/csi.sock", BackendsConfig{Backends: []BackendConfig{newTestBackendConfig(DefaultBackendName, srv)}}, true, DefaultVolumePrefix, "node1", nil)
+	if err != nil {
+		t.Fatalf("failed to init driver: %#v", err)
+	}
+	return d, srv
+}
+
+func newTestBackendConfig(name string, srv *qnaptest.Server) BackendConfig {
+	return BackendConfig{
+		Name:          name,
+		URL:           srv.URL,
+		Portal:        "127.0.0.1:3260",
+		StoragePoolID: qnaptest.DefaultStoragePoolID,
+		Username:      testUsername,
+		Password:      testPassword,
+	}
+}
+
+func newCreateVolumeRequest(name string, size int64) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:          name,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: supportedAccessMode,
+		}},
+	}
+}
+
+func TestDriver_CreateVolumeIdempotent(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+
+	first, err := d.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 10*giB))
+	if err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+	second, err := d.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 10*giB))
+	if err != nil {
+		t.Fatalf("failed to create volume again: %#v", err)
+	}
+	if first.Volume.VolumeId != second.Volume.VolumeId || first.Volume.VolumeContext["iqn"] != second.Volume.VolumeContext["iqn"] {
+		t.Fatalf("expected the same volume, got %v and %v", first.Volume, second.Volume)
+	}
+	if len(srv.Targets()) != 1 || len(srv.LUNs()) != 1 {
+		t.Fatalf("expected 1 target and 1 LUN, got %d and %d", len(srv.Targets()), len(srv.LUNs()))
+	}
+
+	_, err = d.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 20*giB))
+	if status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected already exists for a different size, got %#v", err)
+	}
+}
+
+func TestDriver_CreateVolumeParameters(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+	srv.AddStoragePool(2, 10*tiB)
+
+	req := newCreateVolumeRequest("pvc-1", 10*giB)
+	req.Parameters = map[string]string{"storagePoolID": "2", "thinAllocate": "true", "sectorSize": "4096"}
+	if _, err := d.CreateVolume(ctx, req); err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+
+	luns := srv.LUNs()
+	if len(luns) != 1 || luns[0].StoragePoolID != 2 || !luns[0].ThinAllocate || luns[0].SectorSize != 4096 {
+		t.Fatalf("unexpected LUN %#v", luns)
+	}
+
+	req = newCreateVolumeRequest("pvc-2", 10*giB)
+	req.Parameters = map[string]string{"storagePoolID": "3"}
+	if _, err := d.CreateVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument for a missing storage pool, got %#v", err)
+	}
+	if len(srv.Targets()) != 1 {
+		t.Fatal("target for the failed volume was not rolled back")
+	}
+}
+
+func TestDriver_CreateVolumeResumesPartialVolume(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+	client := d.backends[DefaultBackendName].client
+
+	// As if the controller died after creating the target for one volume, and after creating the LUN for another
+	if _, err := client.CreateStorageISCSITarget(ctx, "csi-pvc1", false, false, true); err != nil {
+		t.Fatalf("failed to create target: %#v", err)
+	}
+	if _, err := client.CreateStorageISCSIBlockLUN(ctx, "csi-pvc2", qnaptest.DefaultStoragePoolID, 10, false, 512, false, false, false, false); err != nil {
+		t.Fatalf("failed to create lun: %#v", err)
+	}
+
+	for _, name := range []string{"pvc-1", "pvc-2"} {
+		resp, err := d.CreateVolume(ctx, newCreateVolumeRequest(name, 10*giB))
+		if err != nil {
+			t.Fatalf("failed to create volume %s: %#v", name, err)
+		}
+		if resp.Volume.VolumeContext["iqn"] == "" {
+			t.Fatalf("volume %s has no IQN", name)
+		}
+	}
+
+	targets := srv.Targets()
+	if len(targets) != 2 || len(srv.LUNs()) != 2 {
+		t.Fatalf("expected 2 targets and 2 LUNs, got %d and %d", len(targets), len(srv.LUNs()))
+	}
+	for _, target := range targets {
+		if len(target.LUNs) != 1 {
+			t.Fatalf("target %s has %d LUNs attached", target.Name, len(target.LUNs))
+		}
+	}
+}
+
+func TestDriver_ControllerPublishVolume(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+
+	const (
+		node1 = "iqn.1993-08.org.debian:01:node1"
+		node2 = "iqn.1993-08.org.debian:01:node2"
+	)
+
+	resp, err := d.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 10*giB))
+	if err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+	volumeID := resp.Volume.VolumeId
+	lunIndex := srv.LUNs()[0].Index
+	if permission, ok := srv.Policies()[0].LUNs[lunIndex]; !ok || permission != int(qnap.LUNPermissionDeny) {
+		t.Fatal("new LUN is not masked by the default policy")
+	}
+
+	newPublishRequest := func(nodeID string) *csi.ControllerPublishVolumeRequest {
+		return &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           nodeID,
+			VolumeCapability: newCreateVolumeRequest("", 0).VolumeCapabilities[0],
+		}
+	}
+
+	// Publishing twice is fine
+	for i := 0; i < 2; i++ {
+		if _, err = d.ControllerPublishVolume(ctx, newPublishRequest(node1)); err != nil {
+			t.Fatalf("failed to publish volume: %#v", err)
+		}
+	}
+	policies := srv.Policies()
+	if len(policies) != 2 || policies[1].Name != "csi-iqn199308orgdebian01node1" || policies[1].InitiatorIQN != node1 || policies[1].LUNs[lunIndex] != int(qnap.LUNPermissionReadWrite) {
+		t.Fatalf("unexpected policies %#v", policies)
+	}
+
+	if _, err = d.ControllerPublishVolume(ctx, newPublishRequest(node2)); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected failed precondition for a second node, got %#v", err)
+	}
+	// A node without an initiator goes by its node name, it can't use ISCSI volumes
+	if _, err = d.ControllerPublishVolume(ctx, newPublishRequest("node1")); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected failed precondition for a node without an initiator, got %#v", err)
+	}
+	if len(srv.Policies()) != 2 {
+		t.Fatalf("expected no policy for a node without an initiator, got %#v", srv.Policies())
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: node1}); err != nil {
+			t.Fatalf("failed to unpublish volume: %#v", err)
+		}
+	}
+	if srv.Policies()[1].LUNs[lunIndex] != int(qnap.LUNPermissionDeny) {
+		t.Fatal("node1 still has access after unpublishing")
+	}
+
+	if _, err = d.ControllerPublishVolume(ctx, newPublishRequest(node2)); err != nil {
+		t.Fatalf("failed to publish volume to node2: %#v", err)
+	}
+	if _, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "default/csi-pvc2", NodeId: node2}); err != nil {
+		t.Fatalf("expected unpublishing a missing volume to succeed, got %#v", err)
+	}
+}
+
+func TestDriver_ControllerGetVolume(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+
+	const (
+		node1 = "iqn.1993-08.org.debian:01:node1"
+		node2 = "iqn.1993-08.org.debian:01:node2"
+	)
+
+	resp, err := d.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 10*giB))
+	if err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+	volumeID := resp.Volume.VolumeId
+	targetIndex := srv.Targets()[0].Index
+
+	getResp, err := d.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	if err != nil {
+		t.Fatalf("failed to get volume: %#v", err)
+	}
+	if getResp.Volume.CapacityBytes != 10*giB {
+		t.Fatalf("expected: %d, got: %d", 10*giB, getResp.Volume.CapacityBytes)
+	}
+	if len(getResp.Status.PublishedNodeIds) != 0 || getResp.Status.VolumeCondition.Abnormal {
+		t.Fatalf("unexpected status of a new volume %v", getResp.Status)
+	}
+
+	// Multipath gives node1 two sessions, it's still only published to it once
+	srv.ConnectInitiator(targetIndex, node2)
+	srv.ConnectInitiator(targetIndex, node1)
+	srv.ConnectInitiator(targetIndex, node1)
+	if getResp, err = d.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Fatalf("failed to get volume: %#v", err)
+	}
+	if got := fmt.Sprint(getResp.Status.PublishedNodeIds); got != fmt.Sprint([]string{node1, node2}) {
+		t.Fatalf("expected: %v, got: %v", []string{node1, node2}, got)
+	}
+
+	srv.SetTargetOffline(targetIndex, true)
+	if getResp, err = d.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Fatalf("failed to get volume: %#v", err)
+	}
+	if !getResp.Status.VolumeCondition.Abnormal {
+		t.Fatal("expected an offline target to be abnormal")
+	}
+
+	// Listing reports the same as getting
+	listResp, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("failed to list volumes: %#v", err)
+	}
+	entries := listResp.Entries
+	if len(entries) != 1 || entries[0].Volume.VolumeId != volumeID || entries[0].Volume.CapacityBytes != 10*giB || len(entries[0].Status.PublishedNodeIds) != 2 || !entries[0].Status.VolumeCondition.Abnormal {
+		t.Fatalf("unexpected volume list %v", entries)
+	}
+
+	if _, err = d.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "default/pvc2"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found for a missing volume, got %#v", err)
+	}
+	if _, err = d.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument without a volume ID, got %#v", err)
+	}
+}
+
+func TestDriver_ListVolumesPagination(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestDriver(t)
+
+	for _, name := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		if _, err := d.CreateVolume(ctx, newCreateVolumeRequest(name, 10*giB)); err != nil {
+			t.Fatalf("failed to create volume: %#v", err)
+		}
+	}
+
+	listVolumeIDs := func(resp *csi.ListVolumesResponse) []string {
+		volumeIDs := make([]string, 0, len(resp.Entries))
+		for _, entry := range resp.Entries {
+			volumeIDs = append(volumeIDs, entry.Volume.VolumeId)
+		}
+		return volumeIDs
+	}
+
+	resp, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("failed to list volumes: %#v", err)
+	}
+	if got := fmt.Sprint(listVolumeIDs(resp)); got != "[default/csi-pvc1 default/csi-pvc2]" || resp.NextToken == "" {
+		t.Fatalf("unexpected first page %s, token %q", got, resp.NextToken)
+	}
+
+	// Deleting the last volume returned, even the one the token points at, and creating another between pages doesn't
+	// make the next page skip or repeat any
+	if _, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "default/csi-pvc2"}); err != nil {
+		t.Fatalf("failed to delete volume: %#v", err)
+	}
+	if _, err = d.CreateVolume(ctx, newCreateVolumeRequest("pvc-0", 10*giB)); err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+
+	if resp, err = d.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: resp.NextToken}); err != nil {
+		t.Fatalf("failed to list volumes: %#v", err)
+	}
+	if got := fmt.Sprint(listVolumeIDs(resp)); got != "[default/csi-pvc3 default/csi-pvc0]" || resp.NextToken != "" {
+		t.Fatalf("unexpected second page %s, token %q", got, resp.NextToken)
+	}
+
+	// Without a limit everything fits in one page
+	if resp, err = d.ListVolumes(ctx, &csi.ListVolumesRequest{}); err != nil {
+		t.Fatalf("failed to list volumes: %#v", err)
+	}
+	if len(resp.Entries) != 3 || resp.NextToken != "" {
+		t.Fatalf("expected 3 volumes and no token, got %v, token %q", listVolumeIDs(resp), resp.NextToken)
+	}
+
+	for _, token := range []string{"bm90IGEgdG9rZW4=", "default/t/-1", "default/x/1"} {
+		if _, err = d.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: token}); status.Code(err) != codes.Aborted {
+			t.Fatalf("expected aborted for starting token %q, got %#v", token, err)
+		}
+	}
+	if _, err = d.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument for negative max entries, got %#v", err)
+	}
+}
+
+func TestDriver_ControllerExpandVolume(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+
+	resp, err := d.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 10*giB))
+	if err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+	volumeID := resp.Volume.VolumeId
+	newExpandRequest := func(required, limit int64) *csi.ControllerExpandVolumeRequest {
+		return &csi.ControllerExpandVolumeRequest{
+			VolumeId:         volumeID,
+			CapacityRange:    &csi.CapacityRange{RequiredBytes: required, LimitBytes: limit},
+			VolumeCapability: newCreateVolumeRequest("", 0).VolumeCapabilities[0],
+		}
+	}
+
+	// Growing to the same size again is a retry, asking for less than it has already is satisfied too
+	for _, required := range []int64{20 * giB, 20 * giB, 10 * giB} {
+		expandResp, err := d.ControllerExpandVolume(ctx, newExpandRequest(required, 0))
+		if err != nil {
+			t.Fatalf("failed to expand volume to %d: %#v", required, err)
+		}
+		if expandResp.CapacityBytes != 20*giB || !expandResp.NodeExpansionRequired {
+			t.Fatalf("expected 20GiB and node expansion, got %+v", expandResp)
+		}
+	}
+	if luns := srv.LUNs(); len(luns) != 1 || luns[0].CapacityGB != 20 {
+		t.Fatalf("expected the LUN to be 20GB, got %#v", luns)
+	}
+
+	// Block volumes have no filesystem for the node to grow
+	req := newExpandRequest(30*giB, 0)
+	req.VolumeCapability = &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+	expandResp, err := d.ControllerExpandVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("failed to expand block volume: %#v", err)
+	}
+	if expandResp.CapacityBytes != 30*giB || expandResp.NodeExpansionRequired {
+		t.Fatalf("expected 30GiB and no node expansion, got %+v", expandResp)
+	}
+
+	tests := []struct {
+		required int64
+		limit    int64
+		want     codes.Code
+	}{
+		// Shrinking isn't supported
+		{required: 10 * giB, limit: 10 * giB, want: codes.OutOfRange},
+		// Invalid capacity ranges
+		{required: 40 * giB, limit: 20 * giB, want: codes.OutOfRange},
+		{required: 40*giB + 1, want: codes.OutOfRange},
+	}
+	for _, table := range tests {
+		if _, err = d.ControllerExpandVolume(ctx, newExpandRequest(table.required, table.limit)); status.Code(err) != table.want {
+			t.Fatalf("%d-%d: expected: %v, got: %v", table.required, table.limit, table.want, status.Code(err))
+		}
+	}
+	if luns := srv.LUNs(); luns[0].CapacityGB != 30 {
+		t.Fatalf("expected the LUN to still be 30GB, got %d", luns[0].CapacityGB)
+	}
+
+	if _, err = d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: "default/csi-pvc2", CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB}}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found for a missing volume, got %#v", err)
+	}
+}
+
+func TestDriver_Snapshots(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+
+	var volumeIDs []string
+	for _, name := range []string{"pvc-1", "pvc-2"} {
+		resp, err := d.CreateVolume(ctx, newCreateVolumeRequest(name, 10*giB))
+		if err != nil {
+			t.Fatalf("failed to create volume: %#v", err)
+		}
+		volumeIDs = append(volumeIDs, resp.Volume.VolumeId)
+	}
+
+	// Creating it again is a retry
+	var first *csi.CreateSnapshotResponse
+	for i := 0; i < 2; i++ {
+		resp, err := d.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: volumeIDs[0], Name: "snapshot-1"})
+		if err != nil {
+			t.Fatalf("failed to create snapshot: %#v", err)
+		}
+		if first == nil {
+			first = resp
+		}
+		if resp.Snapshot.SnapshotId != first.Snapshot.SnapshotId || resp.Snapshot.SourceVolumeId != volumeIDs[0] || resp.Snapshot.SizeBytes != 10*giB || !resp.Snapshot.ReadyToUse {
+			t.Fatalf("unexpected snapshot %+v", resp.Snapshot)
+		}
+	}
+	if len(srv.Snapshots()) != 1 {
+		t.Fatalf("expected 1 snapshot, have %d", len(srv.Snapshots()))
+	}
+
+	if _, err := d.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: volumeIDs[1], Name: "snapshot-1"}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected already exists for the same name with another source, got %#v", err)
+	}
+	if _, err := d.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "default/csi-pvc3", Name: "snapshot-3"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found for a missing source, got %#v", err)
+	}
+	second, err := d.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: volumeIDs[1], Name: "snapshot-2"})
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %#v", err)
+	}
+
+	tests := []struct {
+		req  *csi.ListSnapshotsRequest
+		want []string
+	}{
+		{req: &csi.ListSnapshotsRequest{}, want: []string{first.Snapshot.SnapshotId, second.Snapshot.SnapshotId}},
+		{req: &csi.ListSnapshotsRequest{SourceVolumeId: volumeIDs[0]}, want: []string{first.Snapshot.SnapshotId}},
+		{req: &csi.ListSnapshotsRequest{SnapshotId: second.Snapshot.SnapshotId}, want: []string{second.Snapshot.SnapshotId}},
+		{req: &csi.ListSnapshotsRequest{SourceVolumeId: "default/csi-pvc3"}, want: []string{}},
+		{req: &csi.ListSnapshotsRequest{SnapshotId: buildSnapshotID(volumeIDs[0], "csi-snapshot2")}, want: []string{}},
+		{req: &csi.ListSnapshotsRequest{SnapshotId: "not a snapshot"}, want: []string{}},
+	}
+	for _, table := range tests {
+		resp, err := d.ListSnapshots(ctx, table.req)
+		if err != nil {
+			t.Fatalf("failed to list snapshots: %#v", err)
+		}
+		got := make([]string, 0, len(resp.Entries))
+		for _, entry := range resp.Entries {
+			got = append(got, entry.Snapshot.SnapshotId)
+		}
+		if !reflect.DeepEqual(got, table.want) {
+			t.Fatalf("%+v: expected: %v, got: %v", table.req, table.want, got)
+		}
+	}
+
+	// Deleting twice is fine, as is deleting a snapshot that never existed
+	for _, snapshotID := range []string{first.Snapshot.SnapshotId, first.Snapshot.SnapshotId, buildSnapshotID("default/csi-pvc3", "csi-snapshot3"), "not a snapshot"} {
+		if _, err = d.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID}); err != nil {
+			t.Fatalf("failed to delete snapshot %s: %#v", snapshotID, err)
+		}
+	}
+	if snapshots := srv.Snapshots(); len(snapshots) != 1 || snapshots[0].Name != "csi-snapshot2" {
+		t.Fatalf("expected only snapshot-2 to be left, got %#v", snapshots)
+	}
+}
+
+func TestDriver_CreateVolumeFromContentSource(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+
+	resp, err := d.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 10*giB))
+	if err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+	sourceID := resp.Volume.VolumeId
+	snapshotResp, err := d.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: sourceID, Name: "snapshot-1"})
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %#v", err)
+	}
+
+	fromSnapshot := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotResp.Snapshot.SnapshotId}}}
+	fromVolume := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: sourceID}}}
+	tests := []struct {
+		name   string
+		source *csi.VolumeContentSource
+		size   int64
+		want   codes.Code
+	}{
+		{name: "pvc-2", source: fromSnapshot, size: 10 * giB, want: codes.OK},
+		{name: "pvc-3", source: fromSnapshot, size: 20 * giB, want: codes.OK},
+		{name: "pvc-4", source: fromVolume, size: 15 * giB, want: codes.OK},
+		{name: "pvc-5", source: fromVolume, size: 5 * giB, want: codes.OutOfRange},
+		{name: "pvc-6", source: fromSnapshot, size: 5 * giB, want: codes.OutOfRange},
+	}
+
+	for _, table := range tests {
+		req := newCreateVolumeRequest(table.name, table.size)
+		req.VolumeContentSource = table.source
+		resp, err = d.CreateVolume(ctx, req)
+		if status.Code(err) != table.want {
+			t.Fatalf("%s: expected: %v, got: %#v", table.name, table.want, err)
+		}
+		if err != nil {
+			continue
+		}
+		if resp.Volume.CapacityBytes != table.size || !reflect.DeepEqual(resp.Volume.ContentSource, table.source) {
+			t.Fatalf("%s: unexpected volume %+v", table.name, resp.Volume)
+		}
+		lun, err := d.backends[DefaultBackendName].getLUNByName(ctx, d.volumeName(table.name))
+		if err != nil || lun == nil {
+			t.Fatalf("%s: failed to get LUN: %v, %#v", table.name, lun, err)
+		}
+		if capacity, err := d.backends[DefaultBackendName].getLUNCapacity(ctx, lun.Index); err != nil || capacity != table.size {
+			t.Fatalf("%s: expected a %d byte LUN, got %d, %#v", table.name, table.size, capacity, err)
+		}
+	}
+
+	// Only the snapshot that was asked for is left, cloning a volume cleans up after itself
+	if snapshots := srv.Snapshots(); len(snapshots) != 1 || snapshots[0].Name != "csi-snapshot1" {
+		t.Fatalf("expected only the requested snapshot, got %#v", snapshots)
+	}
+
+	// Even when cloning fails
+	srv.FailClones = true
+	req := newCreateVolumeRequest("pvc-7", 10*giB)
+	req.VolumeContentSource = fromVolume
+	if _, err = d.CreateVolume(ctx, req); status.Code(err) != codes.Internal {
+		t.Fatalf("expected internal error for a failed clone, got %#v", err)
+	}
+	if snapshots := srv.Snapshots(); len(snapshots) != 1 || snapshots[0].Name != "csi-snapshot1" {
+		t.Fatalf("expected only the requested snapshot, got %#v", snapshots)
+	}
+}
+
+func TestDriver_VolumeOwnership(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+	client := d.backends[DefaultBackendName].client
+
+	if err := d.SetClusterID("Prod-1"); err == nil {
+		t.Fatal("expected an error for a cluster ID that isn't lowercase letters and numbers")
+	}
+	if err := d.SetClusterID("prod"); err != nil {
+		t.Fatalf("failed to set cluster ID: %#v", err)
+	}
+
+	resp, err := d.CreateVolume(ctx, newCreateVolumeRequest("pvc-1", 10*giB))
+	if err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+	if resp.Volume.VolumeId != "default/csi-prod-pvc1" {
+		t.Fatalf("expected: default/csi-prod-pvc1, got: %s", resp.Volume.VolumeId)
+	}
+
+	// Any name the CO picks is fine, as long as something is left of it
+	if resp, err := d.CreateVolume(ctx, newCreateVolumeRequest("data_1", 10*giB)); err != nil || resp.Volume.VolumeId != "default/csi-prod-data1" {
+		t.Fatalf("expected default/csi-prod-data1, got %v, %#v", resp, err)
+	}
+	if _, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "default/csi-prod-data1"}); err != nil {
+		t.Fatalf("failed to delete volume: %#v", err)
+	}
+	if _, err = d.CreateVolume(ctx, newCreateVolumeRequest("--", 10*giB)); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument for a name with nothing left once cleaned, got %#v", err)
+	}
+
+	// Made by hand, by other clusters, one of whose IDs starts with this one's, and by an earlier version, which can't
+	// be told apart from other clusters' volumes
+	for _, name := range []string{"backups", "csi-staging-pvc2", "csi-prod2-pvc4", "pvc00000000000000000000000000000003"} {
+		if _, err = client.CreateStorageISCSITarget(ctx, name, false, false, true); err != nil {
+			t.Fatalf("failed to create target: %#v", err)
+		}
+	}
+
+	listResp, err := d.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("failed to list volumes: %#v", err)
+	}
+	if len(listResp.Entries) != 1 || listResp.Entries[0].Volume.VolumeId != resp.Volume.VolumeId {
+		t.Fatalf("expected only the cluster's volume to be listed, got %v", listResp.Entries)
+	}
+
+	if _, err = d.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "default/backups"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found for a target made by hand, got %#v", err)
+	}
+	for _, volumeID := range []string{"default/backups", "default/csi-staging-pvc2", "default/nfs/csi-staging-pvc2"} {
+		if _, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Fatalf("expected deleting %s to succeed, got %#v", volumeID, err)
+		}
+	}
+	if len(srv.Targets()) != 5 {
+		t.Fatalf("expected targets the driver doesn't own to be left alone, have %d targets", len(srv.Targets()))
+	}
+
+	// Snapshots are tagged too, and other clusters' snapshots aren't listed
+	snapshotResp, err := d.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: resp.Volume.VolumeId, Name: "snapshot-1"})
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %#v", err)
+	}
+	if want := buildSnapshotID("default/csi-prod-pvc1", "csi-prod-snapshot1"); snapshotResp.Snapshot.SnapshotId != want {
+		t.Fatalf("expected: %s, got: %s", want, snapshotResp.Snapshot.SnapshotId)
+	}
+	d.clusterID = "prod2"
+	otherResp, err := d.CreateVolume(ctx, newCreateVolumeRequest("pvc-5", 10*giB))
+	if err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+	if _, err = d.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: otherResp.Volume.VolumeId, Name: "snapshot-2"}); err != nil {
+		t.Fatalf("failed to create snapshot: %#v", err)
+	}
+	d.clusterID = "prod"
+	snapshotList, err := d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{})
+	if err != nil {
+		t.Fatalf("failed to list snapshots: %#v", err)
+	}
+	if len(snapshotList.Entries) != 1 || snapshotList.Entries[0].Snapshot.SnapshotId != snapshotResp.Snapshot.SnapshotId {
+		t.Fatalf("expected only the cluster's snapshot to be listed, got %v", snapshotList.Entries)
+	}
+	if snapshotList, err = d.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: otherResp.Volume.VolumeId}); err != nil || len(snapshotList.Entries) != 0 {
+		t.Fatalf("expected no snapshots of another cluster's volume, got %v, %#v", snapshotList, err)
+	}
+
+	// Nothing can be done to another cluster's volume
+	otherID := otherResp.Volume.VolumeId
+	capability := newCreateVolumeRequest("", 0).VolumeCapabilities[0]
+	otherSnapshotID := buildSnapshotID(otherID, "csi-prod2-snapshot2")
+	fromOther := newCreateVolumeRequest("pvc-6", 10*giB)
+	fromOther.VolumeContentSource = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: otherID}}}
+	rpcs := map[string]func() error{
+		"ValidateVolumeCapabilities": func() error {
+			_, err := d.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: otherID, VolumeCapabilities: []*csi.VolumeCapability{capability}})
+			return err
+		},
+		"ControllerExpandVolume": func() error {
+			_, err := d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: otherID, CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB}})
+			return err
+		},
+		"ControllerPublishVolume": func() error {
+			_, err := d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: otherID, NodeId: "iqn.1993-08.org.debian:01:node1", VolumeCapability: capability})
+			return err
+		},
+		"ControllerUnpublishVolume": func() error {
+			_, err := d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: otherID})
+			return err
+		},
+		"CreateSnapshot": func() error {
+			_, err := d.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: otherID, Name: "snapshot-3"})
+			return err
+		},
+		"CreateVolume": func() error {
+			_, err := d.CreateVolume(ctx, fromOther)
+			return err
+		},
+	}
+	for rpc, call := range rpcs {
+		if err = call(); status.Code(err) != codes.NotFound {
+			t.Fatalf("%s: expected not found for another cluster's volume, got %#v", rpc, err)
+		}
+	}
+	if _, err = d.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: otherSnapshotID}); err != nil {
+		t.Fatalf("expected deleting another cluster's snapshot to succeed, got %#v", err)
+	}
+	if len(srv.Snapshots()) != 2 || len(srv.Policies()) != 1 || srv.LUNs()[1].CapacityGB != 10 {
+		t.Fatalf("expected another cluster's volume to be left alone, got %#v %#v %#v", srv.Snapshots(), srv.Policies(), srv.LUNs())
+	}
+
+	// Without a cluster ID only volumes named by earlier versions are owned as well, not every cluster's
+	d.clusterID = ""
+	if listResp, err = d.ListVolumes(ctx, &csi.ListVolumesRequest{}); err != nil {
+		t.Fatalf("failed to list volumes: %#v", err)
+	}
+	if len(listResp.Entries) != 1 || listResp.Entries[0].Volume.VolumeId != "default/pvc00000000000000000000000000000003" {
+		t.Fatalf("expected only the earlier version's volume to be listed, got %v", listResp.Entries)
+	}
+}
+
+func TestDriver_ownsVolume(t *testing.T) {
+	d, _ := newTestDriver(t)
+
+	tests := []struct {
+		clusterID string
+		input     string
+		want      bool
+	}{
+		{clusterID: "", input: "csi-pvc1", want: true},
+		{clusterID: "", input: "pvc00000000000000000000000000000001", want: true},
+		{clusterID: "", input: "csi-prod-pvc1", want: false},
+		{clusterID: "", input: "csi-data1", want: true},
+		{clusterID: "", input: "csi", want: false},
+		{clusterID: "", input: "csi-", want: false},
+		{clusterID: "", input: "csipvc1", want: false},
+		{clusterID: "", input: "backups", want: false},
+		{clusterID: "prod", input: "csi-prod-pvc1", want: true},
+		{clusterID: "prod", input: "csi-prod2-pvc1", want: false},
+		{clusterID: "prod", input: "csi-pvc1", want: false},
+		{clusterID: "prod", input: "pvc00000000000000000000000000000001", want: false},
+		{clusterID: "prod2", input: "csi-prod2-pvc1", want: true},
+		{clusterID: "prod2", input: "csi-prod-pvc1", want: false},
+	}
+
+	for _, table := range tests {
+		d.clusterID = table.clusterID
+		if got := d.ownsVolume(table.input); got != table.want {
+			t.Fatalf("%q with cluster ID %q: expected: %v, got: %v", table.input, table.clusterID, table.want, got)
+		}
+	}
+}
+
+func Test_nasError(t *testing.T) {
+	tests := []struct {
+		input error
+		want  codes.Code
+	}{
+		{input: errors.New("connection refused"), want: codes.Internal},
+		{input: &qnap.APIError{Endpoint: "snapshot.cgi", Func: "del_snapshot", Result: "-1", Err: qnap.ErrNotFound}, want: codes.NotFound},
+		{input: &qnap.APIError{Endpoint: "snapshot.cgi", Func: "create_snapshot", Result: "-2", Err: qnap.ErrAlreadyExists}, want: codes.AlreadyExists},
+		{input: &qnap.APIError{Endpoint: "iscsi_lun_setting.cgi", Func: "add_lun", Result: "-1", Err: qnap.ErrInvalidPool}, want: codes.InvalidArgument},
+		{input: &qnap.APIError{Endpoint: "authLogin.cgi", Func: "login", Err: qnap.ErrAuth}, want: codes.Unavailable},
+		{input: &qnap.APIError{Endpoint: "iscsi_lun_setting.cgi", Func: "edit_lun", Result: "-1"}, want: codes.Internal},
+		{input: fmt.Errorf("request failed: %w", context.DeadlineExceeded), want: codes.DeadlineExceeded},
+	}
+
+	for _, table := range tests {
+		got := status.Code(nasError(table.input, "Failed"))
+		if got != table.want {
+			t.Fatalf("%v: expected: %v, got: %v", table.input, table.want, got)
+		}
+	}
+}
+
+func TestDriver_GetCapacity(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestDriver(t)
+
+	resp, err := d.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	if err != nil {
+		t.Fatalf("failed to get capacity: %#v", err)
+	}
+	if resp.AvailableCapacity <= 0 {
+		t.Fatalf("expected some capacity, got %d", resp.AvailableCapacity)
+	}
+
+	// Only LUNs are created in a pool of the StorageClass's choosing, shared folders' options aren't looked at
+	if _, err = d.GetCapacity(ctx, &csi.GetCapacityRequest{Parameters: map[string]string{"protocol": "nfs", "nfsVolume": "0"}}); err != nil {
+		t.Fatalf("failed to get capacity for NFS: %#v", err)
+	}
+	if _, err = d.GetCapacity(ctx, &csi.GetCapacityRequest{Parameters: map[string]string{"storagePoolID": "one"}}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument for a bad pool, got %#v", err)
+	}
+}
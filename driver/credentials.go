@@ -0,0 +1,121 @@
+package driver
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Label on credential Secrets, along with one naming the target or shared folder, so DeleteVolume can find them
+// without the PV name
+const secretBackendLabel = DefaultDriverName + "/backend"
+
+// credentialStore keeps the credentials generated for volumes in Secrets, one per volume, which nodes are given and
+// retries of CreateVolume read back.
+type credentialStore struct {
+	client    kubernetes.Interface
+	namespace string
+
+	kind         string   // what the credentials are for, e.g. CHAP, for logs and errors
+	owner        string   // what Secrets belong to, "target" or "share", their name is in a label of that name
+	requiredKeys []string // keys a Secret has to have a value for to be usable
+}
+
+func (s *credentialStore) ownerLabel() string {
+	return DefaultDriverName + "/" + s.owner
+}
+
+// get returns the data in a Secret, or nil if it doesn't exist.
+func (s *credentialStore) get(ctx context.Context, secretName string) (map[string][]byte, error) {
+	secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range s.requiredKeys {
+		if len(secret.Data[key]) == 0 {
+			return nil, errors.New(s.kind + " secret " + secretName + " has no credentials")
+		}
+	}
+	return secret.Data, nil
+}
+
+func (s *credentialStore) create(ctx context.Context, secretName, backendName, owner string, data map[string][]byte) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				secretBackendLabel: backendName,
+				s.ownerLabel():     owner,
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}
+
+	_, err := s.client.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
+	return err
+}
+
+// getOrCreate returns the data in a volume's Secret, creating it from generate if it doesn't exist, so credentials are
+// only generated once. stored says they were there already.
+func (s *credentialStore) getOrCreate(ctx context.Context, secretName, backendName, owner string, generate func() (map[string][]byte, error)) (data map[string][]byte, stored bool, err error) {
+	if data, err = s.get(ctx, secretName); err != nil {
+		log.Error().Err(err).Str("secret", secretName).Str("kind", s.kind).Msg("Failed to get credentials secret")
+		return nil, false, status.Errorf(codes.Internal, "Failed to get %s secret %s: %v", s.kind, secretName, err)
+	}
+	if data != nil {
+		return data, true, nil
+	}
+
+	if data, err = generate(); err != nil {
+		log.Error().Err(err).Str("kind", s.kind).Msg("Failed to generate credentials")
+		return nil, false, status.Errorf(codes.Internal, "Failed to generate %s credentials: %v", s.kind, err)
+	}
+
+	err = s.create(ctx, secretName, backendName, owner, data)
+	if apierrors.IsAlreadyExists(err) {
+		// Lost a race with another attempt, use what it stored
+		stored = true
+		data, err = s.get(ctx, secretName)
+		if err == nil && data == nil {
+			err = errors.New("secret deleted while creating it")
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("secret", secretName).Str("kind", s.kind).Msg("Failed to create credentials secret")
+		return nil, false, status.Errorf(codes.Internal, "Failed to create %s secret %s: %v", s.kind, secretName, err)
+	}
+
+	return data, stored, nil
+}
+
+// delete removes the Secrets for a target or shared folder, if there are any.
+func (s *credentialStore) delete(ctx context.Context, backendName, owner string) error {
+	selector := labels.SelectorFromSet(labels.Set{secretBackendLabel: backendName, s.ownerLabel(): owner})
+	secretList, err := s.client.CoreV1().Secrets(s.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		log.Error().Err(err).Str(s.owner, owner).Str("kind", s.kind).Msg("Failed to list credentials secrets")
+		return status.Errorf(codes.Internal, "Failed to list %s secrets: %v", s.kind, err)
+	}
+
+	for _, secret := range secretList.Items {
+		if err = s.client.CoreV1().Secrets(s.namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			log.Error().Err(err).Str("secret", secret.Name).Str("kind", s.kind).Msg("Failed to delete credentials secret")
+			return status.Errorf(codes.Internal, "Failed to delete %s secret: %v", s.kind, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testCredentialsNamespace = "qnap-csi"
+
+func newTestCredentialStore(objects ...runtime.Object) (*credentialStore, *fake.Clientset) {
+	kubeClient := fake.NewSimpleClientset(objects...)
+	return &credentialStore{
+		client:       kubeClient,
+		namespace:    testCredentialsNamespace,
+		kind:         "test",
+		owner:        "share",
+		requiredKeys: []string{"username", "password"},
+	}, kubeClient
+}
+
+func TestCredentialStore_getOrCreate(t *testing.T) {
+	ctx := context.Background()
+	store, kubeClient := newTestCredentialStore(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "broken", Namespace: testCredentialsNamespace},
+		Data:       map[string][]byte{"username": []byte("user1")},
+	})
+
+	generated := 0
+	generate := func() (map[string][]byte, error) {
+		generated++
+		return map[string][]byte{"username": []byte("user1"), "password": []byte("password1")}, nil
+	}
+
+	// Retries get what the first attempt stored rather than new credentials
+	for attempt, wantStored := range []bool{false, true} {
+		data, stored, err := store.getOrCreate(ctx, "secret1", "nas-a", "share1", generate)
+		if err != nil {
+			t.Fatalf("failed to get or create credentials: %#v", err)
+		}
+		if stored != wantStored || string(data["password"]) != "password1" || generated != 1 {
+			t.Fatalf("attempt %d: unexpected credentials %v, stored: %v, generated: %d", attempt, data, stored, generated)
+		}
+	}
+	secret, err := kubeClient.CoreV1().Secrets(testCredentialsNamespace).Get(ctx, "secret1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get secret: %#v", err)
+	}
+	wantLabels := map[string]string{secretBackendLabel: "nas-a", DefaultDriverName + "/share": "share1"}
+	if !reflect.DeepEqual(secret.Labels, wantLabels) {
+		t.Fatalf("expected: %v, got: %v", wantLabels, secret.Labels)
+	}
+
+	if _, _, err = store.getOrCreate(ctx, "broken", "nas-a", "share2", generate); status.Code(err) != codes.Internal {
+		t.Fatalf("expected internal error for a secret without a password, got %#v", err)
+	}
+
+	// Another attempt creates the Secret first, its credentials win
+	kubeClient.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		winner := action.(k8stesting.CreateAction).GetObject().(*corev1.Secret).DeepCopy()
+		winner.Data = map[string][]byte{"username": []byte("user3"), "password": []byte("winner")}
+		return false, nil, kubeClient.Tracker().Add(winner)
+	})
+	data, stored, err := store.getOrCreate(ctx, "secret3", "nas-a", "share3", generate)
+	if err != nil {
+		t.Fatalf("failed to get or create credentials: %#v", err)
+	}
+	if !stored || string(data["password"]) != "winner" {
+		t.Fatalf("expected the stored credentials, got %v, stored: %v", data, stored)
+	}
+}
+
+func TestCredentialStore_delete(t *testing.T) {
+	ctx := context.Background()
+	store, kubeClient := newTestCredentialStore()
+
+	generate := func() (map[string][]byte, error) {
+		return map[string][]byte{"username": []byte("user1"), "password": []byte("password1")}, nil
+	}
+	for _, owner := range []struct{ secret, backend, share string }{
+		{secret: "secret1", backend: "nas-a", share: "share1"},
+		{secret: "secret2", backend: "nas-b", share: "share1"},
+		{secret: "secret3", backend: "nas-a", share: "share2"},
+	} {
+		if _, _, err := store.getOrCreate(ctx, owner.secret, owner.backend, owner.share, generate); err != nil {
+			t.Fatalf("failed to create credentials: %#v", err)
+		}
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := store.delete(ctx, "nas-a", "share1"); err != nil {
+			t.Fatalf("failed to delete credentials: %#v", err)
+		}
+	}
+
+	secrets, err := kubeClient.CoreV1().Secrets(testCredentialsNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list secrets: %#v", err)
+	}
+	if len(secrets.Items) != 2 || secrets.Items[0].Name != "secret2" || secrets.Items[1].Name != "secret3" {
+		t.Fatalf("expected only secret1 to be deleted, got %#v", secrets.Items)
+	}
+}
@@ -8,17 +8,25 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/rs/zerolog/log"
-	"github.com/terrycain/qnap-csi/qnap"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	"k8s.io/utils/mount"
 )
 
 const (
 	DefaultDriverName = "qnap.terrycain.github.com"
+
+	// volumeNameSeparator goes between the prefix, cluster ID and PV name in volume names, it's never in any of them
+	volumeNameSeparator = "-"
+
+	// MaxClusterIDLength keeps volume names, and the SMB usernames made from them, short enough for the NAS
+	MaxClusterIDLength = 12
 )
 
 var (
@@ -30,17 +38,28 @@ var (
 type Driver struct {
 	name string
 
-	storagePoolID int
-	endpoint      string
-	URL           string
-	nodeID        string
-	username      string
-	password      string
-	client        *qnap.Client
-	isController  bool
-	prefix        string
-	portal        string
-	configDir     string
+	endpoint     string
+	nodeID       string
+	isController bool
+	prefix       string
+	clusterID    string // empty unless the NAS is shared with other clusters
+	configDir    string
+	gc           *garbageCollector
+	chapSecrets  *credentialStore // nil unless CHAP is enabled
+	smbSecrets   *credentialStore // nil unless SMB is enabled
+	metrics      *metrics         // nil unless metrics are enabled
+
+	// backends are the NAS units the controller provisions on, nodeBackends are the ones a node can reach
+	backends       map[string]*backend
+	defaultBackend string
+	nodeBackends   []string
+
+	// initiatorNameFile is the host's open-iscsi initiator name, nodes use it as their node ID
+	initiatorNameFile string
+	// mounter does the bind mounts from a volume's staging path to where pods use it
+	mounter mount.Interface
+	// sysfsDir is where the state of ISCSI devices is read from
+	sysfsDir string
 
 	srv *grpc.Server
 
@@ -48,25 +67,77 @@ type Driver struct {
 	ready   bool
 }
 
-func NewDriver(endpoint, url, username, password string, isController bool, prefix string, nodeID string, portal string, storagePoolID int) (*Driver, error) {
-	qnapClient, err := qnap.NewClient(username, password, url)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Driver{
-		name:          DefaultDriverName,
-		storagePoolID: storagePoolID,
-		client:        qnapClient,
-		URL:           url,
-		isController:  isController,
-		endpoint:      endpoint,
-		username:      username,
-		nodeID:        nodeID,
-		password:      password,
-		prefix:        prefix,
-		portal:        portal,
-	}, nil
+// NewDriver creates a driver, the controller needs backends to provision volumes on, nodes need the names of the
+// backends they can reach so pods are only scheduled where their volumes are accessible.
+func NewDriver(endpoint string, backendsConfig BackendsConfig, isController bool, prefix string, nodeID string, nodeBackends []string) (*Driver, error) {
+	d := &Driver{
+		name:         DefaultDriverName,
+		isController: isController,
+		endpoint:     endpoint,
+		nodeID:       nodeID,
+		prefix:       prefix,
+		nodeBackends: nodeBackends,
+
+		initiatorNameFile: filepath.Join(hostDir(), "etc", "iscsi", "initiatorname.iscsi"),
+		mounter:           mount.New(""),
+		sysfsDir:          "/sys",
+	}
+
+	if isController {
+		if cleanISCSIName(prefix) == "" {
+			return nil, fmt.Errorf("invalid prefix %q, must contain letters or numbers", prefix)
+		}
+		var err error
+		if d.backends, d.defaultBackend, err = newBackends(backendsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// SetClusterID tags the names of new volumes with the cluster's ID as well as the prefix, so several clusters can share
+// a NAS without treating each other's volumes as their own.
+func (d *Driver) SetClusterID(clusterID string) error {
+	if clusterID != cleanISCSIName(clusterID) {
+		return fmt.Errorf("invalid cluster ID %q, must only contain lowercase letters and numbers", clusterID)
+	}
+	if len(clusterID) > MaxClusterIDLength {
+		return fmt.Errorf("invalid cluster ID %q, must be at most %d characters", clusterID, MaxClusterIDLength)
+	}
+	d.clusterID = clusterID
+	return nil
+}
+
+// volumeNameTag goes before the PV name in the names of the targets, LUNs and shared folders this driver creates.
+func (d *Driver) volumeNameTag() string {
+	if d.clusterID == "" {
+		return cleanISCSIName(d.prefix)
+	}
+	return cleanISCSIName(d.prefix) + volumeNameSeparator + d.clusterID
+}
+
+// taggedName is name tagged as this driver's, for volumes, snapshots and ACL policies.
+func (d *Driver) taggedName(name string) string {
+	return d.volumeNameTag() + volumeNameSeparator + cleanISCSIName(name)
+}
+
+// volumeName is the name of a new volume's target, LUN or shared folder.
+func (d *Driver) volumeName(pvName string) string {
+	return d.taggedName(pvName)
+}
+
+// ownsVolume reports whether a target, LUN or shared folder is one this driver created, so ones made by hand or by
+// other clusters are never listed or deleted. The separator can't be in the cleaned PV name, so "csi" doesn't own
+// "csi-prod-pvc1" and "csi-prod" doesn't own "csi-prod2-pvc1".
+func (d *Driver) ownsVolume(name string) bool {
+	tag := d.volumeNameTag() + volumeNameSeparator
+	if rest := strings.TrimPrefix(name, tag); len(rest) < len(name) && rest != "" && !strings.Contains(rest, volumeNameSeparator) {
+		return true
+	}
+	// Earlier versions named volumes after the PV alone, they can only be told apart from other clusters' volumes if
+	// this is the only cluster
+	return d.clusterID == "" && isDriverVolumeName(name)
 }
 
 func (d *Driver) Run(ctx context.Context) error {
@@ -99,14 +170,28 @@ func (d *Driver) Run(ctx context.Context) error {
 		return fmt.Errorf("failed to make directories for config, error: %w", err)
 	}
 
+	// Sorted out before serving, so kubelet's requests don't race with it
+	if !d.isController {
+		d.reconcileStagedVolumes()
+	}
+
 	grpcListener, err := net.Listen(u.Scheme, grpcAddr)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
 
+	var metricsListener net.Listener
+	if d.metrics != nil {
+		if metricsListener, err = net.Listen("tcp", d.metrics.address); err != nil {
+			return fmt.Errorf("failed to listen for metrics: %w", err)
+		}
+	}
+
 	// log response errors for better observability
 	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
 		resp, err := handler(ctx, req)
+		d.metrics.observeRPC(info.FullMethod, time.Since(start), err)
 		if err != nil {
 			log.Error().Err(err).Str("method", info.FullMethod).Msg("method failed")
 		}
@@ -131,6 +216,18 @@ func (d *Driver) Run(ctx context.Context) error {
 		}()
 		return d.srv.Serve(grpcListener)
 	})
+	if metricsListener != nil {
+		log.Info().Str("metrics_addr", metricsListener.Addr().String()).Msg("starting metrics server")
+		eg.Go(func() error {
+			return d.metrics.serve(ctx, metricsListener)
+		})
+	}
+	if d.isController && d.gc != nil && d.gc.opts.Interval > 0 {
+		eg.Go(func() error {
+			d.gc.run(ctx)
+			return nil
+		})
+	}
 
 	return eg.Wait()
 }
@@ -142,5 +239,6 @@ func (d *Driver) setReady(state bool) {
 }
 
 func (d *Driver) getISCSILibConfigPath(id string) string {
-	return path.Join(d.configDir, id+".json")
+	// Volume IDs contain the backend, which mustn't become a directory
+	return path.Join(d.configDir, strings.ReplaceAll(id, volumeIDSeparator, "_")+".json")
 }
@@ -0,0 +1,278 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/terrycain/qnap-csi/qnap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+)
+
+// GCOptions configures the controller's garbage collector, which looks for targets, LUNs and shared folders this driver
+// created that have been left behind by failed creates and deletes.
+type GCOptions struct {
+	// Interval between scans of the NAS, 0 disables the garbage collector
+	Interval time.Duration
+	// GracePeriod is how long something has to stay orphaned before it is deleted
+	GracePeriod time.Duration
+	// Delete removes orphans once they are past the grace period, otherwise they are only reported
+	Delete bool
+}
+
+const (
+	orphanTargetWithoutLUN = "target without LUN"
+	orphanLUNWithoutTarget = "LUN without target"
+	orphanVolumeWithoutPV  = "volume without PV"
+	// An NFS or SMB volume, SMB volumes' users and Secrets are deleted with them
+	orphanSharedFolderWithoutPV = "shared folder without PV"
+)
+
+// orphan is a target and/or LUNs, or a shared folder, on a backend which should no longer exist, targetIndex is -1 for
+// anything but a target.
+type orphan struct {
+	backend     *backend
+	kind        string
+	name        string
+	targetIndex int
+	lunIndexes  []int
+	protocol    string // of a shared folder, empty for targets and LUNs
+}
+
+func (o orphan) key() string {
+	return fmt.Sprintf("%s/%s/%s/%d/%v", o.backend.name, o.kind, o.name, o.targetIndex, o.lunIndexes)
+}
+
+// volumeLister returns the IDs of every volume Kubernetes has a PV for.
+type volumeLister interface {
+	ListVolumeIDs(ctx context.Context) (sets.String, error)
+}
+
+type pvVolumeLister struct {
+	client     kubernetes.Interface
+	driverName string
+}
+
+func (l *pvVolumeLister) ListVolumeIDs(ctx context.Context) (sets.String, error) {
+	pvList, err := l.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	volumeIDs := sets.NewString()
+	for _, pv := range pvList.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == l.driverName {
+			volumeIDs.Insert(pv.Spec.CSI.VolumeHandle)
+		}
+	}
+
+	return volumeIDs, nil
+}
+
+type garbageCollector struct {
+	backends       []*backend
+	defaultBackend string
+	owns           func(name string) bool // whether a target, LUN or shared folder is one the driver created
+	opts           GCOptions
+	// deleteSharedFolder deletes an NFS or SMB volume the same way DeleteVolume does
+	deleteSharedFolder func(ctx context.Context, b *backend, protocol, share string) error
+	volumes            volumeLister // nil if Kubernetes can't be asked, so volumes without a PV aren't looked for
+
+	// firstSeen is when each current orphan was first found, so the grace period is measured from then
+	firstSeen map[string]time.Time
+	now       func() time.Time
+}
+
+// EnableGC turns on the garbage collector when the controller runs. kubeClient is used to find volumes which no
+// longer have a PV, if it is nil only targets without LUNs and LUNs without targets are collected. Shared folders are
+// only orphaned by not having a PV, and SMB users whose shared folder has already gone can't be found.
+func (d *Driver) EnableGC(opts GCOptions, kubeClient kubernetes.Interface) {
+	gc := &garbageCollector{
+		backends:           d.sortedBackends(),
+		defaultBackend:     d.defaultBackend,
+		owns:               d.ownsVolume,
+		opts:               opts,
+		deleteSharedFolder: d.deleteSharedFolderVolume,
+		firstSeen:          map[string]time.Time{},
+		now:                time.Now,
+	}
+	if kubeClient != nil {
+		gc.volumes = &pvVolumeLister{client: kubeClient, driverName: d.name}
+	}
+
+	d.gc = gc
+}
+
+func (g *garbageCollector) run(ctx context.Context) {
+	log.Info().Dur("interval", g.opts.Interval).Dur("grace_period", g.opts.GracePeriod).Bool("delete", g.opts.Delete).Msg("Starting garbage collector")
+
+	ticker := time.NewTicker(g.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := g.collect(ctx); err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("Failed to collect orphaned volumes")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect finds orphans, reports them and deletes the ones past the grace period if deleting is enabled.
+func (g *garbageCollector) collect(ctx context.Context) error {
+	orphans, err := g.findOrphans(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := g.now()
+	current := map[string]time.Time{}
+	for _, o := range orphans {
+		firstSeen, ok := g.firstSeen[o.key()]
+		if !ok {
+			firstSeen = now
+		}
+		current[o.key()] = firstSeen
+		age := now.Sub(firstSeen)
+
+		logger := log.With().Str("backend", o.backend.name).Str("kind", o.kind).Str("name", o.name).Int("target_index", o.targetIndex).Ints("lun_indexes", o.lunIndexes).Dur("age", age).Logger()
+		if !g.opts.Delete || age < g.opts.GracePeriod {
+			logger.Warn().Msg("Found orphan")
+			continue
+		}
+
+		logger.Info().Msg("Deleting orphan")
+		if err = g.deleteOrphan(ctx, o); err != nil {
+			logger.Error().Err(err).Msg("Failed to delete orphan")
+			continue
+		}
+		delete(current, o.key())
+	}
+
+	// Anything which is no longer orphaned starts its grace period again if it becomes orphaned later
+	g.firstSeen = current
+
+	return nil
+}
+
+func (g *garbageCollector) findOrphans(ctx context.Context) ([]orphan, error) {
+	var volumeIDs sets.String
+	if g.volumes != nil {
+		pvVolumeIDs, err := g.volumes.ListVolumeIDs(ctx)
+		if err != nil {
+			// Still worth looking for the other kinds of orphan
+			log.Warn().Err(err).Msg("Failed to list PVs, not looking for volumes without a PV")
+		} else {
+			// PVs from before backends existed have volume IDs without one
+			volumeIDs = sets.NewString()
+			for volumeID := range pvVolumeIDs {
+				backendName, name := parseVolumeID(volumeID)
+				if backendName == "" {
+					backendName = g.defaultBackend
+				}
+				volumeIDs.Insert(buildVolumeID(backendName, name))
+			}
+		}
+	}
+
+	var orphans []orphan
+	for _, b := range g.backends {
+		backendOrphans, err := findBackendOrphans(ctx, b, g.owns, volumeIDs)
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", b.name, err)
+		}
+		orphans = append(orphans, backendOrphans...)
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].key() < orphans[j].key()
+	})
+
+	return orphans, nil
+}
+
+// findBackendOrphans finds the orphans among the targets, LUNs and shared folders owns says are the driver's on one
+// backend, volumes without a PV are only looked for if volumeIDs is not nil.
+func findBackendOrphans(ctx context.Context, b *backend, owns func(name string) bool, volumeIDs sets.String) ([]orphan, error) {
+	targetList, err := b.client.GetStorageISCSITargetList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get list of ISCSI targets: %w", err)
+	}
+	lunList, err := b.client.GetStorageISCSILunList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get list of ISCSI LUNs: %w", err)
+	}
+
+	var orphans []orphan
+	attachedLUNs := sets.NewInt()
+	for _, target := range targetList.Targets {
+		attachedLUNs.Insert(target.TargetLUNs...)
+		if !owns(target.Name) {
+			continue
+		}
+
+		switch {
+		case len(target.TargetLUNs) == 0:
+			orphans = append(orphans, orphan{backend: b, kind: orphanTargetWithoutLUN, name: target.Name, targetIndex: target.TargetIndex})
+		case volumeIDs != nil && !volumeIDs.Has(buildVolumeID(b.name, target.Name)):
+			orphans = append(orphans, orphan{backend: b, kind: orphanVolumeWithoutPV, name: target.Name, targetIndex: target.TargetIndex, lunIndexes: target.TargetLUNs})
+		}
+	}
+
+	for _, lun := range lunList.LUNs {
+		if !owns(lun.Name) || attachedLUNs.Has(lun.Index) {
+			continue
+		}
+		orphans = append(orphans, orphan{backend: b, kind: orphanLUNWithoutTarget, name: lun.Name, targetIndex: -1, lunIndexes: []int{lun.Index}})
+	}
+
+	if volumeIDs == nil {
+		return orphans, nil
+	}
+	folderList, err := b.client.GetSharedFolderList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get list of shared folders: %w", err)
+	}
+	for i := range folderList.SharedFolders {
+		folder := &folderList.SharedFolders[i]
+		if !owns(folder.Name) {
+			continue
+		}
+		volume, _ := b.sharedFolderVolume(folder)
+		if !volumeIDs.Has(volume.VolumeId) {
+			orphans = append(orphans, orphan{backend: b, kind: orphanSharedFolderWithoutPV, name: folder.Name, targetIndex: -1, protocol: volumeProtocol(volume.VolumeId)})
+		}
+	}
+
+	return orphans, nil
+}
+
+func (g *garbageCollector) deleteOrphan(ctx context.Context, o orphan) error {
+	if o.protocol != "" {
+		return g.deleteSharedFolder(ctx, o.backend, o.protocol, o.name)
+	}
+
+	// Same order as DeleteVolume, so a failure leaves the target to be found again next time
+	for _, lunIndex := range o.lunIndexes {
+		if err := o.backend.client.DeleteStorageISCSIBlockLUN(ctx, lunIndex, false); err != nil && !errors.Is(err, qnap.ErrNotFound) {
+			return err
+		}
+	}
+
+	if o.targetIndex >= 0 {
+		if err := o.backend.client.DeleteStorageISCSITarget(ctx, o.targetIndex); err != nil && !errors.Is(err, qnap.ErrNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/terrycain/qnap-csi/qnap"
+	"github.com/terrycain/qnap-csi/qnap/qnaptest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	gcVolumeWithPV     = "pvc00000000000000000000000000000001"
+	gcVolumeWithoutPV  = "pvc00000000000000000000000000000002"
+	gcTargetWithoutLUN = "pvc00000000000000000000000000000003"
+	gcLUNWithoutTarget = "pvc00000000000000000000000000000004"
+	gcUnownedTarget    = "manual"
+	gcNFSWithPV        = "pvc00000000000000000000000000000005"
+	gcNFSWithoutPV     = "pvc00000000000000000000000000000006"
+	gcSMBWithoutPV     = "pvc00000000000000000000000000000007"
+)
+
+func newTestGC(t *testing.T, deleteOrphans bool) (*garbageCollector, *qnaptest.Server, *time.Time) {
+	t.Helper()
+
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+	client := d.backends[DefaultBackendName].client
+
+	for _, name := range []string{gcVolumeWithPV, gcVolumeWithoutPV} {
+		targetIndex, err := client.CreateStorageISCSITarget(ctx, name, false, false, true)
+		if err != nil {
+			t.Fatalf("failed to create target: %#v", err)
+		}
+		lunResp, err := client.CreateStorageISCSIBlockLUN(ctx, name, qnaptest.DefaultStoragePoolID, 10, false, 512, false, false, false, false)
+		if err != nil {
+			t.Fatalf("failed to create lun: %#v", err)
+		}
+		if err = client.AttachStorageISCSITargetLUN(ctx, lunResp.Result, targetIndex); err != nil {
+			t.Fatalf("failed to attach lun: %#v", err)
+		}
+	}
+	for _, name := range []string{gcTargetWithoutLUN, gcUnownedTarget} {
+		if _, err := client.CreateStorageISCSITarget(ctx, name, false, false, true); err != nil {
+			t.Fatalf("failed to create target: %#v", err)
+		}
+	}
+	if _, err := client.CreateStorageISCSIBlockLUN(ctx, gcLUNWithoutTarget, qnaptest.DefaultStoragePoolID, 10, false, 512, false, false, false, false); err != nil {
+		t.Fatalf("failed to create lun: %#v", err)
+	}
+
+	for _, name := range []string{gcNFSWithPV, gcNFSWithoutPV, gcSMBWithoutPV, gcUnownedTarget} {
+		if err := client.CreateSharedFolder(ctx, name, 1, 10); err != nil {
+			t.Fatalf("failed to create shared folder: %#v", err)
+		}
+		if name == gcSMBWithoutPV {
+			continue
+		}
+		if err := client.SetSharedFolderNFSAccess(ctx, name, []string{"10.0.0.0/24"}, qnap.NFSSquashNone); err != nil {
+			t.Fatalf("failed to set NFS access: %#v", err)
+		}
+	}
+	smbUser := d.smbUsername(gcSMBWithoutPV)
+	if err := client.CreateUser(ctx, smbUser, "password"); err != nil {
+		t.Fatalf("failed to create user: %#v", err)
+	}
+
+	pv := func(name, volumeHandle string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{Driver: DefaultDriverName, VolumeHandle: volumeHandle},
+				},
+			},
+		}
+	}
+	kubeClient := fake.NewSimpleClientset(
+		pv("pvc-00000000-0000-0000-0000-000000000001", gcVolumeWithPV),
+		pv("pvc-00000000-0000-0000-0000-000000000005", buildSharedFolderVolumeID(DefaultBackendName, protocolNFS, gcNFSWithPV)),
+	)
+
+	d.EnableGC(GCOptions{Interval: time.Minute, GracePeriod: time.Hour, Delete: deleteOrphans}, kubeClient)
+	now := time.Now()
+	d.gc.now = func() time.Time { return now }
+
+	return d.gc, srv, &now
+}
+
+func TestGarbageCollector_FindOrphans(t *testing.T) {
+	ctx := context.Background()
+	gc, _, _ := newTestGC(t, false)
+
+	orphans, err := gc.findOrphans(ctx)
+	if err != nil {
+		t.Fatalf("failed to find orphans: %#v", err)
+	}
+
+	want := map[string]string{
+		gcVolumeWithoutPV:  orphanVolumeWithoutPV,
+		gcTargetWithoutLUN: orphanTargetWithoutLUN,
+		gcLUNWithoutTarget: orphanLUNWithoutTarget,
+		gcNFSWithoutPV:     orphanSharedFolderWithoutPV,
+		gcSMBWithoutPV:     orphanSharedFolderWithoutPV,
+	}
+	if len(orphans) != len(want) {
+		t.Fatalf("expected %d orphans, got %#v", len(want), orphans)
+	}
+	for _, o := range orphans {
+		if want[o.name] != o.kind {
+			t.Fatalf("unexpected orphan %#v", o)
+		}
+	}
+}
+
+func TestGarbageCollector_ClusterID(t *testing.T) {
+	ctx := context.Background()
+	gc, _, _ := newTestGC(t, true)
+
+	// With a cluster ID, volumes named like earlier versions did could belong to another cluster
+	d := &Driver{prefix: DefaultVolumePrefix}
+	if err := d.SetClusterID("prod"); err != nil {
+		t.Fatalf("failed to set cluster ID: %#v", err)
+	}
+	gc.owns = d.ownsVolume
+
+	orphans, err := gc.findOrphans(ctx)
+	if err != nil {
+		t.Fatalf("failed to find orphans: %#v", err)
+	}
+	if len(orphans) != 0 {
+		t.Fatalf("expected no orphans, got %#v", orphans)
+	}
+}
+
+func TestGarbageCollector_GracePeriod(t *testing.T) {
+	ctx := context.Background()
+	gc, srv, now := newTestGC(t, true)
+
+	if err := gc.collect(ctx); err != nil {
+		t.Fatalf("failed to collect: %#v", err)
+	}
+	if len(srv.Targets()) != 4 || len(srv.LUNs()) != 3 {
+		t.Fatalf("nothing should be deleted within the grace period, have %d targets and %d LUNs", len(srv.Targets()), len(srv.LUNs()))
+	}
+
+	*now = now.Add(2 * time.Hour)
+	if err := gc.collect(ctx); err != nil {
+		t.Fatalf("failed to collect: %#v", err)
+	}
+
+	targets := srv.Targets()
+	if len(targets) != 2 || len(srv.LUNs()) != 1 {
+		t.Fatalf("expected 2 targets and 1 LUN to be left, have %d targets and %d LUNs", len(targets), len(srv.LUNs()))
+	}
+	for _, target := range targets {
+		if target.Name != gcVolumeWithPV && target.Name != gcUnownedTarget {
+			t.Fatalf("target %s should have been deleted", target.Name)
+		}
+	}
+
+	folders := srv.SharedFolders()
+	if len(folders) != 2 || folders[0].Name != gcUnownedTarget || folders[1].Name != gcNFSWithPV {
+		t.Fatalf("expected shared folders %s and %s to be left, got %#v", gcUnownedTarget, gcNFSWithPV, folders)
+	}
+	if users := srv.Users(); len(users) != 0 {
+		t.Fatalf("expected the SMB user to be deleted, got %v", users)
+	}
+}
+
+func TestGarbageCollector_ReportOnly(t *testing.T) {
+	ctx := context.Background()
+	gc, srv, now := newTestGC(t, false)
+
+	if err := gc.collect(ctx); err != nil {
+		t.Fatalf("failed to collect: %#v", err)
+	}
+	*now = now.Add(2 * time.Hour)
+	if err := gc.collect(ctx); err != nil {
+		t.Fatalf("failed to collect: %#v", err)
+	}
+
+	if len(srv.Targets()) != 4 || len(srv.LUNs()) != 3 || len(srv.SharedFolders()) != 4 {
+		t.Fatalf("nothing should be deleted when only reporting, have %d targets, %d LUNs and %d shared folders", len(srv.Targets()), len(srv.LUNs()), len(srv.SharedFolders()))
+	}
+}
@@ -38,7 +38,7 @@ func (d *Driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCa
 			{
 				Type: &csi.PluginCapability_VolumeExpansion_{
 					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
-						Type: csi.PluginCapability_VolumeExpansion_UNKNOWN,
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
 					},
 				},
 			},
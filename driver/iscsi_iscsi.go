@@ -16,16 +16,17 @@ limitations under the License.
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"strconv"
-	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	iscsiLib "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/utils/exec"
 	"k8s.io/utils/mount"
 )
 
-func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
+func getISCSIInfo(req *csi.NodeStageVolumeRequest) (*iscsiDisk, error) {
 	volName := req.GetVolumeId()
 	tp := req.GetVolumeContext()["targetPortal"]
 	iqn := req.GetVolumeContext()["iqn"]
@@ -35,8 +36,8 @@ func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
 	}
 
 	portalList := req.GetVolumeContext()["portals"]
-	secretParams := req.GetVolumeContext()["secret"]
-	secret := parseSecret(secretParams)
+	// CHAP credentials come from the StorageClass' node secret, never the volume context as that's stored in the PV
+	secret := req.GetSecrets()
 	sessionSecret, err := parseSessionSecret(secret)
 	if err != nil {
 		return nil, err
@@ -55,8 +56,14 @@ func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
 		return nil, err
 	}
 
+	// The target portal may be listed again, logging in to it twice would give multipath two paths to the same place
+	seen := sets.NewString(bkportal...)
 	for _, portal := range portals {
-		bkportal = append(bkportal, portalMounter(portal))
+		portal = portalMounter(portal)
+		if !seen.Has(portal) {
+			seen.Insert(portal)
+			bkportal = append(bkportal, portal)
+		}
 	}
 
 	iface := req.GetVolumeContext()["iscsiInterface"]
@@ -69,6 +76,9 @@ func getISCSIInfo(req *csi.NodePublishVolumeRequest) (*iscsiDisk, error) {
 	chapSession := false
 	if req.GetVolumeContext()["sessionCHAPAuth"] == "true" {
 		chapSession = true
+		if sessionSecret == (iscsiLib.Secrets{}) {
+			return nil, fmt.Errorf("volume needs CHAP but no CHAP secret was given, check the StorageClass' node secret parameters")
+		}
 	}
 
 	var lunVal int32
@@ -119,26 +129,28 @@ func buildISCSIConnector(iscsiInfo *iscsiDisk) *iscsiLib.Connector {
 	return &c
 }
 
-func getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.NodePublishVolumeRequest) *iscsiDiskMounter {
-	readOnly := req.GetReadonly()
+// getISCSIDiskMounter mounts the disk at the staging path, it's always read-write there as publishing decides whether
+// a pod gets to write. Raw block volumes are only connected.
+func getISCSIDiskMounter(iscsiInfo *iscsiDisk, req *csi.NodeStageVolumeRequest) *iscsiDiskMounter {
+	_, isBlock := req.GetVolumeCapability().GetAccessType().(*csi.VolumeCapability_Block)
 	fsType := req.GetVolumeCapability().GetMount().GetFsType()
 	mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
 
 	diskMounter := &iscsiDiskMounter{
 		iscsiDisk:    iscsiInfo,
+		isBlock:      isBlock,
 		fsType:       fsType,
-		readOnly:     readOnly,
 		mountOptions: mountOptions,
 		mounter:      &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()},
 		exec:         exec.New(),
-		targetPath:   req.GetTargetPath(),
+		targetPath:   req.GetStagingTargetPath(),
 		connector:    buildISCSIConnector(iscsiInfo),
 	}
 
 	return diskMounter
 }
 
-func getISCSIDiskUnmounter(req *csi.NodeUnpublishVolumeRequest) *iscsiDiskUnmounter {
+func getISCSIDiskUnmounter(req *csi.NodeUnstageVolumeRequest) *iscsiDiskUnmounter {
 	return &iscsiDiskUnmounter{
 		iscsiDisk: &iscsiDisk{
 			VolName: req.GetVolumeId(),
@@ -149,22 +161,13 @@ func getISCSIDiskUnmounter(req *csi.NodeUnpublishVolumeRequest) *iscsiDiskUnmoun
 }
 
 func portalMounter(portal string) string {
-	if !strings.Contains(portal, ":") {
-		portal += ":3260"
+	if _, _, err := net.SplitHostPort(portal); err != nil {
+		portal = net.JoinHostPort(portalHost(portal), "3260")
 	}
 
 	return portal
 }
 
-func parseSecret(secretParams string) map[string]string {
-	var secret map[string]string
-	if err := json.Unmarshal([]byte(secretParams), &secret); err != nil {
-		return nil
-	}
-
-	return secret
-}
-
 func parseSessionSecret(secretParams map[string]string) (iscsiLib.Secrets, error) {
 	var ok bool
 	secret := iscsiLib.Secrets{}
@@ -179,11 +182,12 @@ func parseSessionSecret(secretParams map[string]string) (iscsiLib.Secrets, error
 	if secret.Password, ok = secretParams["node.session.auth.password"]; !ok {
 		return iscsiLib.Secrets{}, fmt.Errorf("node.session.auth.password not found in secret")
 	}
-	if secret.UserNameIn, ok = secretParams["node.session.auth.username_in"]; !ok {
-		return iscsiLib.Secrets{}, fmt.Errorf("node.session.auth.username_in not found in secret")
-	}
-	if secret.PasswordIn, ok = secretParams["node.session.auth.password_in"]; !ok {
-		return iscsiLib.Secrets{}, fmt.Errorf("node.session.auth.password_in not found in secret")
+
+	// Mutual CHAP is optional, but needs both halves
+	secret.UserNameIn = secretParams["node.session.auth.username_in"]
+	secret.PasswordIn = secretParams["node.session.auth.password_in"]
+	if (secret.UserNameIn == "") != (secret.PasswordIn == "") {
+		return iscsiLib.Secrets{}, fmt.Errorf("node.session.auth.username_in and node.session.auth.password_in must both be in secret")
 	}
 
 	secret.SecretsType = "chap"
@@ -194,7 +198,8 @@ func parseDiscoverySecret(secretParams map[string]string) (iscsiLib.Secrets, err
 	var ok bool
 	secret := iscsiLib.Secrets{}
 
-	if len(secretParams) == 0 {
+	// Discovery CHAP is separate from session CHAP, a secret with only session credentials is fine
+	if _, ok = secretParams["node.sendtargets.auth.username"]; !ok {
 		return secret, nil
 	}
 
@@ -232,7 +237,7 @@ type iscsiDisk struct {
 
 type iscsiDiskMounter struct {
 	*iscsiDisk
-	readOnly     bool
+	isBlock      bool
 	fsType       string
 	mountOptions []string
 	mounter      *mount.SafeFormatAndMount
@@ -2,7 +2,9 @@ package driver
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strings"
 
 	iscsiLib "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
 	"google.golang.org/grpc/codes"
@@ -22,6 +24,16 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter, iscsiInfoPath string) (str
 	if devicePath == "" {
 		return "", fmt.Errorf("connect reported success, but no path returned")
 	}
+
+	// Raw block volumes aren't mounted at the staging path, publishing bind mounts the device itself
+	if b.isBlock {
+		if err = iscsiLib.PersistConnector(b.connector, iscsiInfoPath); err != nil {
+			klog.Errorf("failed to persist connection info: %v", err)
+			return "", fmt.Errorf("unable to create persistence file for connection")
+		}
+		return devicePath, nil
+	}
+
 	// Mount device
 	mntPath := b.targetPath
 	notMnt, err := b.mounter.IsLikelyNotMountPoint(mntPath)
@@ -45,14 +57,8 @@ func (util *ISCSIUtil) AttachDisk(b iscsiDiskMounter, iscsiInfoPath string) (str
 		return "", fmt.Errorf("unable to create persistence file for connection")
 	}
 
-	var options []string
-
-	if b.readOnly {
-		options = append(options, "ro")
-	} else {
-		options = append(options, "rw")
-	}
-	options = append(options, b.mountOptions...)
+	// Read-only publishes are read-only bind mounts of this
+	options := append([]string{"rw"}, b.mountOptions...)
 
 	err = b.mounter.FormatAndMount(devicePath, mntPath, b.fsType, options)
 	if err != nil {
@@ -84,14 +90,17 @@ func (util *ISCSIUtil) DetachDisk(c iscsiDiskUnmounter, targetPath, iscsiInfoPat
 		}
 		return status.Error(codes.Internal, err.Error())
 	}
-	if err = c.mounter.Unmount(targetPath); err != nil {
-		klog.Errorf("iscsi detach disk: failed to unmount: %s\nError: %v", targetPath, err)
-		return err
-	}
-	cnt--
-	if cnt != 0 {
-		klog.Errorf("the device is in use : %d", cnt)
-		return nil
+	// Nothing is mounted for raw block volumes, or if a previous attempt got as far as unmounting
+	if cnt > 0 {
+		if err = c.mounter.Unmount(targetPath); err != nil {
+			klog.Errorf("iscsi detach disk: failed to unmount: %s\nError: %v", targetPath, err)
+			return err
+		}
+		cnt--
+		if cnt != 0 {
+			klog.Errorf("the device is in use : %d", cnt)
+			return nil
+		}
 	}
 
 	klog.Info("detaching ISCSI device")
@@ -101,7 +110,7 @@ func (util *ISCSIUtil) DetachDisk(c iscsiDiskUnmounter, targetPath, iscsiInfoPat
 		return err
 	}
 
-	iscsiLib.Disconnect(connector.TargetIqn, connector.TargetPortals)
+	logoutPortals(connector.TargetIqn, connector.TargetPortals)
 	if err := os.RemoveAll(targetPath); err != nil {
 		klog.Errorf("iscsi: failed to remove mount path Error: %v", err)
 	}
@@ -114,3 +123,25 @@ func (util *ISCSIUtil) DetachDisk(c iscsiDiskUnmounter, targetPath, iscsiInfoPat
 
 	return nil
 }
+
+// logoutPortals logs out of the target on every portal. Unlike iscsiLib.Disconnect it carries on past a failed logout,
+// so one unreachable portal of a multipath volume doesn't leave sessions to the others behind.
+func logoutPortals(targetIqn string, portals []string) {
+	for _, portal := range portals {
+		if err := iscsiLib.Logout(targetIqn, portalHost(portal)); err != nil {
+			klog.Warningf("failed to log out of %s on %s: %v", targetIqn, portal, err)
+		}
+	}
+
+	if err := iscsiLib.DeleteDBEntry(targetIqn); err != nil {
+		klog.Warningf("failed to delete node record for %s: %v", targetIqn, err)
+	}
+}
+
+// portalHost is the address of a portal without its port, which may be left off. IPv6 addresses lose their brackets.
+func portalHost(portal string) string {
+	if host, _, err := net.SplitHostPort(portal); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(portal, "["), "]")
+}
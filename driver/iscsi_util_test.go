@@ -0,0 +1,23 @@
+package driver
+
+import "testing"
+
+func Test_portalHost(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "10.0.1.5:3260", want: "10.0.1.5"},
+		{input: "10.0.1.5", want: "10.0.1.5"},
+		{input: "[fd00::1]:3260", want: "fd00::1"},
+		{input: "[fd00::1]", want: "fd00::1"},
+		{input: "fd00::1", want: "fd00::1"},
+		{input: "nas.example.com:3261", want: "nas.example.com"},
+	}
+
+	for _, table := range tests {
+		if got := portalHost(table.input); got != table.want {
+			t.Fatalf("%s: expected: %s, got: %s", table.input, table.want, got)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"github.com/terrycain/qnap-csi/qnap"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	metricsNamespace = "qnap_csi"
+
+	// storagePoolTimeout bounds how long a scrape waits for each backend's storage pool
+	storagePoolTimeout = 10 * time.Second
+	// metricsShutdownTimeout is how long in-flight scrapes get when the driver stops
+	metricsShutdownTimeout = 5 * time.Second
+)
+
+// metrics are the driver's Prometheus metrics. The methods do nothing on a nil *metrics, so callers don't need to
+// check whether metrics are enabled.
+type metrics struct {
+	address  string
+	registry *prometheus.Registry
+
+	rpcDuration *prometheus.HistogramVec
+	rpcErrors   *prometheus.CounterVec
+	apiDuration *prometheus.HistogramVec
+	apiErrors   *prometheus.CounterVec
+	logins      *prometheus.CounterVec
+	lunWait     *prometheus.HistogramVec
+}
+
+func newMetrics(address string) *metrics {
+	m := &metrics{
+		address:  address,
+		registry: prometheus.NewRegistry(),
+
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_duration_seconds",
+			Help:      "How long CSI RPCs took to handle.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+		}, []string{"method"}),
+		rpcErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_errors_total",
+			Help:      "CSI RPCs which returned an error, by gRPC code.",
+		}, []string{"method", "code"}),
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "qnap_request_duration_seconds",
+			Help:      "How long requests to the QNAP API took.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+		}, []string{"backend", "cgi", "func"}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "qnap_request_errors_total",
+			Help:      "Requests to the QNAP API which failed, by reason.",
+		}, []string{"backend", "cgi", "func", "reason"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "qnap_logins_total",
+			Help:      "Sessions started on the QNAP, by result.",
+		}, []string{"backend", "result"}),
+		lunWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "lun_creation_wait_seconds",
+			Help:      "How long CreateVolume waited for a new LUN to finish creating.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{"backend"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.rpcDuration,
+		m.rpcErrors,
+		m.apiDuration,
+		m.apiErrors,
+		m.logins,
+		m.lunWait,
+	)
+
+	return m
+}
+
+// EnableMetrics serves Prometheus metrics on address when the driver runs. The controller exports RPC, QNAP API and
+// storage pool metrics, nodes export RPC and ISCSI session metrics.
+func (d *Driver) EnableMetrics(address string) {
+	m := newMetrics(address)
+
+	if d.isController {
+		backends := d.sortedBackends()
+		for _, b := range backends {
+			b.client.SetObserver(&apiObserver{metrics: m, backend: b.name})
+		}
+		m.registry.MustRegister(newStoragePoolCollector(backends))
+	} else {
+		m.registry.MustRegister(newSessionCollector(d.sysfsDir))
+	}
+
+	d.metrics = m
+}
+
+// serve runs the metrics HTTP server until ctx is done.
+func (m *metrics) serve(ctx context.Context, listener net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Warn().Err(err).Msg("Failed to stop metrics server")
+		}
+	}()
+
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (m *metrics) observeRPC(method string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.rpcDuration.WithLabelValues(method).Observe(duration.Seconds())
+	if err != nil {
+		m.rpcErrors.WithLabelValues(method, status.Code(err).String()).Inc()
+	}
+}
+
+func (m *metrics) observeLUNWait(backend string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lunWait.WithLabelValues(backend).Observe(duration.Seconds())
+}
+
+// apiObserver records a backend's QNAP API requests.
+type apiObserver struct {
+	metrics *metrics
+	backend string
+}
+
+func (o *apiObserver) ObserveRequest(cgi, function string, statusCode int, duration time.Duration, err error) {
+	o.metrics.apiDuration.WithLabelValues(o.backend, cgi, function).Observe(duration.Seconds())
+	// Requests which got a response are counted by ObserveError, if the NAS says they failed
+	if err != nil {
+		o.metrics.apiErrors.WithLabelValues(o.backend, cgi, function, "transport").Inc()
+	}
+}
+
+func (o *apiObserver) ObserveError(err *qnap.APIError) {
+	o.metrics.apiErrors.WithLabelValues(o.backend, err.Endpoint, err.Func, apiErrorReason(err)).Inc()
+}
+
+// apiErrorReason labels a failed request by the sentinel error it was turned into.
+func apiErrorReason(err *qnap.APIError) string {
+	switch {
+	case errors.Is(err, qnap.ErrAuth):
+		return "auth"
+	case errors.Is(err, qnap.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, qnap.ErrAlreadyExists):
+		return "already_exists"
+	case errors.Is(err, qnap.ErrInvalidPool):
+		return "invalid_pool"
+	case errors.Is(err, qnap.ErrInvalidVolume):
+		return "invalid_volume"
+	case err.StatusCode != http.StatusOK:
+		return "http_status"
+	default:
+		return "unknown"
+	}
+}
+
+func (o *apiObserver) ObserveLogin(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	o.metrics.logins.WithLabelValues(o.backend, result).Inc()
+}
+
+// storagePoolCollector asks each backend for the usage of its storage pools when scraped, the backend's own pool and
+// every other pool with volumes or LUNs in it, e.g. ones a StorageClass picked with storagePoolID.
+type storagePoolCollector struct {
+	backends []*backend
+
+	capacity        *prometheus.Desc
+	free            *prometheus.Desc
+	thinProvisioned *prometheus.Desc
+}
+
+func newStoragePoolCollector(backends []*backend) *storagePoolCollector {
+	labels := []string{"backend", "pool_id"}
+	return &storagePoolCollector{
+		backends:        backends,
+		capacity:        prometheus.NewDesc(metricsNamespace+"_storage_pool_capacity_bytes", "Size of the storage pool volumes are created in.", labels, nil),
+		free:            prometheus.NewDesc(metricsNamespace+"_storage_pool_free_bytes", "Free space in the storage pool volumes are created in.", labels, nil),
+		thinProvisioned: prometheus.NewDesc(metricsNamespace+"_storage_pool_thin_provisioned_bytes", "Total size of the thin volumes and LUNs in the storage pool.", labels, nil),
+	}
+}
+
+func (c *storagePoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.capacity
+	ch <- c.free
+	ch <- c.thinProvisioned
+}
+
+func (c *storagePoolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, b := range c.backends {
+		for _, poolID := range storagePoolIDs(b) {
+			ctx, cancel := context.WithTimeout(context.Background(), storagePoolTimeout)
+			resp, err := b.client.GetStoragePoolSubscription(ctx, poolID)
+			cancel()
+			if err != nil {
+				// Leaving the pool out rather than failing the scrape keeps the other pools' metrics
+				log.Warn().Err(err).Str("backend", b.name).Int("pool_id", poolID).Msg("Failed to get storage pool for metrics")
+				continue
+			}
+
+			pool := resp.PoolSubscription
+			poolLabel := strconv.Itoa(poolID)
+			ch <- prometheus.MustNewConstMetric(c.capacity, prometheus.GaugeValue, float64(pool.CapacityBytes), b.name, poolLabel)
+			ch <- prometheus.MustNewConstMetric(c.free, prometheus.GaugeValue, float64(pool.FreesizeBytes), b.name, poolLabel)
+			ch <- prometheus.MustNewConstMetric(c.thinProvisioned, prometheus.GaugeValue, float64(pool.ThinVolumeTotal+pool.ThinLUNTotal), b.name, poolLabel)
+		}
+	}
+}
+
+// storagePoolIDs returns the backend's storage pool and the pools its logical volumes are in, sorted. The client can't
+// list pools, but anything created in one shows up as a logical volume, LUNs included.
+func storagePoolIDs(b *backend) []int {
+	poolIDs := sets.NewInt(b.storagePoolID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), storagePoolTimeout)
+	resp, err := b.client.GetStorageLogicalVolumes(ctx)
+	cancel()
+	if err != nil {
+		log.Warn().Err(err).Str("backend", b.name).Msg("Failed to get logical volumes for metrics, only reporting the backend's storage pool")
+		return poolIDs.List()
+	}
+
+	for _, volume := range resp.Volumes {
+		if poolID, err := strconv.Atoi(volume.StoragePoolID); err == nil && poolID > 0 {
+			poolIDs.Insert(poolID)
+		}
+	}
+	return poolIDs.List()
+}
+
+// sessionCollector counts the node's ISCSI sessions by state, as the kernel reports them in sysfs.
+type sessionCollector struct {
+	sysfsDir string
+	sessions *prometheus.Desc
+}
+
+func newSessionCollector(sysfsDir string) *sessionCollector {
+	return &sessionCollector{
+		sysfsDir: sysfsDir,
+		sessions: prometheus.NewDesc(metricsNamespace+"_iscsi_sessions", "ISCSI sessions on the node, by state.", []string{"state"}, nil),
+	}
+}
+
+func (c *sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.sessions
+}
+
+func (c *sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.countSessions()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to count ISCSI sessions for metrics")
+		return
+	}
+	for state, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.sessions, prometheus.GaugeValue, float64(count), state)
+	}
+}
+
+func (c *sessionCollector) countSessions() (map[string]int, error) {
+	sessionsDir := filepath.Join(c.sysfsDir, "class", "iscsi_session")
+	entries, err := ioutil.ReadDir(sessionsDir)
+	if err != nil {
+		// The class only exists once the ISCSI modules are loaded
+		if errors.Is(err, os.ErrNotExist) {
+			return map[string]int{}, nil
+		}
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, entry := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(sessionsDir, entry.Name(), "state"))
+		if err != nil {
+			log.Debug().Err(err).Str("session", entry.Name()).Msg("Failed to read ISCSI session state")
+			continue
+		}
+		counts[strings.TrimSpace(string(data))]++
+	}
+	return counts, nil
+}
@@ -0,0 +1,140 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/terrycain/qnap-csi/qnap"
+	"github.com/terrycain/qnap-csi/qnap/qnaptest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDriver_EnableMetricsController(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+	d.EnableMetrics(":0")
+
+	req := newCreateVolumeRequest("pvc-1", 10*giB)
+	req.Parameters = map[string]string{"thinAllocate": "true"}
+	if _, err := d.CreateVolume(ctx, req); err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+	// Pools StorageClasses pick are reported as well as the backend's
+	srv.AddStoragePool(2, 2*qnaptest.DefaultStoragePoolCapacity)
+	req = newCreateVolumeRequest("pvc-2", 10*giB)
+	req.Parameters = map[string]string{"storagePoolID": "2"}
+	if _, err := d.CreateVolume(ctx, req); err != nil {
+		t.Fatalf("failed to create volume: %#v", err)
+	}
+
+	if logins := testutil.ToFloat64(d.metrics.logins.WithLabelValues(DefaultBackendName, "success")); logins != 1 {
+		t.Fatalf("expected: %v, got: %v", 1, logins)
+	}
+	if count := testutil.CollectAndCount(d.metrics.lunWait); count != 1 {
+		t.Fatalf("expected: %v, got: %v", 1, count)
+	}
+	if count := testutil.CollectAndCount(d.metrics.apiDuration); count == 0 {
+		t.Fatal("expected QNAP requests to be recorded")
+	}
+
+	expected := `
+# HELP qnap_csi_storage_pool_capacity_bytes Size of the storage pool volumes are created in.
+# TYPE qnap_csi_storage_pool_capacity_bytes gauge
+qnap_csi_storage_pool_capacity_bytes{backend="default",pool_id="1"} 1.099511627776e+12
+qnap_csi_storage_pool_capacity_bytes{backend="default",pool_id="2"} 2.199023255552e+12
+# HELP qnap_csi_storage_pool_thin_provisioned_bytes Total size of the thin volumes and LUNs in the storage pool.
+# TYPE qnap_csi_storage_pool_thin_provisioned_bytes gauge
+qnap_csi_storage_pool_thin_provisioned_bytes{backend="default",pool_id="1"} 1.073741824e+10
+qnap_csi_storage_pool_thin_provisioned_bytes{backend="default",pool_id="2"} 0
+`
+	if err := testutil.GatherAndCompare(d.metrics.registry, strings.NewReader(expected), "qnap_csi_storage_pool_capacity_bytes", "qnap_csi_storage_pool_thin_provisioned_bytes"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_metricsObserveRPC(t *testing.T) {
+	m := newMetrics(":0")
+	method := "/csi.v1.Controller/CreateVolume"
+
+	m.observeRPC(method, time.Second, nil)
+	m.observeRPC(method, time.Second, status.Error(codes.NotFound, "not found"))
+
+	if count := testutil.CollectAndCount(m.rpcDuration); count != 1 {
+		t.Fatalf("expected: %v, got: %v", 1, count)
+	}
+	if errs := testutil.ToFloat64(m.rpcErrors.WithLabelValues(method, codes.NotFound.String())); errs != 1 {
+		t.Fatalf("expected: %v, got: %v", 1, errs)
+	}
+
+	// Metrics are optional, so a nil *metrics has to be usable
+	var disabled *metrics
+	disabled.observeRPC(method, time.Second, nil)
+	disabled.observeLUNWait(DefaultBackendName, time.Second)
+}
+
+func Test_apiObserver(t *testing.T) {
+	m := newMetrics(":0")
+	observer := &apiObserver{metrics: m, backend: DefaultBackendName}
+
+	observer.ObserveRequest("snapshot.cgi", "del_snapshot", http.StatusOK, time.Second, nil)
+	observer.ObserveError(&qnap.APIError{Endpoint: "snapshot.cgi", Func: "del_snapshot", StatusCode: http.StatusOK, Result: "-1", Err: qnap.ErrNotFound})
+	observer.ObserveError(&qnap.APIError{Endpoint: "authLogin.cgi", Func: "login", StatusCode: http.StatusOK, Err: qnap.ErrAuth})
+	observer.ObserveError(&qnap.APIError{Endpoint: "snapshot.cgi", Func: "del_snapshot", StatusCode: http.StatusOK, Result: "-9"})
+	observer.ObserveRequest("snapshot.cgi", "del_snapshot", 0, time.Second, errors.New("connection refused"))
+
+	tests := []struct {
+		cgi    string
+		fn     string
+		reason string
+	}{
+		{cgi: "snapshot.cgi", fn: "del_snapshot", reason: "not_found"},
+		{cgi: "authLogin.cgi", fn: "login", reason: "auth"},
+		{cgi: "snapshot.cgi", fn: "del_snapshot", reason: "unknown"},
+		{cgi: "snapshot.cgi", fn: "del_snapshot", reason: "transport"},
+	}
+	for _, table := range tests {
+		if errs := testutil.ToFloat64(m.apiErrors.WithLabelValues(DefaultBackendName, table.cgi, table.fn, table.reason)); errs != 1 {
+			t.Fatalf("%s: expected: %v, got: %v", table.reason, 1, errs)
+		}
+	}
+	if count := testutil.CollectAndCount(m.apiErrors); count != len(tests) {
+		t.Fatalf("expected: %v, got: %v", len(tests), count)
+	}
+}
+
+func Test_sessionCollector(t *testing.T) {
+	sysfsDir := t.TempDir()
+	collector := newSessionCollector(sysfsDir)
+
+	// Before the ISCSI modules are loaded there are no sessions
+	counts, err := collector.countSessions()
+	if err != nil || len(counts) != 0 {
+		t.Fatalf("expected no sessions, got %v, %v", counts, err)
+	}
+
+	for session, state := range map[string]string{"session1": "LOGGED_IN\n", "session2": "LOGGED_IN\n", "session3": "FAILED\n"} {
+		dir := filepath.Join(sysfsDir, "class", "iscsi_session", session)
+		if err = os.MkdirAll(dir, 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, "state"), []byte(state), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if counts, err = collector.countSessions(); err != nil {
+		t.Fatalf("failed to count sessions: %#v", err)
+	}
+	if counts["LOGGED_IN"] != 2 || counts["FAILED"] != 1 {
+		t.Fatalf("unexpected session counts %v", counts)
+	}
+}
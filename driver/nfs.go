@@ -0,0 +1,101 @@
+package driver
+
+import (
+	"context"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/rs/zerolog/log"
+	"github.com/terrycain/qnap-csi/qnap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+// createNFSVolume creates a shared folder limited to size and exports it over NFS to the cluster's nodes.
+func (d *Driver) createNFSVolume(ctx context.Context, req *csi.CreateVolumeRequest, b *backend, name string, size int64, params lunParameters) (*csi.CreateVolumeResponse, error) {
+	// Without this the export would be open to anything which can reach the NAS
+	networks := params.nfsNetworks
+	if networks == nil {
+		networks = b.nfsNetworks
+	}
+	if len(networks) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "NFS volumes need the networks of the cluster's nodes, set %s on the StorageClass or nfsNetworks on backend %s", paramNFSNetworks, b.name)
+	}
+	if b.nfsServer == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "Backend %s has no NFS server address", b.name)
+	}
+
+	// A previous attempt may have created the shared folder but not got as far as exporting it
+	capacity, err := b.createSharedFolder(ctx, req, name, size, params)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("name", name).Strs("networks", networks).Msg("Exporting shared folder over NFS")
+	if err = b.client.SetSharedFolderNFSAccess(ctx, name, networks, qnap.NFSSquashNone); err != nil {
+		log.Error().Err(err).Msg("Failed to set NFS access")
+		return nil, nasError(err, "Failed to set NFS access")
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      buildSharedFolderVolumeID(b.name, protocolNFS, name),
+			CapacityBytes: capacity,
+			VolumeContext: map[string]string{
+				"protocol": protocolNFS,
+				"server":   b.nfsServer,
+				"share":    "/" + name,
+			},
+			AccessibleTopology: []*csi.Topology{b.topology()},
+		},
+	}, nil
+}
+
+// stageNFSVolume mounts a volume's NFS export at its staging path, pods get bind mounts of it like iSCSI volumes.
+func (d *Driver) stageNFSVolume(req *csi.NodeStageVolumeRequest) error {
+	mountCap := req.GetVolumeCapability().GetMount()
+	if mountCap == nil {
+		return status.Error(codes.InvalidArgument, "NFS volumes can only be used as filesystems")
+	}
+
+	server, share := req.GetVolumeContext()["server"], req.GetVolumeContext()["share"]
+	if server == "" || share == "" {
+		return status.Error(codes.InvalidArgument, "NFS server and share missing from volume context")
+	}
+
+	stagingPath := req.GetStagingTargetPath()
+	notMnt, err := d.mounter.IsLikelyNotMountPoint(stagingPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Str("staging_path", stagingPath).Msg("Failed to check staging path")
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err == nil && !notMnt {
+		log.Debug().Str("staging_path", stagingPath).Msg("NFS volume already staged")
+		return nil
+	}
+	if err = os.MkdirAll(stagingPath, 0o750); err != nil {
+		log.Error().Err(err).Str("staging_path", stagingPath).Msg("Failed to create staging path")
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// Mount options, e.g. nfsvers, come from the StorageClass's mountOptions
+	source := server + ":" + share
+	log.Debug().Str("source", source).Str("staging_path", stagingPath).Strs("options", mountCap.GetMountFlags()).Msg("Mounting NFS volume")
+	if err = d.mounter.Mount(source, stagingPath, "nfs", mountCap.GetMountFlags()); err != nil {
+		log.Error().Err(err).Msg("Failed to mount NFS volume")
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
+// unstageNFSVolume unmounts a volume's NFS export from its staging path.
+func (d *Driver) unstageNFSVolume(stagingPath string) error {
+	log.Debug().Str("staging_path", stagingPath).Msg("Unmounting NFS volume")
+	if err := mount.CleanupMountPoint(stagingPath, d.mounter, false); err != nil {
+		log.Error().Err(err).Msg("Failed to unmount NFS volume")
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
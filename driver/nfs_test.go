@@ -0,0 +1,157 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/terrycain/qnap-csi/qnap/qnaptest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newNFSCreateVolumeRequest(name string, size int64) *csi.CreateVolumeRequest {
+	req := newCreateVolumeRequest(name, size)
+	req.VolumeCapabilities[0].AccessMode = &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+	req.Parameters = map[string]string{"protocol": "nfs", "nfsNetworks": "10.0.0.0/24"}
+	return req
+}
+
+func TestDriver_CreateNFSVolume(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+
+	// Retrying picks up the existing shared folder
+	var resp *csi.CreateVolumeResponse
+	var err error
+	for i := 0; i < 2; i++ {
+		if resp, err = d.CreateVolume(ctx, newNFSCreateVolumeRequest("pvc-1", 10*giB)); err != nil {
+			t.Fatalf("failed to create volume: %#v", err)
+		}
+	}
+	volumeID := resp.Volume.VolumeId
+	if volumeID != "default/nfs/csi-pvc1" {
+		t.Fatalf("expected: default/nfs/csi-pvc1, got: %s", volumeID)
+	}
+	wantContext := map[string]string{"protocol": "nfs", "server": "127.0.0.1", "share": "/csi-pvc1"}
+	if !reflect.DeepEqual(resp.Volume.VolumeContext, wantContext) {
+		t.Fatalf("expected: %v, got: %v", wantContext, resp.Volume.VolumeContext)
+	}
+
+	folders := srv.SharedFolders()
+	if len(folders) != 1 || folders[0].VolumeIndex != qnaptest.DefaultVolumeIndex || folders[0].QuotaGB != 10 || !reflect.DeepEqual(folders[0].NFSHosts, []string{"10.0.0.0/24"}) {
+		t.Fatalf("unexpected shared folders %#v", folders)
+	}
+	if len(srv.Targets()) != 0 || len(srv.LUNs()) != 0 {
+		t.Fatal("NFS volume created a target or LUN")
+	}
+
+	if _, err = d.CreateVolume(ctx, newNFSCreateVolumeRequest("pvc-1", 20*giB)); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected already exists for a different size, got %#v", err)
+	}
+
+	req := newNFSCreateVolumeRequest("pvc-2", 10*giB)
+	delete(req.Parameters, "nfsNetworks")
+	if _, err = d.CreateVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument without networks, got %#v", err)
+	}
+
+	// Any number of nodes can use the volume, attaching it doesn't involve the NAS
+	validateResp, err := d.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: volumeID, VolumeCapabilities: newNFSCreateVolumeRequest("", 0).VolumeCapabilities})
+	if err != nil || validateResp.Confirmed == nil {
+		t.Fatalf("expected multi node multi writer to be confirmed, got %v, %#v", validateResp, err)
+	}
+	for _, nodeID := range []string{"iqn.1993-08.org.debian:01:node1", "iqn.1993-08.org.debian:01:node2"} {
+		publishReq := &csi.ControllerPublishVolumeRequest{VolumeId: volumeID, NodeId: nodeID, VolumeCapability: newNFSCreateVolumeRequest("", 0).VolumeCapabilities[0]}
+		if _, err = d.ControllerPublishVolume(ctx, publishReq); err != nil {
+			t.Fatalf("failed to publish volume to %s: %#v", nodeID, err)
+		}
+	}
+
+	expandResp, err := d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: volumeID, CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB}})
+	if err != nil {
+		t.Fatalf("failed to expand volume: %#v", err)
+	}
+	if expandResp.CapacityBytes != 20*giB || expandResp.NodeExpansionRequired {
+		t.Fatalf("unexpected expand response %v", expandResp)
+	}
+	if srv.SharedFolders()[0].QuotaGB != 20 {
+		t.Fatalf("expected: 20, got: %d", srv.SharedFolders()[0].QuotaGB)
+	}
+
+	snapshotReq := &csi.CreateSnapshotRequest{SourceVolumeId: volumeID, Name: "snapshot-1"}
+	if _, err = d.CreateSnapshot(ctx, snapshotReq); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument for snapshotting an NFS volume, got %#v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Fatalf("failed to delete volume: %#v", err)
+		}
+	}
+	if len(srv.SharedFolders()) != 0 {
+		t.Fatal("shared folder was not deleted")
+	}
+}
+
+func Test_validateCapabilitiesNFS(t *testing.T) {
+	multiWriter := &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+	tests := []struct {
+		capability *csi.VolumeCapability
+		protocol   string
+		valid      bool
+	}{
+		{capability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}, AccessMode: multiWriter}, protocol: protocolNFS, valid: true},
+		{capability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}, AccessMode: supportedAccessMode}, protocol: protocolNFS, valid: true},
+		{capability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}, AccessMode: multiWriter}, protocol: protocolNFS, valid: false},
+		{capability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}, AccessMode: multiWriter}, protocol: protocolISCSI, valid: false},
+	}
+
+	for _, table := range tests {
+		violations := validateCapabilities([]*csi.VolumeCapability{table.capability}, table.protocol)
+		if valid := len(violations) == 0; valid != table.valid {
+			t.Fatalf("expected: %v, got: %v (%v)", table.valid, valid, violations)
+		}
+	}
+}
+
+func TestDriver_NodeStageNFSVolume(t *testing.T) {
+	ctx := context.Background()
+	d, mounter := newTestNodeDriver(t)
+	var err error
+
+	stagingPath := filepath.Join(t.TempDir(), "staging")
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "default/nfs/pvc1",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"nfsvers=4"}}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+		VolumeContext: map[string]string{"protocol": "nfs", "server": "10.0.0.5", "share": "/pvc1"},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = d.NodeStageVolume(ctx, req); err != nil {
+			t.Fatalf("failed to stage volume: %#v", err)
+		}
+	}
+
+	mountPoints, _ := mounter.List()
+	if len(mountPoints) != 1 || mountPoints[0].Device != "10.0.0.5:/pvc1" || mountPoints[0].Type != "nfs" || !reflect.DeepEqual(mountPoints[0].Opts, []string{"nfsvers=4"}) {
+		t.Fatalf("unexpected mounts %#v", mountPoints)
+	}
+
+	if _, err = d.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: req.VolumeId, StagingTargetPath: stagingPath}); err != nil {
+		t.Fatalf("failed to unstage volume: %#v", err)
+	}
+	if mountPoints, _ = mounter.List(); len(mountPoints) != 0 {
+		t.Fatalf("expected no mounts, got %#v", mountPoints)
+	}
+
+	req.VolumeCapability.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+	if _, err = d.NodeStageVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument for a block NFS volume, got %#v", err)
+	}
+}
@@ -2,15 +2,76 @@ package driver
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	iscsiLib "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
 )
 
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	return &csi.NodeGetInfoResponse{NodeId: d.nodeID}, nil
+	// The node ID is the initiator name so ControllerPublishVolume knows which initiator to let in. Nodes without
+	// open-iscsi can still use NFS and SMB volumes, they go by their node name and ISCSI volumes' LUNs aren't masked
+	// to them.
+	nodeID, err := readInitiatorName(d.initiatorNameFile)
+	switch {
+	case os.IsNotExist(err) || errors.Is(err, errNoInitiatorName):
+		log.Warn().Err(err).Str("node_id", d.nodeID).Msg("No ISCSI initiator name, using the node name as the node ID")
+		nodeID = d.nodeID
+	case err != nil:
+		log.Error().Err(err).Str("node_id", d.nodeID).Msg("Failed to read ISCSI initiator name")
+		return nil, status.Errorf(codes.FailedPrecondition, "Failed to read ISCSI initiator name: %v", err)
+	}
+
+	// Pods only get scheduled onto nodes which can reach the backend their volume is on
+	segments := map[string]string{}
+	for _, backendName := range d.nodeBackends {
+		segments[topologyKey(backendName)] = "true"
+	}
+
+	return &csi.NodeGetInfoResponse{
+		NodeId:             nodeID,
+		AccessibleTopology: &csi.Topology{Segments: segments},
+	}, nil
+}
+
+// hostDir is where the host's filesystem is mounted, the same as the iscsiadm shim uses.
+func hostDir() string {
+	if dir := os.Getenv("HOST_DIR"); dir != "" {
+		return dir
+	}
+	return "/host"
+}
+
+// errNoInitiatorName means an initiatorname.iscsi file has no InitiatorName line.
+var errNoInitiatorName = errors.New("no InitiatorName")
+
+// readInitiatorName reads the InitiatorName out of an open-iscsi initiatorname.iscsi file.
+func readInitiatorName(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name := strings.TrimPrefix(line, "InitiatorName="); name != line && name != "" {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w in %s", errNoInitiatorName, path)
 }
 
 func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
@@ -19,7 +80,28 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 			{
 				Type: &csi.NodeServiceCapability_Rpc{
 					Rpc: &csi.NodeServiceCapability_RPC{
-						Type: csi.NodeServiceCapability_RPC_UNKNOWN,
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 					},
 				},
 			},
@@ -28,26 +110,28 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 }
 
 func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return &csi.NodeStageVolumeResponse{}, nil
-}
-
-func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return &csi.NodeUnstageVolumeResponse{}, nil
-}
-
-func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Error(codes.InvalidArgument, "volume capability missing in request")
 	}
 	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "volumeID missing in request")
 	}
-	if req.GetTargetPath() == "" {
-		return nil, status.Error(codes.InvalidArgument, "targetPath not provided")
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "stagingTargetPath not provided")
+	}
+
+	switch volumeProtocol(req.GetVolumeId()) {
+	case protocolNFS:
+		if err := d.stageNFSVolume(req); err != nil {
+			return nil, err
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	case protocolSMB:
+		// Mounted by NodePublishVolume, which is given the credentials
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	req.GetVolumeCapability().GetMount().GetMountFlags()
-	log.Debug().Interface("req", req).Msg("Getting ISCSI info from request")
+	log.Debug().Msg("Getting ISCSI info from request")
 	iscsiInfo, err := getISCSIInfo(req)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -57,6 +141,14 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	log.Debug().Str("config_path", libConfigPath).Msg("Generated lib config path")
 	diskMounter := getISCSIDiskMounter(iscsiInfo, req)
 
+	// Written first, so if the plugin dies part way through it can still find the session to clean up when it restarts
+	info := stagingInfo{VolumeID: req.GetVolumeId(), StagingPath: req.GetStagingTargetPath(), Block: diskMounter.isBlock}
+	if err = d.persistStagingInfo(info); err != nil {
+		log.Error().Err(err).Msg("Failed to persist staging info")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Logging in, formatting and mounting happen once per node here, pods sharing the volume get bind mounts of it
 	util := &ISCSIUtil{}
 	log.Debug().Msg("Attaching disk")
 	if _, err = util.AttachDisk(*diskMounter, libConfigPath); err != nil {
@@ -64,16 +156,26 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return &csi.NodePublishVolumeResponse{}, nil
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	if len(req.GetVolumeId()) == 0 {
+func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
-	targetPath := req.GetTargetPath()
-	if len(targetPath) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path not provided")
+	}
+
+	switch volumeProtocol(req.GetVolumeId()) {
+	case protocolNFS:
+		if err := d.unstageNFSVolume(stagingPath); err != nil {
+			return nil, err
+		}
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	case protocolSMB:
+		return &csi.NodeUnstageVolumeResponse{}, nil
 	}
 
 	libConfigPath := d.getISCSILibConfigPath(req.GetVolumeId())
@@ -82,18 +184,226 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 
 	iscsiutil := &ISCSIUtil{}
 	log.Debug().Msg("Detaching disk")
-	if err := iscsiutil.DetachDisk(*diskUnmounter, targetPath, libConfigPath); err != nil {
+	if err := iscsiutil.DetachDisk(*diskUnmounter, stagingPath, libConfigPath); err != nil {
 		log.Error().Err(err).Msg("Failed to unattach disk")
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	// DetachDisk leaves the connection alone if the device is still in use, then it still needs reconciling
+	if _, err := os.Stat(libConfigPath); os.IsNotExist(err) {
+		if err = d.removeStagingInfo(req.GetVolumeId()); err != nil {
+			log.Error().Err(err).Msg("Failed to remove staging info")
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability missing in request")
+	}
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volumeID missing in request")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "stagingTargetPath not provided")
+	}
+	targetPath := req.GetTargetPath()
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "targetPath not provided")
+	}
+
+	notMnt, err := d.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Str("target_path", targetPath).Msg("Failed to check target path")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err == nil && !notMnt {
+		log.Debug().Str("target_path", targetPath).Msg("Volume already published")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if volumeProtocol(req.GetVolumeId()) == protocolSMB {
+		if err = d.publishSMBVolume(req); err != nil {
+			return nil, err
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	// Filesystems are bind mounted from the staging path, raw block volumes get the device node bind mounted onto a file
+	source := req.GetStagingTargetPath()
+	if _, isBlock := req.GetVolumeCapability().GetAccessType().(*csi.VolumeCapability_Block); isBlock {
+		if source, err = d.stagedDevicePath(req.GetVolumeId()); err != nil {
+			return nil, err
+		}
+		err = makeFile(targetPath)
+	} else {
+		err = os.MkdirAll(targetPath, 0o750)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("target_path", targetPath).Msg("Failed to create target path")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	log.Debug().Str("source", source).Str("target_path", targetPath).Strs("options", options).Msg("Bind mounting volume")
+	if err = d.mounter.Mount(source, targetPath, "", options); err != nil {
+		log.Error().Err(err).Msg("Failed to bind mount volume")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// stagedDevicePath returns the device NodeStageVolume connected a volume's LUN as. Errors returned are gRPC statuses.
+func (d *Driver) stagedDevicePath(volumeID string) (string, error) {
+	connector, err := iscsiLib.GetConnectorFromFile(d.getISCSILibConfigPath(volumeID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", status.Errorf(codes.FailedPrecondition, "volume %s is not staged on this node", volumeID)
+		}
+		log.Error().Err(err).Msg("Failed to load ISCSI connection info")
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	return connector.MountTargetDevice.GetPath(), nil
+}
+
+// makeFile creates an empty file for a block device to be bind mounted onto.
+func makeFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	targetPath := req.GetTargetPath()
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
+	}
+
+	// The ISCSI session belongs to the staging path, so this only has to undo the bind mount. The target path is a
+	// file for raw block volumes, which gets removed the same way.
+	log.Debug().Str("target_path", targetPath).Msg("Unmounting volume")
+	if err := mount.CleanupMountPoint(targetPath, d.mounter, false); err != nil {
+		log.Error().Err(err).Msg("Failed to unmount volume")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volumeID missing in request")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volumePath not provided")
+	}
+
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", volumePath)
+		}
+		log.Error().Err(err).Str("volume_path", volumePath).Msg("Failed to stat volume path")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Raw block volumes are published as the device node itself
+	isBlock := info.Mode()&os.ModeDevice != 0
+	// SMB volumes are mounted straight at the volume path, the staging path is an empty directory
+	stagingPath := req.GetStagingTargetPath()
+	if volumeProtocol(req.GetVolumeId()) == protocolSMB {
+		stagingPath = ""
+	}
+	var usage []*csi.VolumeUsage
+	if isBlock {
+		usage, err = blockDeviceUsage(volumePath)
+	} else {
+		usage, err = filesystemUsage(volumePath)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("volume_path", volumePath).Msg("Failed to get volume usage")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: d.volumeCondition(req.GetVolumeId(), stagingPath, isBlock),
+	}, nil
 }
 
 func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "not implemented")
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volumeID missing in request")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volumePath not provided")
+	}
+
+	// The NAS enforces a shared folder's size limit, there's no device or filesystem on the node to grow, nor a size
+	// to report
+	if volumeProtocol(req.GetVolumeId()) != protocolISCSI {
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+
+	libConfigPath := d.getISCSILibConfigPath(req.GetVolumeId())
+	log.Debug().Str("config_path", libConfigPath).Msg("Loading ISCSI connection info")
+	connector, err := iscsiLib.GetConnectorFromFile(libConfigPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s is not attached to this node", req.GetVolumeId())
+		}
+		log.Error().Err(err).Msg("Failed to load ISCSI connection info")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// Get the kernel to notice the LUN has grown
+	log.Debug().Msg("Rescanning ISCSI devices")
+	for i := range connector.Devices {
+		if err = connector.Devices[i].Rescan(); err != nil {
+			log.Error().Err(err).Str("device", connector.Devices[i].Name).Msg("Failed to rescan ISCSI device")
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	if connector.IsMultipathEnabled() {
+		if err = iscsiLib.ResizeMultipathDevice(connector.MountTargetDevice); err != nil {
+			log.Error().Err(err).Msg("Failed to resize multipath device")
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	devicePath := connector.MountTargetDevice.GetPath()
+	if _, isBlock := req.GetVolumeCapability().GetAccessType().(*csi.VolumeCapability_Block); !isBlock {
+		if err = resizeFilesystem(devicePath, volumePath); err != nil {
+			log.Error().Err(err).Msg("Failed to resize filesystem")
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// What the device grew to, which is what was asked for unless the rescan missed something
+	size, err := blockDeviceSize(devicePath)
+	if err != nil {
+		log.Error().Err(err).Str("device_path", devicePath).Msg("Failed to get device size")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: size,
+	}, nil
 }
@@ -0,0 +1,231 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+func newTestNodeDriver(t *testing.T) (*Driver, *mount.FakeMounter) {
+	t.Helper()
+
+	d, err := NewDriver("unix:///tmp/csi.sock", BackendsConfig{}, false, DefaultVolumePrefix, "node1", nil)
+	if err != nil {
+		t.Fatalf("failed to init driver: %#v", err)
+	}
+	mounter := mount.NewFakeMounter(nil)
+	d.mounter = mounter
+	d.configDir = t.TempDir()
+	return d, mounter
+}
+
+func Test_readInitiatorName(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "InitiatorName=iqn.1993-08.org.debian:01:node1\n", want: "iqn.1993-08.org.debian:01:node1"},
+		{input: "## DO NOT EDIT\n#InitiatorName=iqn.2004-10.com.ubuntu:01:old\nInitiatorName=iqn.2004-10.com.ubuntu:01:new\n", want: "iqn.2004-10.com.ubuntu:01:new"},
+		{input: "  InitiatorName=iqn.1994-05.com.redhat:node1  \r\n", want: "iqn.1994-05.com.redhat:node1"},
+		{input: "InitiatorName=\n", wantErr: true},
+		{input: "", wantErr: true},
+	}
+
+	dir := t.TempDir()
+	for _, table := range tests {
+		path := filepath.Join(dir, "initiatorname.iscsi")
+		if err := ioutil.WriteFile(path, []byte(table.input), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := readInitiatorName(path)
+		if (err != nil) != table.wantErr {
+			t.Fatalf("%q: expected error: %v, got: %v", table.input, table.wantErr, err)
+		}
+		if got != table.want {
+			t.Fatalf("expected: %v, got: %v", table.want, got)
+		}
+	}
+}
+
+func TestDriver_NodeGetInfo(t *testing.T) {
+	ctx := context.Background()
+	d, err := NewDriver("unix:///tmp/csi.sock", BackendsConfig{}, false, DefaultVolumePrefix, "node1", []string{"nas-a", "nas-b"})
+	if err != nil {
+		t.Fatalf("failed to init driver: %#v", err)
+	}
+	d.initiatorNameFile = filepath.Join(t.TempDir(), "initiatorname.iscsi")
+
+	// Without open-iscsi the node can still use NFS and SMB volumes
+	resp, err := d.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("failed to get node info without an initiator name: %#v", err)
+	}
+	if resp.NodeId != "node1" {
+		t.Fatalf("expected: %v, got: %v", "node1", resp.NodeId)
+	}
+
+	if err = ioutil.WriteFile(d.initiatorNameFile, []byte("InitiatorName=iqn.1993-08.org.debian:01:node1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = d.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{}); err != nil {
+		t.Fatalf("failed to get node info: %#v", err)
+	}
+	if resp.NodeId != "iqn.1993-08.org.debian:01:node1" {
+		t.Fatalf("expected: %v, got: %v", "iqn.1993-08.org.debian:01:node1", resp.NodeId)
+	}
+	if len(resp.AccessibleTopology.Segments) != 2 || resp.AccessibleTopology.Segments[topologyKey("nas-b")] != "true" {
+		t.Fatalf("unexpected topology %v", resp.AccessibleTopology)
+	}
+}
+
+func TestDriver_NodePublishVolume(t *testing.T) {
+	ctx := context.Background()
+	d, mounter := newTestNodeDriver(t)
+	var err error
+
+	dir := t.TempDir()
+	stagingPath := filepath.Join(dir, "staging")
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: supportedAccessMode,
+	}
+
+	// Two pods on the node sharing the volume each get a bind mount of the staging path
+	for i, readonly := range []bool{false, true} {
+		targetPath := filepath.Join(dir, "pod"+strconv.Itoa(i))
+		req := &csi.NodePublishVolumeRequest{VolumeId: "pvc1", StagingTargetPath: stagingPath, TargetPath: targetPath, VolumeCapability: capability, Readonly: readonly}
+		for attempt := 0; attempt < 2; attempt++ {
+			if _, err = d.NodePublishVolume(ctx, req); err != nil {
+				t.Fatalf("failed to publish volume: %#v", err)
+			}
+		}
+	}
+
+	mountPoints, _ := mounter.List()
+	if len(mountPoints) != 2 {
+		t.Fatalf("expected 2 mounts, got %#v", mountPoints)
+	}
+	for _, mountPoint := range mountPoints {
+		if mountPoint.Device != stagingPath {
+			t.Fatalf("expected: %s, got: %s", stagingPath, mountPoint.Device)
+		}
+		wantOpts := []string{"bind"}
+		if mountPoint.Path == filepath.Join(dir, "pod1") {
+			wantOpts = append(wantOpts, "ro")
+		}
+		if !reflect.DeepEqual(mountPoint.Opts, wantOpts) {
+			t.Fatalf("expected: %v, got: %v", wantOpts, mountPoint.Opts)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		targetPath := filepath.Join(dir, "pod"+strconv.Itoa(i))
+		if _, err = d.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc1", TargetPath: targetPath}); err != nil {
+			t.Fatalf("failed to unpublish volume: %#v", err)
+		}
+		if _, err = os.Stat(targetPath); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed, got %v", targetPath, err)
+		}
+	}
+	if mountPoints, _ = mounter.List(); len(mountPoints) != 0 {
+		t.Fatalf("expected no mounts, got %#v", mountPoints)
+	}
+
+	if _, err = d.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: "pvc1", TargetPath: filepath.Join(dir, "pod0"), VolumeCapability: capability}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument without a staging path, got %#v", err)
+	}
+}
+
+func TestDriver_NodePublishVolumeBlock(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestNodeDriver(t)
+
+	dir := t.TempDir()
+	targetPath := filepath.Join(dir, "pod0", "volumeDevices", "pvc1")
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "pvc1",
+		StagingTargetPath: filepath.Join(dir, "staging"),
+		TargetPath:        targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: supportedAccessMode,
+		},
+	}
+
+	// The device comes from what staging connected, without it there's nothing to bind mount
+	if _, err := d.NodePublishVolume(ctx, req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected failed precondition for an unstaged volume, got %#v", err)
+	}
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no target file, got %v", err)
+	}
+}
+
+func TestDriver_NodeExpandVolume(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestNodeDriver(t)
+
+	// The size the volume asked for isn't necessarily what it has, so nothing is reported for shared folders
+	resp, err := d.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{VolumeId: "default/nfs/csi-pvc1", VolumePath: "/pod0", CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * giB}})
+	if err != nil {
+		t.Fatalf("failed to expand volume: %#v", err)
+	}
+	if resp.CapacityBytes != 0 {
+		t.Fatalf("expected: 0, got: %d", resp.CapacityBytes)
+	}
+
+	if _, err = d.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{VolumeId: "default/csi-pvc1", VolumePath: "/pod0"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found for a volume that isn't staged, got %#v", err)
+	}
+}
+
+func Test_getISCSIInfoPortals(t *testing.T) {
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId: "pvc1",
+		VolumeContext: map[string]string{
+			"targetPortal": "10.0.1.5",
+			"iqn":          "iqn.2004-04.com.qnap:ts-453:iscsi.pvc1.abcdef",
+			"lun":          "0",
+			"portals":      `["10.0.2.5:3260","10.0.1.5:3260","10.0.3.5"]`,
+		},
+	}
+
+	diskInfo, err := getISCSIInfo(req)
+	if err != nil {
+		t.Fatalf("failed to get ISCSI info: %#v", err)
+	}
+	want := []string{"10.0.1.5:3260", "10.0.2.5:3260", "10.0.3.5:3260"}
+	if !reflect.DeepEqual(diskInfo.Portals, want) {
+		t.Fatalf("expected: %v, got: %v", want, diskInfo.Portals)
+	}
+}
+
+func Test_portalMounter(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "10.0.1.5", want: "10.0.1.5:3260"},
+		{input: "10.0.1.5:3261", want: "10.0.1.5:3261"},
+		{input: "fd00::1", want: "[fd00::1]:3260"},
+		{input: "[fd00::1]", want: "[fd00::1]:3260"},
+		{input: "[fd00::1]:3261", want: "[fd00::1]:3261"},
+	}
+
+	for _, table := range tests {
+		if got := portalMounter(table.input); got != table.want {
+			t.Fatalf("%s: expected: %s, got: %s", table.input, table.want, got)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// StorageClass parameters understood by CreateVolume.
+const (
+	paramBackend       = "backend"
+	paramStoragePoolID = "storagePoolID"
+	paramThinAllocate  = "thinAllocate"
+	paramSectorSize    = "sectorSize"
+	paramWriteCache    = "writeCache"
+	paramFUA           = "fua"
+	paramSSDCache      = "ssdCache"
+	paramTiering       = "tiering"
+	paramCHAP          = "chap"
+	paramMutualCHAP    = "mutualChap"
+	paramPortals       = "portals"
+	paramProtocol      = "protocol"
+	paramNFSNetworks   = "nfsNetworks"
+	paramNFSVolume     = "nfsVolume"
+	paramSMBVolume     = "smbVolume"
+
+	// The external-provisioner passes its own parameters through with this prefix
+	provisionerParamPrefix = "csi.storage.k8s.io/"
+)
+
+var validSectorSizes = []int{512, 4096}
+
+var (
+	iscsiOnlyParams = []string{paramStoragePoolID, paramThinAllocate, paramSectorSize, paramWriteCache, paramFUA, paramSSDCache, paramTiering, paramCHAP, paramMutualCHAP, paramPortals}
+	nfsOnlyParams   = []string{paramNFSNetworks, paramNFSVolume}
+	smbOnlyParams   = []string{paramSMBVolume}
+)
+
+// lunParameters are the options a block based LUN and its target are created with, or for NFS and SMB volumes the
+// shared folder and how it's shared.
+type lunParameters struct {
+	storagePoolID int
+	thinAllocate  bool
+	sectorSize    int
+	writeCache    bool
+	fua           bool
+	ssdCache      bool
+	tiering       bool
+	chap          bool
+	mutualCHAP    bool
+	portals       []string // nil to use the backend's
+
+	nfs         bool     // a shared folder exported over NFS rather than a LUN
+	smb         bool     // a shared folder shared over SMB rather than a LUN
+	nfsNetworks []string // nil to use the backend's
+	shareVolume int      // the QNAP volume shared folders go on, 0 for the default
+}
+
+func (p lunParameters) protocol() string {
+	switch {
+	case p.nfs:
+		return protocolNFS
+	case p.smb:
+		return protocolSMB
+	default:
+		return protocolISCSI
+	}
+}
+
+// parseLUNParameters reads the LUN options out of StorageClass parameters, anything not given keeps the defaults and
+// the backend's storage pool. Errors returned are gRPC statuses.
+func parseLUNParameters(params map[string]string, storagePoolID int) (lunParameters, error) {
+	result := lunParameters{
+		storagePoolID: storagePoolID,
+		sectorSize:    512,
+	}
+
+	protocol, err := parseProtocol(params)
+	if err != nil {
+		return lunParameters{}, err
+	}
+	result.nfs = protocol == protocolNFS
+	result.smb = protocol == protocolSMB
+
+	// Parameters which only make sense for one protocol are rejected for the others rather than silently ignored
+	wrongParams := sets.NewString()
+	if protocol != protocolISCSI {
+		wrongParams.Insert(iscsiOnlyParams...)
+	}
+	if protocol != protocolNFS {
+		wrongParams.Insert(nfsOnlyParams...)
+	}
+	if protocol != protocolSMB {
+		wrongParams.Insert(smbOnlyParams...)
+	}
+
+	// Sorted so that the error for a StorageClass with several problems is always the same
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := params[key]
+		if strings.HasPrefix(key, provisionerParamPrefix) {
+			continue
+		}
+		if wrongParams.Has(key) {
+			return lunParameters{}, status.Errorf(codes.InvalidArgument, "StorageClass parameter %s does not apply to %s volumes", key, protocol)
+		}
+
+		switch key {
+		case paramBackend, paramProtocol:
+			// Used to pick the backend, see selectBackend, and already parsed
+		case paramStoragePoolID:
+			if result.storagePoolID, err = strconv.Atoi(value); err == nil && result.storagePoolID < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case paramThinAllocate:
+			result.thinAllocate, err = strconv.ParseBool(value)
+		case paramSectorSize:
+			if result.sectorSize, err = strconv.Atoi(value); err == nil && !isValidSectorSize(result.sectorSize) {
+				err = fmt.Errorf("must be one of %v", validSectorSizes)
+			}
+		case paramWriteCache:
+			result.writeCache, err = strconv.ParseBool(value)
+		case paramFUA:
+			result.fua, err = strconv.ParseBool(value)
+		case paramSSDCache:
+			result.ssdCache, err = strconv.ParseBool(value)
+		case paramTiering:
+			result.tiering, err = strconv.ParseBool(value)
+		case paramCHAP:
+			result.chap, err = strconv.ParseBool(value)
+		case paramMutualCHAP:
+			result.mutualCHAP, err = strconv.ParseBool(value)
+		case paramPortals:
+			result.portals, err = parsePortals(value)
+		case paramNFSNetworks:
+			result.nfsNetworks, err = parseNFSNetworks(value)
+		case paramNFSVolume, paramSMBVolume:
+			if result.shareVolume, err = strconv.Atoi(value); err == nil && result.shareVolume < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		default:
+			// Could be meant for a newer version of the driver, so not worth failing the volume over
+			log.Warn().Str("parameter", key).Msg("Ignoring unknown StorageClass parameter")
+		}
+
+		if err != nil {
+			return lunParameters{}, status.Errorf(codes.InvalidArgument, "Invalid StorageClass parameter %s=%q: %v", key, value, err)
+		}
+	}
+
+	// Mutual CHAP is on top of normal CHAP, the target can't authenticate itself to an initiator that didn't log in
+	if result.mutualCHAP {
+		result.chap = true
+	}
+
+	return result, nil
+}
+
+// parseProtocol returns the protocol StorageClass parameters ask for, iSCSI if they don't. Errors returned are gRPC
+// statuses.
+func parseProtocol(params map[string]string) (string, error) {
+	switch value, ok := params[paramProtocol]; {
+	case !ok:
+		return protocolISCSI, nil
+	case value == protocolISCSI, value == protocolNFS, value == protocolSMB:
+		return value, nil
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "Invalid StorageClass parameter %s=%q: must be %s, %s or %s", paramProtocol, value, protocolISCSI, protocolNFS, protocolSMB)
+	}
+}
+
+// parsePortals parses a comma separated list of extra iSCSI portals, an empty list means the volume doesn't use
+// multipath.
+func parsePortals(value string) ([]string, error) {
+	portals := make([]string, 0)
+	for _, portal := range strings.Split(value, ",") {
+		if portal = strings.TrimSpace(portal); portal == "" {
+			continue
+		}
+		if err := validatePortal(portal); err != nil {
+			return nil, err
+		}
+		portals = append(portals, portal)
+	}
+	return portals, nil
+}
+
+// validatePortal checks a portal is an IP, optionally with a port.
+func validatePortal(portal string) error {
+	if net.ParseIP(portal) != nil {
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(portal)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("portal %s is not an IP", portal)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port in portal %s", portal)
+	}
+	return nil
+}
+
+// parseNFSNetworks parses a comma separated list of the IPs and CIDR networks NFS volumes are exported to.
+func parseNFSNetworks(value string) ([]string, error) {
+	networks := make([]string, 0)
+	for _, network := range strings.Split(value, ",") {
+		if network = strings.TrimSpace(network); network == "" {
+			continue
+		}
+		if err := validateNFSNetwork(network); err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// validateNFSNetwork checks an NFS client is an IP or a CIDR network.
+func validateNFSNetwork(network string) error {
+	if net.ParseIP(network) != nil {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(network); err != nil {
+		return fmt.Errorf("%s is not an IP or CIDR network", network)
+	}
+	return nil
+}
+
+func isValidSectorSize(size int) bool {
+	for _, valid := range validSectorSizes {
+		if size == valid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_parseLUNParameters(t *testing.T) {
+	tests := []struct {
+		input   map[string]string
+		want    lunParameters
+		wantErr bool
+	}{
+		{input: nil, want: lunParameters{storagePoolID: 1, sectorSize: 512}},
+		{
+			input: map[string]string{"storagePoolID": "2", "thinAllocate": "true", "sectorSize": "4096", "writeCache": "true", "fua": "true", "ssdCache": "true", "tiering": "true"},
+			want:  lunParameters{storagePoolID: 2, thinAllocate: true, sectorSize: 4096, writeCache: true, fua: true, ssdCache: true, tiering: true},
+		},
+		{input: map[string]string{"csi.storage.k8s.io/pvc/name": "test", "backend": "nas1"}, want: lunParameters{storagePoolID: 1, sectorSize: 512}},
+		{input: map[string]string{"chap": "true"}, want: lunParameters{storagePoolID: 1, sectorSize: 512, chap: true}},
+		{input: map[string]string{"mutualChap": "true"}, want: lunParameters{storagePoolID: 1, sectorSize: 512, chap: true, mutualCHAP: true}},
+		{input: map[string]string{"portals": "10.0.1.5:3260, 10.0.2.5"}, want: lunParameters{storagePoolID: 1, sectorSize: 512, portals: []string{"10.0.1.5:3260", "10.0.2.5"}}},
+		{input: map[string]string{"portals": ""}, want: lunParameters{storagePoolID: 1, sectorSize: 512, portals: []string{}}},
+		{input: map[string]string{"portals": "nas-a:3260"}, wantErr: true},
+		{input: map[string]string{"portals": "10.0.1.5:99999"}, wantErr: true},
+		{input: map[string]string{"storagePoolID": "0"}, wantErr: true},
+		{input: map[string]string{"storagePoolID": "one"}, wantErr: true},
+		{input: map[string]string{"sectorSize": "1024"}, wantErr: true},
+		{input: map[string]string{"thinAllocate": "maybe"}, wantErr: true},
+		{input: map[string]string{"thin": "true", "csi.storage.k8s.io/fstype": "xfs"}, want: lunParameters{storagePoolID: 1, sectorSize: 512}},
+		{input: map[string]string{"protocol": "iscsi"}, want: lunParameters{storagePoolID: 1, sectorSize: 512}},
+		{
+			input: map[string]string{"protocol": "nfs", "nfsNetworks": "10.0.0.0/24, 10.0.1.5", "nfsVolume": "2"},
+			want:  lunParameters{storagePoolID: 1, sectorSize: 512, nfs: true, nfsNetworks: []string{"10.0.0.0/24", "10.0.1.5"}, shareVolume: 2},
+		},
+		{input: map[string]string{"protocol": "cifs"}, wantErr: true},
+		{input: map[string]string{"protocol": "nfs", "nfsNetworks": "nodes.local"}, wantErr: true},
+		{input: map[string]string{"protocol": "nfs", "nfsVolume": "0"}, wantErr: true},
+		{input: map[string]string{"protocol": "nfs", "thinAllocate": "true"}, wantErr: true},
+		{input: map[string]string{"nfsNetworks": "10.0.0.0/24"}, wantErr: true},
+		{input: map[string]string{"protocol": "smb", "smbVolume": "2"}, want: lunParameters{storagePoolID: 1, sectorSize: 512, smb: true, shareVolume: 2}},
+		{input: map[string]string{"protocol": "smb", "nfsNetworks": "10.0.0.0/24"}, wantErr: true},
+		{input: map[string]string{"protocol": "nfs", "smbVolume": "2"}, wantErr: true},
+	}
+
+	for _, table := range tests {
+		got, err := parseLUNParameters(table.input, 1)
+		if table.wantErr {
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("expected invalid argument for %v, got %v", table.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %v", table.input, err)
+		}
+		if !reflect.DeepEqual(table.want, got) {
+			t.Fatalf("expected: %+v, got: %+v", table.want, got)
+		}
+	}
+}
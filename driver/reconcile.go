@@ -0,0 +1,280 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	iscsiLib "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	connectorFileExt   = ".json"
+	stagingInfoFileExt = ".stage"
+)
+
+// stagingInfo is persisted next to a volume's connector file by NodeStageVolume, so that when the node plugin
+// restarts it knows where the volume was staged.
+type stagingInfo struct {
+	VolumeID    string `json:"volume_id"`
+	StagingPath string `json:"staging_path"`
+	Block       bool   `json:"block"`
+}
+
+// stagedVolume is what the node plugin finds in configDir for a volume.
+type stagedVolume struct {
+	// info is nil for connector files written before staging info was
+	info          *stagingInfo
+	connectorPath string
+	infoPath      string
+}
+
+func (d *Driver) getStagingInfoPath(id string) string {
+	return strings.TrimSuffix(d.getISCSILibConfigPath(id), connectorFileExt) + stagingInfoFileExt
+}
+
+func (d *Driver) persistStagingInfo(info stagingInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.getStagingInfoPath(info.VolumeID), data, 0o600)
+}
+
+func (d *Driver) removeStagingInfo(id string) error {
+	if err := os.Remove(d.getStagingInfoPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadStagedVolumes finds every volume with a connector or staging info file in configDir.
+func (d *Driver) loadStagedVolumes() ([]stagedVolume, error) {
+	entries, err := ioutil.ReadDir(d.configDir)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := map[string]*stagedVolume{}
+	var names []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != connectorFileExt && ext != stagingInfoFileExt) {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), ext)
+		volume, ok := volumes[name]
+		if !ok {
+			volume = &stagedVolume{
+				connectorPath: filepath.Join(d.configDir, name+connectorFileExt),
+				infoPath:      filepath.Join(d.configDir, name+stagingInfoFileExt),
+			}
+			volumes[name] = volume
+			names = append(names, name)
+		}
+
+		if ext == stagingInfoFileExt {
+			data, err := ioutil.ReadFile(volume.infoPath)
+			if err != nil {
+				return nil, err
+			}
+			volume.info = &stagingInfo{}
+			if err = json.Unmarshal(data, volume.info); err != nil {
+				log.Warn().Err(err).Str("path", volume.infoPath).Msg("Ignoring unreadable staging info")
+				volume.info = nil
+			}
+		}
+	}
+
+	// ReadDir sorts by name, so this keeps the order stable
+	result := make([]stagedVolume, 0, len(names))
+	for _, name := range names {
+		result = append(result, *volumes[name])
+	}
+	return result, nil
+}
+
+// isStagedVolumeInUse says if a volume is still staged. Filesystems are mounted at their staging path, raw block
+// volumes only have the staging path kubelet made, so they're in use while their device is bind mounted into a pod.
+func (d *Driver) isStagedVolumeInUse(volume stagedVolume) (bool, error) {
+	if _, err := os.Stat(volume.info.StagingPath); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if volume.info.Block {
+		connector, err := readConnector(volume.connectorPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		return d.isDeviceMounted(connector.MountTargetDevice)
+	}
+
+	notMnt, err := d.mounter.IsLikelyNotMountPoint(volume.info.StagingPath)
+	if err != nil {
+		return false, err
+	}
+	return !notMnt, nil
+}
+
+// reconcileStagedVolumes runs when the node plugin starts. Volumes which are still staged get their ISCSI sessions
+// logged back in, in case they dropped whilst the plugin was down. Anything else, e.g. after the node rebooted, is
+// logged out and forgotten, kubelet stages volumes pods still need again.
+func (d *Driver) reconcileStagedVolumes() {
+	volumes, err := d.loadStagedVolumes()
+	if err != nil {
+		log.Error().Err(err).Str("config_dir", d.configDir).Msg("Failed to load staged volumes")
+		return
+	}
+
+	for _, volume := range volumes {
+		if volume.info == nil {
+			d.reconcileUnstagedConnection(volume)
+			continue
+		}
+		logger := log.With().Str("volume_id", volume.info.VolumeID).Str("staging_path", volume.info.StagingPath).Logger()
+
+		inUse, err := d.isStagedVolumeInUse(volume)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to check staged volume")
+			continue
+		}
+
+		if inUse {
+			logger.Info().Msg("Reconnecting staged volume")
+			if err = reconnectVolume(volume.connectorPath); err != nil {
+				logger.Error().Err(err).Msg("Failed to reconnect staged volume")
+			}
+			continue
+		}
+
+		logger.Info().Msg("Cleaning up volume that is no longer staged")
+		if err = cleanupVolume(volume); err != nil {
+			logger.Error().Err(err).Msg("Failed to clean up volume")
+		}
+	}
+}
+
+// reconcileUnstagedConnection handles a connector file written before staging info was, so there's no staging path to
+// check. The connection is only kept if something still has its device mounted.
+func (d *Driver) reconcileUnstagedConnection(volume stagedVolume) {
+	logger := log.With().Str("path", volume.connectorPath).Logger()
+
+	connector, err := readConnector(volume.connectorPath)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to read ISCSI connection")
+		return
+	}
+
+	inUse, err := d.isDeviceMounted(connector.MountTargetDevice)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to check ISCSI connection")
+		return
+	}
+	if inUse {
+		logger.Info().Msg("ISCSI connection has no staging info but its device is mounted, leaving it alone")
+		return
+	}
+
+	logger.Info().Msg("Cleaning up ISCSI connection that has no staging info and isn't mounted")
+	if err = cleanupVolume(volume); err != nil {
+		logger.Error().Err(err).Msg("Failed to clean up ISCSI connection")
+	}
+}
+
+// isDeviceMounted says if any mount refers to device, which is gone after a reboot.
+func (d *Driver) isDeviceMounted(device *iscsiLib.Device) (bool, error) {
+	if device == nil || device.Name == "" {
+		return false, nil
+	}
+
+	path := device.GetPath()
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		return false, err
+	}
+	for _, mountPoint := range mountPoints {
+		mountDevice := mountPoint.Device
+		if resolved, err := filepath.EvalSymlinks(mountDevice); err == nil {
+			mountDevice = resolved
+		}
+		if mountDevice == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readConnector reads a connector file without looking up its devices, which GetConnectorFromFile does and fails at
+// if they've gone.
+func readConnector(path string) (*iscsiLib.Connector, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	connector := &iscsiLib.Connector{}
+	if err = json.Unmarshal(data, connector); err != nil {
+		return nil, err
+	}
+	return connector, nil
+}
+
+func reconnectVolume(connectorPath string) error {
+	connector, err := readConnector(connectorPath)
+	if err != nil {
+		return err
+	}
+
+	// Connect only logs in where there's no session, the devices may have new names afterwards
+	if _, err = connector.Connect(); err != nil {
+		return err
+	}
+	return iscsiLib.PersistConnector(connector, connectorPath)
+}
+
+func cleanupVolume(volume stagedVolume) error {
+	connector, err := readConnector(volume.connectorPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if connector != nil {
+		// The devices are only still there if the node didn't reboot
+		if withDevices, err := iscsiLib.GetConnectorFromFile(volume.connectorPath); err == nil {
+			if err = withDevices.DisconnectVolume(); err != nil {
+				return err
+			}
+		}
+		logoutPortals(connector.TargetIqn, connector.TargetPortals)
+	}
+
+	var errs []string
+	for _, path := range []string{volume.connectorPath, volume.infoPath} {
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	iscsiLib "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+)
+
+func TestDriver_loadStagedVolumes(t *testing.T) {
+	d, _ := newTestNodeDriver(t)
+
+	if err := d.persistStagingInfo(stagingInfo{VolumeID: "nas-a/pvc1", StagingPath: "/staging/pvc1"}); err != nil {
+		t.Fatalf("failed to persist staging info: %#v", err)
+	}
+	for _, name := range []string{"nas-a_pvc1.json", "pvc2.json", "unrelated.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(d.configDir, name), []byte("{}"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	volumes, err := d.loadStagedVolumes()
+	if err != nil {
+		t.Fatalf("failed to load staged volumes: %#v", err)
+	}
+	if len(volumes) != 2 {
+		t.Fatalf("expected 2 volumes, got %#v", volumes)
+	}
+	if volumes[0].info == nil || volumes[0].info.VolumeID != "nas-a/pvc1" || volumes[0].connectorPath != d.getISCSILibConfigPath("nas-a/pvc1") {
+		t.Fatalf("unexpected volume %#v", volumes[0])
+	}
+	// Connections from before staging info was written have none
+	if volumes[1].info != nil {
+		t.Fatalf("expected no staging info, got %#v", volumes[1].info)
+	}
+}
+
+func TestDriver_isStagedVolumeInUse(t *testing.T) {
+	d, mounter := newTestNodeDriver(t)
+
+	dir := t.TempDir()
+	mounted := filepath.Join(dir, "mounted")
+	unmounted := filepath.Join(dir, "unmounted")
+	for _, path := range []string{mounted, unmounted} {
+		if err := os.MkdirAll(path, 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mounter.Mount("/dev/sdb", mounted, "ext4", nil); err != nil {
+		t.Fatal(err)
+	}
+	// Raw block volumes are bind mounted onto a file in the pod, /dev/null and /dev/zero stand in for devices which
+	// are still there
+	if err := mounter.Mount("/dev/null", filepath.Join(dir, "pod0"), "", []string{"bind"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		info   stagingInfo
+		device string
+		want   bool
+	}{
+		{info: stagingInfo{StagingPath: mounted}, want: true},
+		{info: stagingInfo{StagingPath: unmounted}, want: false},
+		{info: stagingInfo{StagingPath: filepath.Join(dir, "missing")}, want: false},
+		{info: stagingInfo{StagingPath: unmounted, Block: true}, device: "null", want: true},
+		// A stale staging path left behind once no pod has the device
+		{info: stagingInfo{StagingPath: unmounted, Block: true}, device: "zero", want: false},
+		{info: stagingInfo{StagingPath: unmounted, Block: true}, want: false},
+		{info: stagingInfo{StagingPath: filepath.Join(dir, "missing"), Block: true}, device: "null", want: false},
+	}
+
+	for i, table := range tests {
+		info := table.info
+		volume := stagedVolume{info: &info, connectorPath: filepath.Join(dir, strconv.Itoa(i)+connectorFileExt)}
+		if table.device != "" {
+			data, err := json.Marshal(iscsiLib.Connector{MountTargetDevice: &iscsiLib.Device{Name: table.device, Type: "disk"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(volume.connectorPath, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := d.isStagedVolumeInUse(volume)
+		if err != nil {
+			t.Fatalf("failed to check %+v: %#v", table.info, err)
+		}
+		if got != table.want {
+			t.Fatalf("%+v %s: expected: %v, got: %v", table.info, table.device, table.want, got)
+		}
+	}
+}
+
+func TestDriver_reconcileStagedVolumes(t *testing.T) {
+	d, _ := newTestNodeDriver(t)
+
+	// The plugin died before connecting, and the staging path has since gone
+	if err := d.persistStagingInfo(stagingInfo{VolumeID: "pvc1", StagingPath: filepath.Join(t.TempDir(), "missing")}); err != nil {
+		t.Fatalf("failed to persist staging info: %#v", err)
+	}
+
+	d.reconcileStagedVolumes()
+
+	if _, err := os.Stat(d.getStagingInfoPath("pvc1")); !os.IsNotExist(err) {
+		t.Fatalf("expected staging info to be removed, got %v", err)
+	}
+}
+
+func TestDriver_reconcileUnstagedConnection(t *testing.T) {
+	d, mounter := newTestNodeDriver(t)
+
+	// Connections staged before staging info was written only have a connector file. /dev/null stands in for a device
+	// which is still there.
+	if err := mounter.Mount("/dev/null", t.TempDir(), "ext4", nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id     string
+		device string
+		kept   bool
+	}{
+		{id: "pvc1", device: "null", kept: true},
+		{id: "pvc2", device: "sdqnaptestmissing", kept: false},
+		{id: "pvc3", device: "", kept: false},
+	}
+
+	for _, table := range tests {
+		connector := iscsiLib.Connector{VolumeName: table.id, TargetIqn: "iqn.2004-04.com.qnap:test:" + table.id}
+		if table.device != "" {
+			connector.MountTargetDevice = &iscsiLib.Device{Name: table.device, Type: "disk"}
+		}
+		data, err := json.Marshal(connector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(d.getISCSILibConfigPath(table.id), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.reconcileStagedVolumes()
+
+	for _, table := range tests {
+		_, err := os.Stat(d.getISCSILibConfigPath(table.id))
+		if kept := err == nil; kept != table.kept {
+			t.Fatalf("%s: expected kept: %v, got: %v (%v)", table.id, table.kept, kept, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package driver
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/utils/exec"
+	"k8s.io/utils/mount"
+)
+
+// resizeFilesystem grows the filesystem on devicePath (mounted at mountPath) to fill the device.
+func resizeFilesystem(devicePath, mountPath string) error {
+	mounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()}
+
+	format, err := mounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to get filesystem type of %s: %w", devicePath, err)
+	}
+
+	log.Debug().Str("device_path", devicePath).Str("format", format).Msg("Resizing filesystem")
+
+	var output []byte
+	switch format {
+	case "ext2", "ext3", "ext4":
+		// resize2fs can grow mounted ext filesystems given the device
+		output, err = mounter.Exec.Command("resize2fs", devicePath).CombinedOutput()
+	case "xfs":
+		// xfs_growfs operates on the mountpoint, not the device
+		output, err = mounter.Exec.Command("xfs_growfs", "-d", mountPath).CombinedOutput()
+	case "":
+		return fmt.Errorf("device %s is not formatted", devicePath)
+	default:
+		return fmt.Errorf("resizing %s filesystems is not supported", format)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to resize %s filesystem on %s: %w, output: %s", format, devicePath, err, string(output))
+	}
+
+	return nil
+}
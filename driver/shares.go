@@ -0,0 +1,192 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/rs/zerolog/log"
+	"github.com/terrycain/qnap-csi/qnap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	protocolISCSI = "iscsi"
+	protocolNFS   = "nfs"
+	protocolSMB   = "smb"
+
+	// defaultShareVolume is the QNAP volume shared folders are created on unless the StorageClass says otherwise.
+	defaultShareVolume = 1
+)
+
+// sharedFolderProtocols are the protocols whose volumes are shared folders rather than LUNs.
+var sharedFolderProtocols = []string{protocolNFS, protocolSMB}
+
+// sharedFolderAccessModes are the access modes NFS and SMB volumes support, any number of nodes can mount a shared
+// folder.
+var sharedFolderAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:    true,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:  true,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:   true,
+}
+
+// buildSharedFolderVolumeID makes the ID of an NFS or SMB volume, <backend>/<protocol>/<shared folder>. Target names
+// never contain a "/" so they can't be confused with ISCSI volumes.
+func buildSharedFolderVolumeID(backendName, protocol, share string) string {
+	return buildVolumeID(backendName, protocol+volumeIDSeparator+share)
+}
+
+// sharedFolderVolume returns the protocol and shared folder of an NFS or SMB volume, name being what backendForVolume
+// returns, and false for ISCSI volumes.
+func sharedFolderVolume(name string) (string, string, bool) {
+	for _, protocol := range sharedFolderProtocols {
+		if prefix := protocol + volumeIDSeparator; strings.HasPrefix(name, prefix) {
+			return protocol, strings.TrimPrefix(name, prefix), true
+		}
+	}
+	return "", "", false
+}
+
+// nasVolumeName is the name of the target or shared folder behind a volume, name being what backendForVolume returns.
+func nasVolumeName(name string) string {
+	if _, share, ok := sharedFolderVolume(name); ok {
+		return share
+	}
+	return name
+}
+
+// volumeProtocol is the protocol of the volume with the given ID.
+func volumeProtocol(volumeID string) string {
+	_, name := parseVolumeID(volumeID)
+	if protocol, _, ok := sharedFolderVolume(name); ok {
+		return protocol
+	}
+	return protocolISCSI
+}
+
+// getSharedFolderByName returns the shared folder with the given name, or nil if it does not exist.
+func (b *backend) getSharedFolderByName(ctx context.Context, name string) (*qnap.SharedFolderInfoXML, error) {
+	folderList, err := b.client.GetSharedFolderList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range folderList.SharedFolders {
+		if folderList.SharedFolders[i].Name == name {
+			return &folderList.SharedFolders[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// createSharedFolder creates a shared folder limited to size for a new NFS or SMB volume, returning its capacity. One
+// left by a previous attempt is reused if its size is compatible.
+func (b *backend) createSharedFolder(ctx context.Context, req *csi.CreateVolumeRequest, name string, size int64, params lunParameters) (int64, error) {
+	if req.GetVolumeContentSource() != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "%s volumes can't be created from a snapshot or another volume", strings.ToUpper(params.protocol()))
+	}
+
+	volumeIndex := params.shareVolume
+	if volumeIndex == 0 {
+		volumeIndex = defaultShareVolume
+	}
+
+	folder, err := b.getSharedFolderByName(ctx, name)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of shared folders")
+		return 0, nasError(err, "Failed to get list of shared folders")
+	}
+
+	if folder != nil {
+		capacity := int64(folder.QuotaBytes)
+		limit := req.GetCapacityRange().GetLimitBytes()
+		if capacity < size || (limit > 0 && capacity > limit) {
+			return 0, status.Errorf(codes.AlreadyExists, "Volume already exists with a different size of %s", formatBytes(capacity))
+		}
+		log.Info().Str("name", name).Msg("Shared folder already exists")
+		return capacity, nil
+	}
+
+	log.Debug().Str("name", name).Int("volume", volumeIndex).Msg("Creating shared folder")
+	if err = b.client.CreateSharedFolder(ctx, name, volumeIndex, int(size/giB)); err != nil {
+		log.Error().Err(err).Msg("Failed to create shared folder")
+		return 0, nasError(err, "Failed to create shared folder")
+	}
+	return size, nil
+}
+
+// validateSharedFolderCapabilities confirms the capabilities asked for if an NFS or SMB volume supports them all.
+func (b *backend) validateSharedFolderCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest, protocol, share string) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	folder, err := b.getSharedFolderByName(ctx, share)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of shared folders")
+		return nil, nasError(err, "Failed to get list of shared folders")
+	}
+	if folder == nil {
+		return nil, status.Errorf(codes.NotFound, "ValidateVolumeCapabilities Volume ID %s not found", req.VolumeId)
+	}
+
+	if violations := validateCapabilities(req.VolumeCapabilities, protocol); len(violations) > 0 {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: strings.Join(violations, "; ")}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// deleteSharedFolder removes a shared folder and everything in it.
+func (b *backend) deleteSharedFolder(ctx context.Context, share string) error {
+	if err := b.client.DeleteSharedFolder(ctx, share); err != nil && !errors.Is(err, qnap.ErrNotFound) {
+		log.Error().Err(err).Msg("Failed to delete shared folder")
+		return nasError(err, "Failed to delete shared folder")
+	}
+	return nil
+}
+
+// deleteSharedFolderVolume deletes an NFS or SMB volume, along with an SMB volume's user and Secret.
+func (d *Driver) deleteSharedFolderVolume(ctx context.Context, b *backend, protocol, share string) error {
+	if protocol == protocolSMB {
+		return d.deleteSMBVolume(ctx, b, share)
+	}
+	return b.deleteSharedFolder(ctx, share)
+}
+
+// expandSharedFolder raises a shared folder's size limit, nodes see the new size straight away so there's nothing for
+// them to do.
+func (b *backend) expandSharedFolder(ctx context.Context, volumeID, share string, size, limit int64) (*csi.ControllerExpandVolumeResponse, error) {
+	folder, err := b.getSharedFolderByName(ctx, share)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get list of shared folders")
+		return nil, nasError(err, "Failed to get list of shared folders")
+	}
+	if folder == nil {
+		return nil, status.Errorf(codes.NotFound, "ControllerExpandVolume Volume ID %s not found", volumeID)
+	}
+
+	currentSize := int64(folder.QuotaBytes)
+	if err = checkShrink(volumeID, currentSize, limit); err != nil {
+		return nil, err
+	}
+	if currentSize >= size {
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: currentSize}, nil
+	}
+
+	log.Debug().Str("name", share).Int64("size_gib", size/giB).Msg("Raising shared folder size limit")
+	if err = b.client.SetSharedFolderQuota(ctx, share, int(size/giB)); err != nil {
+		log.Error().Err(err).Msg("Failed to set shared folder size limit")
+		return nil, nasError(err, "Failed to set shared folder size limit")
+	}
+
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: size}, nil
+}
@@ -0,0 +1,203 @@
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/rs/zerolog/log"
+	"github.com/terrycain/qnap-csi/qnap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// SMBSecretPrefix goes before the PV name to make the name of a volume's SMB credentials Secret, StorageClasses
+	// point nodes at it with csi.storage.k8s.io/node-publish-secret-name: qnap-smb-${pv.name}
+	SMBSecretPrefix = "qnap-smb-"
+
+	// Secret keys, the same names other SMB CSI drivers use
+	smbUsernameKey = "username"
+	smbPasswordKey = "password"
+
+	smbPasswordLength = 32
+
+	// smbUsernameMinHashLength is how much of a username is left for the hash however long the volume name tag is
+	smbUsernameMinHashLength = 16
+)
+
+// smbCredentials are the NAS user a volume's shared folder is mounted as.
+type smbCredentials struct {
+	username string
+	password string
+}
+
+func (c *smbCredentials) secretData() map[string][]byte {
+	return map[string][]byte{
+		smbUsernameKey: []byte(c.username),
+		smbPasswordKey: []byte(c.password),
+	}
+}
+
+// EnableSMB lets StorageClasses ask for SMB volumes, the credentials of each volume's user are kept in Secrets in
+// namespace.
+func (d *Driver) EnableSMB(kubeClient kubernetes.Interface, namespace string) {
+	d.smbSecrets = &credentialStore{
+		client:       kubeClient,
+		namespace:    namespace,
+		kind:         "SMB",
+		owner:        "share",
+		requiredKeys: []string{smbUsernameKey, smbPasswordKey},
+	}
+}
+
+// smbUsername is the NAS user a volume's shared folder is shared with. Volume names are too long for a username and
+// only differ at the end, so the username is the volume name tag followed by as much of a hash of the name as fits.
+func (d *Driver) smbUsername(share string) string {
+	tag := d.volumeNameTag() + volumeNameSeparator
+	if len(tag) > qnap.MaxUsernameLength-smbUsernameMinHashLength {
+		tag = tag[:qnap.MaxUsernameLength-smbUsernameMinHashLength]
+	}
+	sum := sha256.Sum256([]byte(share))
+	return tag + hex.EncodeToString(sum[:])[:qnap.MaxUsernameLength-len(tag)]
+}
+
+// createSMBVolume creates a shared folder limited to size, and a NAS user with read-write access to it whose
+// credentials are stored in a Secret for nodes to mount it with.
+func (d *Driver) createSMBVolume(ctx context.Context, req *csi.CreateVolumeRequest, b *backend, name string, size int64, params lunParameters) (*csi.CreateVolumeResponse, error) {
+	if d.smbSecrets == nil {
+		return nil, status.Error(codes.FailedPrecondition, "SMB was requested but the controller has no namespace to store SMB secrets in")
+	}
+	if b.smbServer == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "Backend %s has no SMB server address", b.name)
+	}
+
+	capacity, err := b.createSharedFolder(ctx, req, name, size, params)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, stored, err := d.getOrCreateSMBCredentials(ctx, req.Name, b, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Secret is created first, so a user left by a previous attempt already has its password. One that's there
+	// before the Secret isn't this volume's, and mustn't be given access to it.
+	log.Debug().Str("user", credentials.username).Msg("Creating SMB user")
+	if err = b.client.CreateUser(ctx, credentials.username, credentials.password); err != nil {
+		if !errors.Is(err, qnap.ErrAlreadyExists) {
+			log.Error().Err(err).Msg("Failed to create SMB user")
+			return nil, nasError(err, "Failed to create SMB user")
+		}
+		if !stored {
+			log.Error().Str("user", credentials.username).Msg("SMB user already exists")
+			// Logged by delete, the user existing is the error that matters
+			_ = d.smbSecrets.delete(ctx, b.name, name)
+			return nil, status.Errorf(codes.AlreadyExists, "SMB user %s already exists on backend %s", credentials.username, b.name)
+		}
+	}
+
+	log.Debug().Str("name", name).Str("user", credentials.username).Msg("Giving SMB user access to shared folder")
+	if err = b.client.SetSharedFolderUserAccess(ctx, name, credentials.username, qnap.SharedFolderAccessReadWrite); err != nil {
+		log.Error().Err(err).Msg("Failed to set shared folder access")
+		return nil, nasError(err, "Failed to set shared folder access")
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      buildSharedFolderVolumeID(b.name, protocolSMB, name),
+			CapacityBytes: capacity,
+			VolumeContext: map[string]string{
+				"protocol": protocolSMB,
+				"server":   b.smbServer,
+				"share":    name,
+			},
+			AccessibleTopology: []*csi.Topology{b.topology()},
+		},
+	}, nil
+}
+
+// getOrCreateSMBCredentials returns the credentials of a new volume's user, stored says they were there already.
+func (d *Driver) getOrCreateSMBCredentials(ctx context.Context, volumeName string, b *backend, share string) (*smbCredentials, bool, error) {
+	data, stored, err := d.smbSecrets.getOrCreate(ctx, SMBSecretPrefix+volumeName, b.name, share, func() (map[string][]byte, error) {
+		password, err := randomPassword(smbPasswordLength)
+		if err != nil {
+			return nil, err
+		}
+		credentials := &smbCredentials{username: d.smbUsername(share), password: password}
+		return credentials.secretData(), nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return &smbCredentials{username: string(data[smbUsernameKey]), password: string(data[smbPasswordKey])}, stored, nil
+}
+
+// deleteSMBVolume removes a volume's shared folder, its user and the Secret with its credentials.
+func (d *Driver) deleteSMBVolume(ctx context.Context, b *backend, share string) error {
+	if err := b.deleteSharedFolder(ctx, share); err != nil {
+		return err
+	}
+
+	if err := b.client.DeleteUser(ctx, d.smbUsername(share)); err != nil && !errors.Is(err, qnap.ErrNotFound) {
+		log.Error().Err(err).Msg("Failed to delete SMB user")
+		return nasError(err, "Failed to delete SMB user")
+	}
+
+	if d.smbSecrets == nil {
+		return nil
+	}
+	return d.smbSecrets.delete(ctx, b.name, share)
+}
+
+// publishSMBVolume mounts a volume's shared folder straight at a pod's target path with mount.cifs. The credentials
+// only come with NodePublishVolume, so unlike other volumes there's nothing staged to bind mount.
+func (d *Driver) publishSMBVolume(req *csi.NodePublishVolumeRequest) error {
+	mountCap := req.GetVolumeCapability().GetMount()
+	if mountCap == nil {
+		return status.Error(codes.InvalidArgument, "SMB volumes can only be used as filesystems")
+	}
+
+	server, share := req.GetVolumeContext()["server"], req.GetVolumeContext()["share"]
+	if server == "" || share == "" {
+		return status.Error(codes.InvalidArgument, "SMB server and share missing from volume context")
+	}
+	username, password := req.GetSecrets()[smbUsernameKey], req.GetSecrets()[smbPasswordKey]
+	if username == "" || password == "" {
+		return status.Errorf(codes.InvalidArgument, "SMB credentials missing from node publish secrets, the StorageClass should set csi.storage.k8s.io/node-publish-secret-name to %s${pv.name}", SMBSecretPrefix)
+	}
+
+	targetPath := req.GetTargetPath()
+	notMnt, err := d.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Str("target_path", targetPath).Msg("Failed to check target path")
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err == nil && !notMnt {
+		log.Debug().Str("target_path", targetPath).Msg("Volume already published")
+		return nil
+	}
+	if err = os.MkdirAll(targetPath, 0o750); err != nil {
+		log.Error().Err(err).Str("target_path", targetPath).Msg("Failed to create target path")
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// Mount options, e.g. vers or file_mode, come from the StorageClass's mountOptions
+	options := append([]string{}, mountCap.GetMountFlags()...)
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	source := "//" + server + "/" + share
+	log.Debug().Str("source", source).Str("target_path", targetPath).Strs("options", options).Msg("Mounting SMB volume")
+	if err = d.mounter.MountSensitive(source, targetPath, "cifs", options, []string{"username=" + username, "password=" + password}); err != nil {
+		log.Error().Err(err).Msg("Failed to mount SMB volume")
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
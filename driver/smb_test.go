@@ -0,0 +1,209 @@
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/terrycain/qnap-csi/qnap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testSMBNamespace = "qnap-csi"
+
+func newSMBCreateVolumeRequest(name string, size int64) *csi.CreateVolumeRequest {
+	req := newCreateVolumeRequest(name, size)
+	req.VolumeCapabilities[0].AccessMode = &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+	req.Parameters = map[string]string{"protocol": "smb"}
+	return req
+}
+
+func TestDriver_CreateSMBVolume(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+
+	if _, err := d.CreateVolume(ctx, newSMBCreateVolumeRequest("pvc-1", 10*giB)); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected failed precondition without a secret namespace, got %#v", err)
+	}
+
+	kubeClient := fake.NewSimpleClientset()
+	d.EnableSMB(kubeClient, testSMBNamespace)
+
+	// Retrying picks up the existing shared folder, Secret and user
+	var resp *csi.CreateVolumeResponse
+	var err error
+	for i := 0; i < 2; i++ {
+		if resp, err = d.CreateVolume(ctx, newSMBCreateVolumeRequest("pvc-1", 10*giB)); err != nil {
+			t.Fatalf("failed to create volume: %#v", err)
+		}
+	}
+	volumeID := resp.Volume.VolumeId
+	if volumeID != "default/smb/csi-pvc1" {
+		t.Fatalf("expected: default/smb/csi-pvc1, got: %s", volumeID)
+	}
+	wantContext := map[string]string{"protocol": "smb", "server": "127.0.0.1", "share": "csi-pvc1"}
+	if !reflect.DeepEqual(resp.Volume.VolumeContext, wantContext) {
+		t.Fatalf("expected: %v, got: %v", wantContext, resp.Volume.VolumeContext)
+	}
+
+	secret, err := kubeClient.CoreV1().Secrets(testSMBNamespace).Get(ctx, SMBSecretPrefix+"pvc-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get SMB secret: %#v", err)
+	}
+	username, password := string(secret.Data[smbUsernameKey]), string(secret.Data[smbPasswordKey])
+	if users := srv.Users(); len(users) != 1 || users[username] != password || len(password) != smbPasswordLength {
+		t.Fatalf("NAS users and secret credentials differ, %v %v", users, secret.Data)
+	}
+	folders := srv.SharedFolders()
+	if len(folders) != 1 || folders[0].QuotaGB != 10 || folders[0].UserAccess[username] != qnap.SharedFolderAccessReadWrite || len(folders[0].NFSHosts) != 0 {
+		t.Fatalf("unexpected shared folders %#v", folders)
+	}
+
+	req := newSMBCreateVolumeRequest("pvc-2", 10*giB)
+	req.Parameters["nfsNetworks"] = "10.0.0.0/24"
+	if _, err = d.CreateVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument for an NFS parameter, got %#v", err)
+	}
+
+	// Any number of nodes can use the volume
+	validateResp, err := d.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: volumeID, VolumeCapabilities: newSMBCreateVolumeRequest("", 0).VolumeCapabilities})
+	if err != nil || validateResp.Confirmed == nil {
+		t.Fatalf("expected multi node multi writer to be confirmed, got %v, %#v", validateResp, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Fatalf("failed to delete volume: %#v", err)
+		}
+	}
+	if len(srv.SharedFolders()) != 0 || len(srv.Users()) != 0 {
+		t.Fatal("shared folder or user was not deleted")
+	}
+	secrets, err := kubeClient.CoreV1().Secrets(testSMBNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list secrets: %#v", err)
+	}
+	if len(secrets.Items) != 0 {
+		t.Fatalf("expected the SMB secret to be deleted, have %d secrets", len(secrets.Items))
+	}
+}
+
+func TestDriver_smbUsername(t *testing.T) {
+	d, _ := newTestDriver(t)
+
+	tests := []struct {
+		clusterID string
+		input     string
+		want      string
+	}{
+		{input: "csi-pvc1", want: "csi-e787fb12db0945dc9e8092dd1024"},
+		{clusterID: "prod", input: "csi-prod-pvc1", want: "csi-prod-"},
+		{clusterID: "abcdefghijkl", input: "csi-abcdefghijkl-pvc1", want: "csi-abcdefghijkl"},
+	}
+
+	for _, table := range tests {
+		d.clusterID = table.clusterID
+		got := d.smbUsername(table.input)
+		if len(got) != qnap.MaxUsernameLength || !strings.HasPrefix(got, table.want) {
+			t.Fatalf("%s: expected: %s..., got: %s", table.input, table.want, got)
+		}
+	}
+
+	// Volumes whose names only differ at the end still get their own users
+	if d.smbUsername("csi-abcdefghijkl-pvc00000000000000000000000000000001") == d.smbUsername("csi-abcdefghijkl-pvc00000000000000000000000000000002") {
+		t.Fatal("expected different volumes to have different usernames")
+	}
+}
+
+func TestDriver_CreateSMBVolumeUserExists(t *testing.T) {
+	ctx := context.Background()
+	d, srv := newTestDriver(t)
+	kubeClient := fake.NewSimpleClientset()
+	d.EnableSMB(kubeClient, testSMBNamespace)
+
+	// A user that isn't this volume's, which mustn't get access to its shared folder
+	username := d.smbUsername("csi-pvc1")
+	if err := d.backends[DefaultBackendName].client.CreateUser(ctx, username, "secret"); err != nil {
+		t.Fatalf("failed to create user: %#v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := d.CreateVolume(ctx, newSMBCreateVolumeRequest("pvc-1", 10*giB)); status.Code(err) != codes.AlreadyExists {
+			t.Fatalf("expected already exists, got %#v", err)
+		}
+	}
+	if users := srv.Users(); users[username] != "secret" {
+		t.Fatalf("expected the existing user to be left alone, got %v", users)
+	}
+	secrets, err := kubeClient.CoreV1().Secrets(testSMBNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list secrets: %#v", err)
+	}
+	if len(secrets.Items) != 0 {
+		t.Fatalf("expected the SMB secret to be removed, have %d secrets", len(secrets.Items))
+	}
+	if folders := srv.SharedFolders(); len(folders) != 1 || len(folders[0].UserAccess) != 0 {
+		t.Fatalf("expected nobody to have access to the shared folder, got %#v", folders)
+	}
+}
+
+func TestDriver_NodePublishSMBVolume(t *testing.T) {
+	ctx := context.Background()
+	d, mounter := newTestNodeDriver(t)
+	var err error
+
+	dir := t.TempDir()
+	stagingPath, targetPath := filepath.Join(dir, "staging"), filepath.Join(dir, "pod0")
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"vers=3.0"}}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	volumeContext := map[string]string{"protocol": "smb", "server": "10.0.0.5", "share": "pvc1"}
+
+	// Staging does nothing, the credentials only come with publishing
+	stageReq := &csi.NodeStageVolumeRequest{VolumeId: "default/smb/pvc1", StagingTargetPath: stagingPath, VolumeCapability: capability, VolumeContext: volumeContext}
+	if _, err = d.NodeStageVolume(ctx, stageReq); err != nil {
+		t.Fatalf("failed to stage volume: %#v", err)
+	}
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:          "default/smb/pvc1",
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  capability,
+		VolumeContext:     volumeContext,
+		Readonly:          true,
+	}
+	if _, err = d.NodePublishVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument without credentials, got %#v", err)
+	}
+
+	req.Secrets = map[string]string{"username": "pvc1", "password": "secret"}
+	for i := 0; i < 2; i++ {
+		if _, err = d.NodePublishVolume(ctx, req); err != nil {
+			t.Fatalf("failed to publish volume: %#v", err)
+		}
+	}
+
+	mountPoints, _ := mounter.List()
+	wantOpts := []string{"vers=3.0", "ro", "username=pvc1", "password=secret"}
+	if len(mountPoints) != 1 || mountPoints[0].Device != "//10.0.0.5/pvc1" || mountPoints[0].Type != "cifs" || !reflect.DeepEqual(mountPoints[0].Opts, wantOpts) {
+		t.Fatalf("unexpected mounts %#v", mountPoints)
+	}
+
+	if _, err = d.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: req.VolumeId, TargetPath: targetPath}); err != nil {
+		t.Fatalf("failed to unpublish volume: %#v", err)
+	}
+	if mountPoints, _ = mounter.List(); len(mountPoints) != 0 {
+		t.Fatalf("expected no mounts, got %#v", mountPoints)
+	}
+	if _, err = d.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: req.VolumeId, StagingTargetPath: stagingPath}); err != nil {
+		t.Fatalf("failed to unstage volume: %#v", err)
+	}
+}
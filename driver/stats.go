@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	iscsiLib "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+	"golang.org/x/sys/unix"
+)
+
+// scsiDeviceRunning is the state of a SCSI device which is usable, it becomes blocked or transport-offline when the
+// ISCSI session behind it is down.
+const scsiDeviceRunning = "running"
+
+// filesystemUsage returns the bytes and inodes used on the filesystem mounted at path.
+func filesystemUsage(path string) ([]*csi.VolumeUsage, error) {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(path, &statfs); err != nil {
+		return nil, err
+	}
+
+	blockSize := int64(statfs.Bsize)
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(statfs.Blocks) * blockSize,
+			Available: int64(statfs.Bavail) * blockSize,
+			Used:      int64(statfs.Blocks-statfs.Bfree) * blockSize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(statfs.Files),
+			Available: int64(statfs.Ffree),
+			Used:      int64(statfs.Files - statfs.Ffree),
+		},
+	}, nil
+}
+
+// blockDeviceUsage returns the size of the block device at path, how much of it is used isn't known.
+func blockDeviceUsage(path string) ([]*csi.VolumeUsage, error) {
+	size, err := blockDeviceSize(path)
+	if err != nil {
+		return nil, err
+	}
+	return []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: size}}, nil
+}
+
+// blockDeviceSize returns the size of the block device at path, like blockdev --getsize64.
+func blockDeviceSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return f.Seek(0, io.SeekEnd)
+}
+
+// isReadOnlyFilesystem says if the filesystem mounted at path is read-only.
+func isReadOnlyFilesystem(path string) (bool, error) {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(path, &statfs); err != nil {
+		return false, err
+	}
+	return statfs.Flags&unix.ST_RDONLY != 0, nil
+}
+
+// volumeCondition checks the ISCSI devices NodeStageVolume connected are still running and, for filesystems, that the
+// staging mount hasn't been remounted read-only after I/O errors. stagingPath may be empty if it isn't known.
+func (d *Driver) volumeCondition(volumeID, stagingPath string, isBlock bool) *csi.VolumeCondition {
+	libConfigPath := d.getISCSILibConfigPath(volumeID)
+	if _, err := os.Stat(libConfigPath); err == nil {
+		connector, err := iscsiLib.GetConnectorFromFile(libConfigPath)
+		if err != nil {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("ISCSI devices are missing: %v", err)}
+		}
+
+		for _, device := range connector.Devices {
+			state, err := d.scsiDeviceState(device.Hctl)
+			if err != nil {
+				return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("Failed to get state of ISCSI device %s: %v", device.Name, err)}
+			}
+			if state != scsiDeviceRunning {
+				return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("ISCSI device %s is %s, the session to the NAS may be down", device.Name, state)}
+			}
+		}
+	}
+
+	// The staging mount is always read-write, so read-only means the kernel gave up writing to it
+	if !isBlock && stagingPath != "" {
+		readOnly, err := isReadOnlyFilesystem(stagingPath)
+		if err != nil {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("Failed to check staging mount: %v", err)}
+		}
+		if readOnly {
+			return &csi.VolumeCondition{Abnormal: true, Message: "Filesystem has been remounted read-only, check the node's kernel log for I/O errors"}
+		}
+	}
+
+	return &csi.VolumeCondition{Message: "Volume is healthy"}
+}
+
+// scsiDeviceState reads the state of a SCSI device, given as host:channel:target:lun, from sysfs.
+func (d *Driver) scsiDeviceState(hctl string) (string, error) {
+	state, err := ioutil.ReadFile(filepath.Join(d.sysfsDir, "class", "scsi_device", hctl, "device", "state"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(state)), nil
+}
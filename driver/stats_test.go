@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDriver_NodeGetVolumeStats(t *testing.T) {
+	ctx := context.Background()
+	d, _ := newTestNodeDriver(t)
+
+	volumePath := t.TempDir()
+	resp, err := d.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc1", VolumePath: volumePath, StagingTargetPath: volumePath})
+	if err != nil {
+		t.Fatalf("failed to get volume stats: %#v", err)
+	}
+	if len(resp.Usage) != 2 || resp.Usage[0].Unit != csi.VolumeUsage_BYTES || resp.Usage[1].Unit != csi.VolumeUsage_INODES {
+		t.Fatalf("expected byte and inode usage, got %v", resp.Usage)
+	}
+	if resp.Usage[0].Total <= 0 || resp.Usage[0].Available > resp.Usage[0].Total {
+		t.Fatalf("unexpected byte usage %v", resp.Usage[0])
+	}
+	if resp.VolumeCondition == nil || resp.VolumeCondition.Abnormal {
+		t.Fatalf("expected a healthy volume, got %v", resp.VolumeCondition)
+	}
+
+	if _, err = d.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc1", VolumePath: filepath.Join(volumePath, "missing")}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found for a missing volume path, got %#v", err)
+	}
+	if _, err = d.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "pvc1"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument without a volume path, got %#v", err)
+	}
+}
+
+func Test_blockDeviceUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "device")
+	if err := ioutil.WriteFile(path, make([]byte, 4096), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := blockDeviceUsage(path)
+	if err != nil {
+		t.Fatalf("failed to get usage: %#v", err)
+	}
+	if len(usage) != 1 || usage[0].Total != 4096 {
+		t.Fatalf("expected: %d, got: %v", 4096, usage)
+	}
+}
+
+func TestDriver_scsiDeviceState(t *testing.T) {
+	d := &Driver{sysfsDir: t.TempDir()}
+
+	tests := []struct {
+		hctl    string
+		state   string
+		want    string
+		wantErr bool
+	}{
+		{hctl: "2:0:0:0", state: "running\n", want: scsiDeviceRunning},
+		{hctl: "3:0:0:0", state: "transport-offline\n", want: "transport-offline"},
+		{hctl: "4:0:0:0", wantErr: true},
+	}
+
+	for _, table := range tests {
+		if table.state != "" {
+			dir := filepath.Join(d.sysfsDir, "class", "scsi_device", table.hctl, "device")
+			if err := os.MkdirAll(dir, 0o750); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "state"), []byte(table.state), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := d.scsiDeviceState(table.hctl)
+		if (err != nil) != table.wantErr {
+			t.Fatalf("%s: expected error: %v, got: %v", table.hctl, table.wantErr, err)
+		}
+		if got != table.want {
+			t.Fatalf("expected: %v, got: %v", table.want, got)
+		}
+	}
+}
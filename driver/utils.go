@@ -1,43 +1,86 @@
 package driver
 
 import (
-	"encoding/base64"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"k8s.io/apimachinery/pkg/util/sets"
 )
 
-func seenIndexesToBase64String(ints []int) string {
-	result := ""
-	for _, elem := range ints {
-		result += strconv.Itoa(elem) + ","
-	}
+// volumeCursor is a position in the list of volumes, which is ordered by backend name, then each backend's targets by
+// index and then its shared folders by name. Target indexes only go up and shared folder names don't change, so a
+// position stays put as volumes are created and deleted.
+type volumeCursor struct {
+	backend     string
+	targetIndex int
+	// share is set for shared folders, which come after every target
+	share string
+}
 
-	result = strings.TrimRight(result, ",")
-	return base64.StdEncoding.EncodeToString([]byte(result))
+func (c volumeCursor) less(other volumeCursor) bool {
+	if c.backend != other.backend {
+		return c.backend < other.backend
+	}
+	if (c.share == "") != (other.share == "") {
+		return c.share == ""
+	}
+	if c.share != "" {
+		return c.share < other.share
+	}
+	return c.targetIndex < other.targetIndex
 }
 
-func base64SeenIndexesToMap(value string) (*sets.Int, error) {
-	result := sets.NewInt()
+// String formats the cursor as a ListVolumes token, <backend>/t/<target index> or <backend>/s/<shared folder>.
+func (c volumeCursor) String() string {
+	if c.share != "" {
+		return c.backend + "/s/" + c.share
+	}
+	return c.backend + "/t/" + strconv.Itoa(c.targetIndex)
+}
 
-	s, err := base64.StdEncoding.DecodeString(value)
-	if err != nil {
-		return nil, err
+func parseVolumeCursor(token string) (volumeCursor, error) {
+	parts := strings.SplitN(token, "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return volumeCursor{}, fmt.Errorf("invalid volume cursor %q", token)
 	}
 
-	for _, strInt := range strings.Split(string(s), ",") {
-		intValue, err2 := strconv.Atoi(strInt)
-		if err2 != nil {
-			return nil, err2
+	switch parts[1] {
+	case "t":
+		index, err := strconv.Atoi(parts[2])
+		if err != nil || index < 0 {
+			return volumeCursor{}, fmt.Errorf("invalid target index in volume cursor %q", token)
 		}
-		result.Insert(intValue)
+		return volumeCursor{backend: parts[0], targetIndex: index}, nil
+	case "s":
+		return volumeCursor{backend: parts[0], share: parts[2]}, nil
+	default:
+		return volumeCursor{}, fmt.Errorf("invalid volume cursor %q", token)
 	}
+}
 
-	return &result, err
+// Snapshot IDs are the source volume ID and the snapshot name, as snapshot names are only unique per LUN.
+const snapshotIDSeparator = "@"
+
+func buildSnapshotID(volumeID, snapshotName string) string {
+	return volumeID + snapshotIDSeparator + snapshotName
+}
+
+func parseSnapshotID(snapshotID string) (string, string, error) {
+	index := strings.LastIndex(snapshotID, snapshotIDSeparator)
+	if index <= 0 || index == len(snapshotID)-1 {
+		return "", "", fmt.Errorf("invalid snapshot id %q", snapshotID)
+	}
+
+	return snapshotID[:index], snapshotID[index+1:], nil
+}
+
+// initiatorNameRegex matches the iqn., eui. and naa. iSCSI name formats.
+var initiatorNameRegex = regexp.MustCompile(`^(iqn\.\d{4}-\d{2}\..+|eui\.[0-9A-Fa-f]{16}|naa\.[0-9A-Fa-f]{16,32})$`)
+
+func isInitiatorName(name string) bool {
+	return initiatorNameRegex.MatchString(name)
 }
 
 var cleanRegex = regexp.MustCompile(`([^a-z0-9A-Z]*)`)
@@ -128,3 +171,12 @@ func formatBytes(inputBytes int64) string {
 	result = strings.TrimSuffix(result, ".0")
 	return result + unit
 }
+
+// driverVolumeNameRegex matches cleanISCSIName of the PV names the external-provisioner generates (pvc-<uid>), which
+// is all earlier versions named volumes, so targets and LUNs created by hand on the NAS are never treated as this
+// driver's.
+var driverVolumeNameRegex = regexp.MustCompile(`^pvc[0-9a-f]{32}$`)
+
+func isDriverVolumeName(name string) bool {
+	return driverVolumeNameRegex.MatchString(name)
+}
@@ -22,3 +22,76 @@ func Test_cleanISCSIName(t *testing.T) {
 		}
 	}
 }
+
+func Test_parseSnapshotID(t *testing.T) {
+	tests := []struct {
+		input        string
+		wantVolume   string
+		wantSnapshot string
+		wantErr      bool
+	}{
+		{input: buildSnapshotID("pvc1234", "snapshot1234"), wantVolume: "pvc1234", wantSnapshot: "snapshot1234"},
+		{input: "pvc1234", wantErr: true},
+		{input: "@snapshot1234", wantErr: true},
+		{input: "pvc1234@", wantErr: true},
+	}
+
+	for _, table := range tests {
+		gotVolume, gotSnapshot, err := parseSnapshotID(table.input)
+		if table.wantErr {
+			if err == nil {
+				t.Fatalf("expected error for %q", table.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", table.input, err)
+		}
+		if gotVolume != table.wantVolume || gotSnapshot != table.wantSnapshot {
+			t.Fatalf("expected: %v@%v, got: %v@%v", table.wantVolume, table.wantSnapshot, gotVolume, gotSnapshot)
+		}
+	}
+}
+
+func Test_volumeCursor(t *testing.T) {
+	tests := []struct {
+		token   string
+		want    volumeCursor
+		wantErr bool
+	}{
+		{token: "default/t/12", want: volumeCursor{backend: "default", targetIndex: 12}},
+		{token: "nas2/s/pvc0123", want: volumeCursor{backend: "nas2", share: "pvc0123"}},
+		{token: "default/t/a", wantErr: true},
+		{token: "default/t/-1", wantErr: true},
+		{token: "default/s/", wantErr: true},
+		{token: "/t/1", wantErr: true},
+		{token: "0,1,2", wantErr: true},
+	}
+
+	for _, table := range tests {
+		got, err := parseVolumeCursor(table.token)
+		if (err != nil) != table.wantErr {
+			t.Fatalf("expected error: %v, got: %v", table.wantErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if got != table.want || got.String() != table.token {
+			t.Fatalf("expected: %v, got: %v", table.want, got)
+		}
+	}
+
+	// Backends first, then targets by index, then shared folders by name
+	ordered := []volumeCursor{
+		{backend: "a", targetIndex: 2},
+		{backend: "a", targetIndex: 10},
+		{backend: "a", share: "pvc1"},
+		{backend: "a", share: "pvc2"},
+		{backend: "b", targetIndex: 0},
+	}
+	for i := 1; i < len(ordered); i++ {
+		if !ordered[i-1].less(ordered[i]) || ordered[i].less(ordered[i-1]) {
+			t.Fatalf("expected %v before %v", ordered[i-1], ordered[i])
+		}
+	}
+}
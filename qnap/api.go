@@ -4,16 +4,20 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/xml"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// defaultRequestTimeout is a backstop for requests whose context has no deadline, some CGIs can hang forever.
+const defaultRequestTimeout = 2 * time.Minute
+
 type Client struct {
 	client                      *http.Client
 	baseURL                     *url.URL
@@ -22,28 +26,59 @@ type Client struct {
 	iscsiPortalEndpoint         string
 	iscsiTargetSettingsEndpoint string
 	iscsiLunSettingsEndpoint    string
+	snapshotEndpoint            string
+	iscsiPolicyEndpoint         string
+	shareEndpoint               string
 	Username                    string
 	Password                    string
 
 	sid      string
 	sidMutex *sync.RWMutex
+
+	observer Observer
+}
+
+// Observer is told about the requests a client sends, e.g. to export metrics. It must be safe for concurrent use.
+type Observer interface {
+	// ObserveRequest is called after every request to a CGI, err is set if no response was received.
+	ObserveRequest(cgi, function string, statusCode int, duration time.Duration, err error)
+	// ObserveError is called for every request the NAS reported a failure for, which it mostly does with a 200 status
+	// and a result code.
+	ObserveError(err *APIError)
+	// ObserveLogin is called after every attempt to start a session.
+	ObserveLogin(err error)
 }
 
 func NewClient(username, password, qnapURL string) (*Client, error) {
+	return NewClientWithTLS(username, password, qnapURL, TLSOptions{})
+}
+
+// NewClientWithTLS is NewClient with control over how HTTPS connections to the NAS are verified.
+func NewClientWithTLS(username, password, qnapURL string, tlsOptions TLSOptions) (*Client, error) {
 	trimmedBase := strings.TrimRight(qnapURL, "/")
 	parsedURL, err := url.Parse(trimmedBase)
 	if err != nil {
 		return &Client{}, err
 	}
 
+	tlsConfig, err := tlsOptions.Config()
+	if err != nil {
+		return &Client{}, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
 	c := Client{
-		client:                      &http.Client{},
+		client:                      &http.Client{Timeout: defaultRequestTimeout, Transport: transport},
 		baseURL:                     parsedURL,
 		loginEndpoint:               trimmedBase + "/cgi-bin/authLogin.cgi",
 		diskManageEndpoint:          trimmedBase + "/cgi-bin/disk/disk_manage.cgi",
 		iscsiPortalEndpoint:         trimmedBase + "/cgi-bin/disk/iscsi_portal_setting.cgi",
 		iscsiTargetSettingsEndpoint: trimmedBase + "/cgi-bin/disk/iscsi_target_setting.cgi",
 		iscsiLunSettingsEndpoint:    trimmedBase + "/cgi-bin/disk/iscsi_lun_setting.cgi",
+		snapshotEndpoint:            trimmedBase + "/cgi-bin/disk/snapshot.cgi",
+		iscsiPolicyEndpoint:         trimmedBase + "/cgi-bin/disk/iscsi_policy_setting.cgi",
+		shareEndpoint:               trimmedBase + "/cgi-bin/priv/privRights.cgi",
 		Username:                    username,
 		// Password is sent to the server base64'd
 		Password: base64.StdEncoding.EncodeToString([]byte(password)),
@@ -54,14 +89,33 @@ func NewClient(username, password, qnapURL string) (*Client, error) {
 	return &c, nil
 }
 
+// SetObserver has the client report its requests to observer, it should be called before the client is used.
+func (c *Client) SetObserver(observer Observer) {
+	c.observer = observer
+}
+
 func addParamsToURL(baseURL string, params url.Values) string {
 	parsedURL, _ := url.Parse(baseURL)
 	parsedURL.RawQuery = params.Encode()
 	return parsedURL.String()
 }
 
-func (c *Client) postFormReq(endpoint string, payload string) ([]byte, int, error) {
-	req, err := http.NewRequestWithContext(context.Background(), "POST", endpoint, strings.NewReader(payload)) // URL-encoded payload
+// postFormReq sends a request to a CGI, function is only used to tell the observer what the request was.
+func (c *Client) postFormReq(ctx context.Context, endpoint, function, payload string) ([]byte, int, error) {
+	start := time.Now()
+	body, statusCode, err := c.doPostFormReq(ctx, endpoint, payload)
+	if c.observer != nil {
+		cgi := endpoint
+		if parsedURL, parseErr := url.Parse(endpoint); parseErr == nil {
+			cgi = path.Base(parsedURL.Path)
+		}
+		c.observer.ObserveRequest(cgi, function, statusCode, time.Since(start), err)
+	}
+	return body, statusCode, err
+}
+
+func (c *Client) doPostFormReq(ctx context.Context, endpoint string, payload string) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(payload)) // URL-encoded payload
 	if err != nil {
 		return nil, 0, err
 	}
@@ -94,17 +148,30 @@ type loginRespXML struct {
 	AuthSid    string `xml:"authSid"`
 }
 
-func (c *Client) Login() error {
+// Login starts a new session on the NAS. Calling it is optional as the client logs in when needed.
+func (c *Client) Login(ctx context.Context) error {
+	c.sidMutex.Lock()
+	defer c.sidMutex.Unlock()
+
+	return c.login(ctx)
+}
+
+// login gets a new sid, the caller must hold the sidMutex write lock.
+func (c *Client) login(ctx context.Context) (err error) {
+	if c.observer != nil {
+		defer func() { c.observer.ObserveLogin(err) }()
+	}
+
 	data := url.Values{}
 	data.Add("user", c.Username)
 	data.Add("pwd", c.Password)
 
-	xmlBytes, statusCode, err := c.postFormReq(c.loginEndpoint, data.Encode())
+	xmlBytes, statusCode, err := c.postFormReq(ctx, c.loginEndpoint, "login", data.Encode())
 	if err != nil {
 		return err
 	}
 	if statusCode != 200 {
-		return errors.New("status code not 200")
+		return c.newAPIError(c.loginEndpoint, "login", statusCode, "", xmlBytes, nil)
 	}
 
 	var xmlStruct loginRespXML
@@ -113,15 +180,87 @@ func (c *Client) Login() error {
 	}
 
 	if xmlStruct.AuthPassed != "1" {
-		return errors.New("invalid username or password")
+		return c.newAPIError(c.loginEndpoint, "login", statusCode, "", xmlBytes, map[string]error{"": ErrAuth})
 	}
 
+	c.sid = xmlStruct.AuthSid
+
+	return nil
+}
+
+// renewSid logs in again, unless another request has already replaced staleSid with a new session in the meantime.
+func (c *Client) renewSid(ctx context.Context, staleSid string) (string, error) {
 	c.sidMutex.Lock()
 	defer c.sidMutex.Unlock()
 
-	c.sid = xmlStruct.AuthSid
+	if c.sid != "" && c.sid != staleSid {
+		return c.sid, nil
+	}
 
-	return nil
+	if err := c.login(ctx); err != nil {
+		return "", err
+	}
+
+	return c.sid, nil
+}
+
+type authCheckRespXML struct {
+	AuthPassed string `xml:"authPassed"`
+}
+
+// isAuthFailure works out if the NAS rejected a request because the sid has expired or is invalid.
+func isAuthFailure(xmlBytes []byte, statusCode int) bool {
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		return true
+	}
+
+	var xmlStruct authCheckRespXML
+	if err := xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return false
+	}
+
+	return xmlStruct.AuthPassed == "0"
+}
+
+// authedPostFormReq is postFormReq for endpoints which need a session, the sid is added to params. If there is no
+// session yet one is started, and if the NAS rejects the sid the client logs in again and retries the request once.
+func (c *Client) authedPostFormReq(ctx context.Context, endpoint string, params url.Values, payload string) ([]byte, int, error) {
+	sid := c.getSid()
+	if sid == "" {
+		var err error
+		if sid, err = c.renewSid(ctx, sid); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	function := requestFunc(params, payload)
+	params.Set("sid", sid)
+	xmlBytes, statusCode, err := c.postFormReq(ctx, addParamsToURL(endpoint, params), function, payload)
+	if err != nil || !isAuthFailure(xmlBytes, statusCode) {
+		return xmlBytes, statusCode, err
+	}
+
+	if sid, err = c.renewSid(ctx, sid); err != nil {
+		return nil, 0, err
+	}
+
+	params.Set("sid", sid)
+	xmlBytes, statusCode, err = c.postFormReq(ctx, addParamsToURL(endpoint, params), function, payload)
+	if err == nil && isAuthFailure(xmlBytes, statusCode) {
+		return nil, 0, c.newAPIError(endpoint, function, statusCode, "", xmlBytes, map[string]error{"": ErrAuth})
+	}
+
+	return xmlBytes, statusCode, err
+}
+
+// requestFunc finds the func parameter of a request, depending on the CGI it is sent in the query string or the body.
+func requestFunc(params url.Values, payload string) string {
+	if fn := params.Get("func"); fn != "" {
+		return fn
+	}
+
+	data, _ := url.ParseQuery(payload)
+	return data.Get("func")
 }
 
 type StoragePoolSubscriptionInfoXML struct {
@@ -142,23 +281,21 @@ type StoragePoolSubscriptionRespXML struct {
 	PoolSubscription StoragePoolSubscriptionInfoXML `xml:"PoolSubscription"`
 }
 
-func (c *Client) GetStoragePoolSubscription(poolID int) (StoragePoolSubscriptionRespXML, error) {
+func (c *Client) GetStoragePoolSubscription(ctx context.Context, poolID int) (StoragePoolSubscriptionRespXML, error) {
 	params := url.Values{}
-	params.Add("sid", c.getSid())
 	params.Add("store", "poolSubsc")
-	endpoint := addParamsToURL(c.diskManageEndpoint, params)
 
 	data := url.Values{}
 	data.Add("func", "extra_get")
 	data.Add("Pool_Subs", "1") // the 1 here means nothing
 	data.Add("poolID", strconv.Itoa(poolID))
 
-	xmlBytes, statusCode, err := c.postFormReq(endpoint, data.Encode())
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.diskManageEndpoint, params, data.Encode())
 	if err != nil {
 		return StoragePoolSubscriptionRespXML{}, err
 	}
 	if statusCode != 200 {
-		return StoragePoolSubscriptionRespXML{}, errors.New("status code not 200")
+		return StoragePoolSubscriptionRespXML{}, c.newAPIError(c.diskManageEndpoint, "extra_get", statusCode, "", xmlBytes, nil)
 	}
 
 	var xmlStruct StoragePoolSubscriptionRespXML
@@ -166,10 +303,8 @@ func (c *Client) GetStoragePoolSubscription(poolID int) (StoragePoolSubscription
 		return StoragePoolSubscriptionRespXML{}, err
 	}
 
-	if xmlStruct.Result == "-1" {
-		return StoragePoolSubscriptionRespXML{}, errors.New("invalid pool id")
-	} else if xmlStruct.Result != "0" {
-		return StoragePoolSubscriptionRespXML{}, errors.New("unknown error occurred")
+	if xmlStruct.Result != "0" {
+		return StoragePoolSubscriptionRespXML{}, c.newAPIError(c.diskManageEndpoint, "extra_get", statusCode, xmlStruct.Result, xmlBytes, map[string]error{"-1": ErrInvalidPool})
 	}
 
 	return xmlStruct, nil
@@ -214,22 +349,20 @@ type StorageLogicalVolumeRespXML struct {
 	Volumes               []LogicalVolumeInfoXML `xml:"Volume_Index>row"`
 }
 
-func (c *Client) GetStorageLogicalVolumes() (StorageLogicalVolumeRespXML, error) {
+func (c *Client) GetStorageLogicalVolumes(ctx context.Context) (StorageLogicalVolumeRespXML, error) {
 	params := url.Values{}
-	params.Add("sid", c.getSid())
 	params.Add("store", "lvList")
-	endpoint := addParamsToURL(c.diskManageEndpoint, params)
 
 	data := url.Values{}
 	data.Add("func", "extra_get")
 	data.Add("extra_vol_index", "1") // the 1 here means nothing
 
-	xmlBytes, statusCode, err := c.postFormReq(endpoint, data.Encode())
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.diskManageEndpoint, params, data.Encode())
 	if err != nil {
 		return StorageLogicalVolumeRespXML{}, err
 	}
 	if statusCode != 200 {
-		return StorageLogicalVolumeRespXML{}, errors.New("status code not 200")
+		return StorageLogicalVolumeRespXML{}, c.newAPIError(c.diskManageEndpoint, "extra_get", statusCode, "", xmlBytes, nil)
 	}
 
 	var xmlStruct StorageLogicalVolumeRespXML
@@ -238,7 +371,7 @@ func (c *Client) GetStorageLogicalVolumes() (StorageLogicalVolumeRespXML, error)
 	}
 
 	if xmlStruct.Result != "0" {
-		return StorageLogicalVolumeRespXML{}, errors.New("unknown error occurred")
+		return StorageLogicalVolumeRespXML{}, c.newAPIError(c.diskManageEndpoint, "extra_get", statusCode, xmlStruct.Result, xmlBytes, nil)
 	}
 
 	return xmlStruct, nil
@@ -297,7 +430,11 @@ type StorageISCSILUNRespXML struct {
 }
 
 func (l *StorageISCSILUNRespXML) StatusString() string {
-	switch l.Status {
+	return lunStatusString(l.Status)
+}
+
+func lunStatusString(status string) string {
+	switch status {
 	case "-1":
 		return "removing"
 	case "-2":
@@ -307,25 +444,23 @@ func (l *StorageISCSILUNRespXML) StatusString() string {
 	case "1":
 		return "ready"
 	default:
-		return fmt.Sprintf("unknown LUN status %s", l.Status)
+		return fmt.Sprintf("unknown LUN status %s", status)
 
 	}
 }
 
-func (c *Client) GetStorageISCSILun(lunID int) (StorageISCSILUNRespXML, error) {
+func (c *Client) GetStorageISCSILun(ctx context.Context, lunID int) (StorageISCSILUNRespXML, error) {
 	params := url.Values{}
-	params.Add("sid", c.getSid())
 	params.Add("func", "extra_get")
 	params.Add("lun_info", "1")
 	params.Add("lunID", strconv.Itoa(lunID))
-	endpoint := addParamsToURL(c.iscsiPortalEndpoint, params)
 
-	xmlBytes, statusCode, err := c.postFormReq(endpoint, "")
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiPortalEndpoint, params, "")
 	if err != nil {
 		return StorageISCSILUNRespXML{}, err
 	}
 	if statusCode != 200 {
-		return StorageISCSILUNRespXML{}, errors.New("status code not 200")
+		return StorageISCSILUNRespXML{}, c.newAPIError(c.iscsiPortalEndpoint, "extra_get", statusCode, "", xmlBytes, nil)
 	}
 
 	var xmlStruct StorageISCSILUNRespXML
@@ -334,7 +469,7 @@ func (c *Client) GetStorageISCSILun(lunID int) (StorageISCSILUNRespXML, error) {
 	}
 
 	if xmlStruct.Result != "0" {
-		return StorageISCSILUNRespXML{}, errors.New("unknown error occurred")
+		return StorageISCSILUNRespXML{}, c.newAPIError(c.iscsiPortalEndpoint, "extra_get", statusCode, xmlStruct.Result, xmlBytes, nil)
 	}
 
 	// The Capacity field seems to have a random newline in it :/
@@ -343,6 +478,57 @@ func (c *Client) GetStorageISCSILun(lunID int) (StorageISCSILUNRespXML, error) {
 	return xmlStruct, nil
 }
 
+type StorageISCSILUNInfoXML struct {
+	Index         int                        `xml:"LUNIndex"`
+	Name          string                     `xml:"LUNName"`
+	Capacity      string                     `xml:"LUNCapacity"`
+	Status        string                     `xml:"LUNStatus"`
+	ThinAllocate  string                     `xml:"LUNThinAllocate"`
+	CapacityBytes string                     `xml:"capacity_bytes"`
+	StoragePoolID string                     `xml:"poolID"`
+	Targets       []StorageISCSILUNTargetXML `xml:"LUNTargetList>row"`
+}
+
+func (l *StorageISCSILUNInfoXML) StatusString() string {
+	return lunStatusString(l.Status)
+}
+
+type StorageISCSILUNListRespXML struct {
+	AuthPassed string                   `xml:"authPassed"`
+	Result     string                   `xml:"result"`
+	LUNs       []StorageISCSILUNInfoXML `xml:"LUNInfo>row"`
+}
+
+// GetStorageISCSILunList lists every iSCSI LUN on the NAS, including ones not attached to a target.
+func (c *Client) GetStorageISCSILunList(ctx context.Context) (StorageISCSILUNListRespXML, error) {
+	params := url.Values{}
+	params.Add("func", "extra_get")
+	params.Add("lunList", "1")
+
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiPortalEndpoint, params, "")
+	if err != nil {
+		return StorageISCSILUNListRespXML{}, err
+	}
+	if statusCode != 200 {
+		return StorageISCSILUNListRespXML{}, c.newAPIError(c.iscsiPortalEndpoint, "extra_get", statusCode, "", xmlBytes, nil)
+	}
+
+	var xmlStruct StorageISCSILUNListRespXML
+	if err = xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return StorageISCSILUNListRespXML{}, err
+	}
+
+	if xmlStruct.Result != "0" {
+		return StorageISCSILUNListRespXML{}, c.newAPIError(c.iscsiPortalEndpoint, "extra_get", statusCode, xmlStruct.Result, xmlBytes, nil)
+	}
+
+	for i := range xmlStruct.LUNs {
+		xmlStruct.LUNs[i].Capacity = strings.Trim(xmlStruct.LUNs[i].Capacity, "\n")
+	}
+
+	return xmlStruct, nil
+}
+
 type StorageISCSITargetInitConnInfoXML struct {
 	ConnectionType   string `xml:"connection_type"`
 	InitiatorIQN     string `xml:"initiatorIQN"`
@@ -380,20 +566,18 @@ type StorageISCSITargetListRespXML struct {
 	Targets    []StorageISCSITargetInfoXML `xml:"iSCSITargetList>targetInfo"`
 }
 
-func (c *Client) GetStorageISCSITargetList() (StorageISCSITargetListRespXML, error) {
+func (c *Client) GetStorageISCSITargetList(ctx context.Context) (StorageISCSITargetListRespXML, error) {
 	params := url.Values{}
-	params.Add("sid", c.getSid())
 	params.Add("func", "extra_get")
 	params.Add("targetList", "1")
-	endpoint := addParamsToURL(c.iscsiPortalEndpoint, params)
 
 	// Is a get when using the UI but I have a feeling it doesnt care, it munges get and post parameters
-	xmlBytes, statusCode, err := c.postFormReq(endpoint, "")
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiPortalEndpoint, params, "")
 	if err != nil {
 		return StorageISCSITargetListRespXML{}, err
 	}
 	if statusCode != 200 {
-		return StorageISCSITargetListRespXML{}, errors.New("status code not 200")
+		return StorageISCSITargetListRespXML{}, c.newAPIError(c.iscsiPortalEndpoint, "extra_get", statusCode, "", xmlBytes, nil)
 	}
 
 	var xmlStruct StorageISCSITargetListRespXML
@@ -402,7 +586,7 @@ func (c *Client) GetStorageISCSITargetList() (StorageISCSITargetListRespXML, err
 	}
 
 	if xmlStruct.Result != "0" {
-		return StorageISCSITargetListRespXML{}, errors.New("unknown error occurred")
+		return StorageISCSITargetListRespXML{}, c.newAPIError(c.iscsiPortalEndpoint, "extra_get", statusCode, xmlStruct.Result, xmlBytes, nil)
 	}
 
 	return xmlStruct, nil
@@ -413,11 +597,10 @@ type StorageISCSICreateTargetRespXML struct {
 	Result     int    `xml:"result"`
 }
 
-// CreateStorageISCSITarget TODO(docs) This is sorta idempotent, you can create the same name multiple times.
-func (c *Client) CreateStorageISCSITarget(name string, dataDigest, headerDigest, clusterMode bool) (int, error) {
+// CreateStorageISCSITarget TODO(docs) This is sorta idempotent, you can create the same name multiple times. Firmware
+// which rejects a name that is taken returns ErrAlreadyExists.
+func (c *Client) CreateStorageISCSITarget(ctx context.Context, name string, dataDigest, headerDigest, clusterMode bool) (int, error) {
 	params := url.Values{}
-	params.Add("sid", c.getSid())
-	endpoint := addParamsToURL(c.iscsiTargetSettingsEndpoint, params)
 
 	data := url.Values{}
 	data.Add("func", "add_target")
@@ -428,12 +611,12 @@ func (c *Client) CreateStorageISCSITarget(name string, dataDigest, headerDigest,
 	data.Add("bTargetClusterEnable", b2is(clusterMode))
 
 	// Is a get when using the UI but I have a feeling it doesnt care, it munges get and post parameters
-	xmlBytes, statusCode, err := c.postFormReq(endpoint, data.Encode())
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiTargetSettingsEndpoint, params, data.Encode())
 	if err != nil {
 		return 0, err
 	}
 	if statusCode != 200 {
-		return 0, errors.New("status code not 200")
+		return 0, c.newAPIError(c.iscsiTargetSettingsEndpoint, "add_target", statusCode, "", xmlBytes, nil)
 	}
 
 	var xmlStruct StorageISCSICreateTargetRespXML
@@ -442,7 +625,7 @@ func (c *Client) CreateStorageISCSITarget(name string, dataDigest, headerDigest,
 	}
 
 	if xmlStruct.Result < 0 {
-		return 0, errors.New("unknown error occurred")
+		return 0, c.newAPIError(c.iscsiTargetSettingsEndpoint, "add_target", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, map[string]error{"-2": ErrAlreadyExists})
 	}
 
 	return xmlStruct.Result, nil
@@ -455,10 +638,8 @@ type StorageISCSICreateInitiatorRespXML struct {
 
 // CreateStorageISCSIInitiator TODO(docs) This is sorta idempotent, you can create multiple times, also doesnt seem to care if you
 // give it bogus index id's.
-func (c *Client) CreateStorageISCSIInitiator(targetIndex int, chapEnable bool, chapUser, chapPass string, mutualChapEnable bool, mutualChapUser, mutualChapPass string) error {
+func (c *Client) CreateStorageISCSIInitiator(ctx context.Context, targetIndex int, chapEnable bool, chapUser, chapPass string, mutualChapEnable bool, mutualChapUser, mutualChapPass string) error {
 	params := url.Values{}
-	params.Add("sid", c.getSid())
-	endpoint := addParamsToURL(c.iscsiTargetSettingsEndpoint, params)
 
 	data := url.Values{}
 	data.Add("func", "add_init")
@@ -472,12 +653,12 @@ func (c *Client) CreateStorageISCSIInitiator(targetIndex int, chapEnable bool, c
 	data.Add("mutualCHAPPasswd", mutualChapPass)
 
 	// Is a get when using the UI but I have a feeling it doesnt care, it munges get and post parameters
-	xmlBytes, statusCode, err := c.postFormReq(endpoint, data.Encode())
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiTargetSettingsEndpoint, params, data.Encode())
 	if err != nil {
 		return err
 	}
 	if statusCode != 200 {
-		return errors.New("status code not 200")
+		return c.newAPIError(c.iscsiTargetSettingsEndpoint, "add_init", statusCode, "", xmlBytes, nil)
 	}
 
 	var xmlStruct StorageISCSICreateInitiatorRespXML
@@ -486,7 +667,7 @@ func (c *Client) CreateStorageISCSIInitiator(targetIndex int, chapEnable bool, c
 	}
 
 	if xmlStruct.Result < 0 {
-		return errors.New("unknown error occurred")
+		return c.newAPIError(c.iscsiTargetSettingsEndpoint, "add_init", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, nil)
 	}
 
 	return nil
@@ -497,20 +678,18 @@ type StorageISCSIDeleteTargetRespXML struct {
 	Result     int    `xml:"result"`
 }
 
-func (c *Client) DeleteStorageISCSITarget(targetIndex int) error {
+func (c *Client) DeleteStorageISCSITarget(ctx context.Context, targetIndex int) error {
 	params := url.Values{}
-	params.Add("sid", c.getSid())
 	params.Add("func", "remove_target")
 	params.Add("targetIndex", strconv.Itoa(targetIndex))
-	endpoint := addParamsToURL(c.iscsiTargetSettingsEndpoint, params)
 
 	// Is a get when using the UI but I have a feeling it doesnt care, it munges get and post parameters
-	xmlBytes, statusCode, err := c.postFormReq(endpoint, "")
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiTargetSettingsEndpoint, params, "")
 	if err != nil {
 		return err
 	}
 	if statusCode != 200 {
-		return errors.New("status code not 200")
+		return c.newAPIError(c.iscsiTargetSettingsEndpoint, "remove_target", statusCode, "", xmlBytes, nil)
 	}
 
 	var xmlStruct StorageISCSIDeleteTargetRespXML
@@ -519,7 +698,7 @@ func (c *Client) DeleteStorageISCSITarget(targetIndex int) error {
 	}
 
 	if xmlStruct.Result != targetIndex {
-		return errors.New("unknown error occurred")
+		return c.newAPIError(c.iscsiTargetSettingsEndpoint, "remove_target", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, map[string]error{"-1": ErrNotFound})
 	}
 
 	return nil
@@ -532,10 +711,8 @@ type StorageISCSICreateBlockLUNRespXML struct {
 }
 
 // CreateStorageISCSIBlockLUN TODO(docs) !!if you try and create same name it'll cause a crash and the ui will show some errors :D.
-func (c *Client) CreateStorageISCSIBlockLUN(name string, storagePoolID int, capacity int, thinAllocate bool, sectorSize int, wcEnable, fuaEnable, ssdCache, enableTiering bool) (StorageISCSICreateBlockLUNRespXML, error) {
+func (c *Client) CreateStorageISCSIBlockLUN(ctx context.Context, name string, storagePoolID int, capacity int, thinAllocate bool, sectorSize int, wcEnable, fuaEnable, ssdCache, enableTiering bool) (StorageISCSICreateBlockLUNRespXML, error) {
 	params := url.Values{}
-	params.Add("sid", c.getSid())
-	endpoint := addParamsToURL(c.iscsiLunSettingsEndpoint, params)
 
 	data := url.Values{}
 	data.Add("func", "add_lun")
@@ -554,12 +731,12 @@ func (c *Client) CreateStorageISCSIBlockLUN(name string, storagePoolID int, capa
 	data.Add("enable_tiering", b2is(enableTiering))
 
 	// Is a get when using the UI but I have a feeling it doesnt care, it munges get and post parameters
-	xmlBytes, statusCode, err := c.postFormReq(endpoint, data.Encode())
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiLunSettingsEndpoint, params, data.Encode())
 	if err != nil {
 		return StorageISCSICreateBlockLUNRespXML{}, err
 	}
 	if statusCode != 200 {
-		return StorageISCSICreateBlockLUNRespXML{}, errors.New("status code not 200")
+		return StorageISCSICreateBlockLUNRespXML{}, c.newAPIError(c.iscsiLunSettingsEndpoint, "add_lun", statusCode, "", xmlBytes, nil)
 	}
 
 	var xmlStruct StorageISCSICreateBlockLUNRespXML
@@ -568,34 +745,67 @@ func (c *Client) CreateStorageISCSIBlockLUN(name string, storagePoolID int, capa
 	}
 
 	if xmlStruct.Result < 0 {
-		return StorageISCSICreateBlockLUNRespXML{}, errors.New("unknown error occurred")
+		return StorageISCSICreateBlockLUNRespXML{}, c.newAPIError(c.iscsiLunSettingsEndpoint, "add_lun", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, map[string]error{"-1": ErrInvalidPool})
 	}
 
 	return xmlStruct, nil
 }
 
+type StorageISCSIExpandBlockLUNRespXML struct {
+	AuthPassed string `xml:"authPassed"`
+	Result     int    `xml:"result"` // This is the LUN index
+}
+
+// ExpandStorageISCSIBlockLUN grows a block based LUN to capacity (in GB), the NAS rejects shrinking a LUN.
+func (c *Client) ExpandStorageISCSIBlockLUN(ctx context.Context, lunIndex int, capacity int) error {
+	params := url.Values{}
+
+	data := url.Values{}
+	data.Add("func", "edit_lun")
+	data.Add("LUNIndex", strconv.Itoa(lunIndex))
+	data.Add("LUNCapacity", strconv.Itoa(capacity))
+
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiLunSettingsEndpoint, params, data.Encode())
+	if err != nil {
+		return err
+	}
+	if statusCode != 200 {
+		return c.newAPIError(c.iscsiLunSettingsEndpoint, "edit_lun", statusCode, "", xmlBytes, nil)
+	}
+
+	var xmlStruct StorageISCSIExpandBlockLUNRespXML
+	if err = xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return err
+	}
+
+	if xmlStruct.Result < 0 {
+		return c.newAPIError(c.iscsiLunSettingsEndpoint, "edit_lun", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, nil)
+	}
+
+	return nil
+}
+
 type StorageISCSIDeleteBlockLUNRespXML struct {
 	AuthPassed string `xml:"authPassed"`
 	Result     int    `xml:"result"`
 }
 
-// DeleteStorageISCSIBlockLUN TODO(docs) can delete random non existent indexes.
-func (c *Client) DeleteStorageISCSIBlockLUN(targetIndex int, runInBackground bool) error {
+// DeleteStorageISCSIBlockLUN TODO(docs) can delete random non existent indexes, firmware which refuses returns
+// ErrNotFound.
+func (c *Client) DeleteStorageISCSIBlockLUN(ctx context.Context, targetIndex int, runInBackground bool) error {
 	params := url.Values{}
-	params.Add("sid", c.getSid())
 	params.Add("func", "remove_lun")
 	if runInBackground {
 		params.Add("run_background", "1")
 	}
 	params.Add("LUNIndex", strconv.Itoa(targetIndex))
-	endpoint := addParamsToURL(c.iscsiLunSettingsEndpoint, params)
 
-	xmlBytes, statusCode, err := c.postFormReq(endpoint, "")
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiLunSettingsEndpoint, params, "")
 	if err != nil {
 		return err
 	}
 	if statusCode != 200 {
-		return errors.New("status code not 200")
+		return c.newAPIError(c.iscsiLunSettingsEndpoint, "remove_lun", statusCode, "", xmlBytes, nil)
 	}
 
 	var xmlStruct StorageISCSIDeleteBlockLUNRespXML
@@ -604,7 +814,7 @@ func (c *Client) DeleteStorageISCSIBlockLUN(targetIndex int, runInBackground boo
 	}
 
 	if xmlStruct.Result != 0 {
-		return errors.New("unknown error occurred")
+		return c.newAPIError(c.iscsiLunSettingsEndpoint, "remove_lun", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, map[string]error{"-1": ErrNotFound})
 	}
 
 	return nil
@@ -616,20 +826,18 @@ type StorageISCSIAttachTargetLUNRespXML struct {
 }
 
 // AttachStorageISCSITargetLUN TODO(docs).
-func (c *Client) AttachStorageISCSITargetLUN(lunIndex, targetIndex int) error {
+func (c *Client) AttachStorageISCSITargetLUN(ctx context.Context, lunIndex, targetIndex int) error {
 	params := url.Values{}
-	params.Add("sid", c.getSid())
 	params.Add("func", "add_lun")
 	params.Add("LUNIndex", strconv.Itoa(lunIndex))
 	params.Add("targetIndex", strconv.Itoa(targetIndex))
-	endpoint := addParamsToURL(c.iscsiTargetSettingsEndpoint, params)
 
-	xmlBytes, statusCode, err := c.postFormReq(endpoint, "")
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiTargetSettingsEndpoint, params, "")
 	if err != nil {
 		return err
 	}
 	if statusCode != 200 {
-		return errors.New("status code not 200")
+		return c.newAPIError(c.iscsiTargetSettingsEndpoint, "add_lun", statusCode, "", xmlBytes, nil)
 	}
 
 	var xmlStruct StorageISCSIAttachTargetLUNRespXML
@@ -638,7 +846,302 @@ func (c *Client) AttachStorageISCSITargetLUN(lunIndex, targetIndex int) error {
 	}
 
 	if xmlStruct.Result != 0 {
-		return errors.New("unknown error occurred")
+		return c.newAPIError(c.iscsiTargetSettingsEndpoint, "add_lun", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, nil)
+	}
+
+	return nil
+}
+
+type StorageISCSISnapshotInfoXML struct {
+	ID         int    `xml:"snapshotID"`
+	Name       string `xml:"snapshot_name"`
+	LUNIndex   int    `xml:"LUNIndex"`
+	CreateTime int64  `xml:"create_time"` // Unix timestamp
+	Status     string `xml:"status"`
+	SizeBytes  uint64 `xml:"size_bytes"` // Space used by the snapshot, not the LUN size
+	Vital      string `xml:"vital"`
+}
+
+func (s *StorageISCSISnapshotInfoXML) StatusString() string {
+	switch s.Status {
+	case "0":
+		return "creating"
+	case "1":
+		return "ready"
+	case "2":
+		return "removing"
+	default:
+		return fmt.Sprintf("unknown snapshot status %s", s.Status)
+	}
+}
+
+type StorageISCSISnapshotListRespXML struct {
+	AuthPassed string                        `xml:"authPassed"`
+	Result     string                        `xml:"result"`
+	Snapshots  []StorageISCSISnapshotInfoXML `xml:"SnapshotList>row"`
+}
+
+// GetStorageISCSISnapshotList lists the snapshots taken of a LUN.
+func (c *Client) GetStorageISCSISnapshotList(ctx context.Context, lunIndex int) (StorageISCSISnapshotListRespXML, error) {
+	params := url.Values{}
+	params.Add("func", "extra_get")
+	params.Add("snapshot_list", "1")
+	params.Add("LUNIndex", strconv.Itoa(lunIndex))
+
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.snapshotEndpoint, params, "")
+	if err != nil {
+		return StorageISCSISnapshotListRespXML{}, err
+	}
+	if statusCode != 200 {
+		return StorageISCSISnapshotListRespXML{}, c.newAPIError(c.snapshotEndpoint, "extra_get", statusCode, "", xmlBytes, nil)
+	}
+
+	var xmlStruct StorageISCSISnapshotListRespXML
+	if err = xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return StorageISCSISnapshotListRespXML{}, err
+	}
+
+	if xmlStruct.Result != "0" {
+		return StorageISCSISnapshotListRespXML{}, c.newAPIError(c.snapshotEndpoint, "extra_get", statusCode, xmlStruct.Result, xmlBytes, nil)
+	}
+
+	return xmlStruct, nil
+}
+
+type StorageISCSICreateSnapshotRespXML struct {
+	AuthPassed string `xml:"authPassed"`
+	Result     int    `xml:"result"` // This is the snapshot ID
+}
+
+// CreateStorageISCSISnapshot takes a snapshot of a LUN, vital snapshots are never removed by the NAS's retention policy.
+func (c *Client) CreateStorageISCSISnapshot(ctx context.Context, lunIndex int, name string, vital bool) (int, error) {
+	params := url.Values{}
+
+	data := url.Values{}
+	data.Add("func", "create_snapshot")
+	data.Add("LUNIndex", strconv.Itoa(lunIndex))
+	data.Add("snapshot_name", name)
+	data.Add("vital", b2is(vital))
+
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.snapshotEndpoint, params, data.Encode())
+	if err != nil {
+		return 0, err
+	}
+	if statusCode != 200 {
+		return 0, c.newAPIError(c.snapshotEndpoint, "create_snapshot", statusCode, "", xmlBytes, nil)
+	}
+
+	var xmlStruct StorageISCSICreateSnapshotRespXML
+	if err = xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return 0, err
+	}
+
+	if xmlStruct.Result < 0 {
+		return 0, c.newAPIError(c.snapshotEndpoint, "create_snapshot", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, map[string]error{"-1": ErrNotFound, "-2": ErrAlreadyExists})
+	}
+
+	return xmlStruct.Result, nil
+}
+
+type StorageISCSIDeleteSnapshotRespXML struct {
+	AuthPassed string `xml:"authPassed"`
+	Result     int    `xml:"result"`
+}
+
+// DeleteStorageISCSISnapshot removes a snapshot.
+func (c *Client) DeleteStorageISCSISnapshot(ctx context.Context, snapshotID int) error {
+	params := url.Values{}
+	params.Add("func", "del_snapshot")
+	params.Add("snapshotID", strconv.Itoa(snapshotID))
+
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.snapshotEndpoint, params, "")
+	if err != nil {
+		return err
+	}
+	if statusCode != 200 {
+		return c.newAPIError(c.snapshotEndpoint, "del_snapshot", statusCode, "", xmlBytes, nil)
+	}
+
+	var xmlStruct StorageISCSIDeleteSnapshotRespXML
+	if err = xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return err
+	}
+
+	if xmlStruct.Result != 0 {
+		return c.newAPIError(c.snapshotEndpoint, "del_snapshot", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, map[string]error{"-1": ErrNotFound})
+	}
+
+	return nil
+}
+
+type StorageISCSICloneSnapshotRespXML struct {
+	AuthPassed string `xml:"authPassed"`
+	Result     int    `xml:"result"` // This is the new LUN index
+}
+
+// CloneStorageISCSISnapshot creates a new block based LUN called name from the contents of a snapshot, the new LUN lives
+// in the same storage pool as the snapshot and needs to be waited on like a freshly created LUN.
+func (c *Client) CloneStorageISCSISnapshot(ctx context.Context, snapshotID int, name string) (int, error) {
+	params := url.Values{}
+
+	data := url.Values{}
+	data.Add("func", "clone_snapshot")
+	data.Add("snapshotID", strconv.Itoa(snapshotID))
+	data.Add("clone_name", name)
+
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.snapshotEndpoint, params, data.Encode())
+	if err != nil {
+		return 0, err
+	}
+	if statusCode != 200 {
+		return 0, c.newAPIError(c.snapshotEndpoint, "clone_snapshot", statusCode, "", xmlBytes, nil)
+	}
+
+	var xmlStruct StorageISCSICloneSnapshotRespXML
+	if err = xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return 0, err
+	}
+
+	if xmlStruct.Result < 0 {
+		return 0, c.newAPIError(c.snapshotEndpoint, "clone_snapshot", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, map[string]error{"-1": ErrNotFound})
+	}
+
+	return xmlStruct.Result, nil
+}
+
+// LUNPermission is what an iSCSI ACL policy lets its initiator do with a LUN.
+type LUNPermission int
+
+const (
+	LUNPermissionReadOnly  LUNPermission = 0
+	LUNPermissionReadWrite LUNPermission = 1
+	LUNPermissionDeny      LUNPermission = 2
+)
+
+// DefaultPolicyIndex is the ACL policy which applies to initiators without a policy of their own, it can't be removed.
+const DefaultPolicyIndex = 0
+
+type StorageISCSIPolicyLUNXML struct {
+	LUNIndex   int           `xml:"LUNIndex"`
+	Permission LUNPermission `xml:"permission"`
+}
+
+type StorageISCSIPolicyInfoXML struct {
+	Index        int                        `xml:"policyIndex"`
+	Name         string                     `xml:"policyName"`
+	InitiatorIQN string                     `xml:"initiatorIQN"`
+	LUNs         []StorageISCSIPolicyLUNXML `xml:"LUNPermList>row"`
+}
+
+// LUNPermission returns the permission the policy gives for a LUN, ok is false if the policy doesn't mention the LUN.
+// The default policy gives read/write to LUNs it doesn't mention, other policies fall back to the default policy.
+func (p *StorageISCSIPolicyInfoXML) LUNPermission(lunIndex int) (permission LUNPermission, ok bool) {
+	for _, lun := range p.LUNs {
+		if lun.LUNIndex == lunIndex {
+			return lun.Permission, true
+		}
+	}
+	return LUNPermissionReadWrite, false
+}
+
+type StorageISCSIPolicyListRespXML struct {
+	AuthPassed string                      `xml:"authPassed"`
+	Result     string                      `xml:"result"`
+	Policies   []StorageISCSIPolicyInfoXML `xml:"policyInfo>row"`
+}
+
+// GetStorageISCSIPolicyList lists the iSCSI ACL policies, which is how the NAS does LUN masking. The default policy is
+// always first.
+func (c *Client) GetStorageISCSIPolicyList(ctx context.Context) (StorageISCSIPolicyListRespXML, error) {
+	params := url.Values{}
+	params.Add("func", "extra_get")
+	params.Add("policyList", "1")
+
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiPolicyEndpoint, params, "")
+	if err != nil {
+		return StorageISCSIPolicyListRespXML{}, err
+	}
+	if statusCode != 200 {
+		return StorageISCSIPolicyListRespXML{}, c.newAPIError(c.iscsiPolicyEndpoint, "extra_get", statusCode, "", xmlBytes, nil)
+	}
+
+	var xmlStruct StorageISCSIPolicyListRespXML
+	if err = xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return StorageISCSIPolicyListRespXML{}, err
+	}
+
+	if xmlStruct.Result != "0" {
+		return StorageISCSIPolicyListRespXML{}, c.newAPIError(c.iscsiPolicyEndpoint, "extra_get", statusCode, xmlStruct.Result, xmlBytes, nil)
+	}
+
+	return xmlStruct, nil
+}
+
+type StorageISCSICreatePolicyRespXML struct {
+	AuthPassed string `xml:"authPassed"`
+	Result     int    `xml:"result"` // This is the new policy index
+}
+
+// CreateStorageISCSIPolicy adds an ACL policy for an initiator, returning its index. New policies don't mention any
+// LUNs. Each initiator can only have one policy, creating a second returns ErrAlreadyExists.
+func (c *Client) CreateStorageISCSIPolicy(ctx context.Context, name, initiatorIQN string) (int, error) {
+	params := url.Values{}
+
+	data := url.Values{}
+	data.Add("func", "add_policy")
+	data.Add("policyName", name)
+	data.Add("initiatorIQN", initiatorIQN)
+
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiPolicyEndpoint, params, data.Encode())
+	if err != nil {
+		return 0, err
+	}
+	if statusCode != 200 {
+		return 0, c.newAPIError(c.iscsiPolicyEndpoint, "add_policy", statusCode, "", xmlBytes, nil)
+	}
+
+	var xmlStruct StorageISCSICreatePolicyRespXML
+	if err = xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return 0, err
+	}
+
+	if xmlStruct.Result < 0 {
+		return 0, c.newAPIError(c.iscsiPolicyEndpoint, "add_policy", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, map[string]error{"-2": ErrAlreadyExists})
+	}
+
+	return xmlStruct.Result, nil
+}
+
+type StorageISCSISetLUNPermissionRespXML struct {
+	AuthPassed string `xml:"authPassed"`
+	Result     int    `xml:"result"`
+}
+
+// SetStorageISCSILUNPermission sets what a policy's initiator can do with a LUN.
+func (c *Client) SetStorageISCSILUNPermission(ctx context.Context, policyIndex, lunIndex int, permission LUNPermission) error {
+	params := url.Values{}
+
+	data := url.Values{}
+	data.Add("func", "set_lun_perm")
+	data.Add("policyIndex", strconv.Itoa(policyIndex))
+	data.Add("LUNIndex", strconv.Itoa(lunIndex))
+	data.Add("permission", strconv.Itoa(int(permission)))
+
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.iscsiPolicyEndpoint, params, data.Encode())
+	if err != nil {
+		return err
+	}
+	if statusCode != 200 {
+		return c.newAPIError(c.iscsiPolicyEndpoint, "set_lun_perm", statusCode, "", xmlBytes, nil)
+	}
+
+	var xmlStruct StorageISCSISetLUNPermissionRespXML
+	if err = xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return err
+	}
+
+	if xmlStruct.Result != 0 {
+		return c.newAPIError(c.iscsiPolicyEndpoint, "set_lun_perm", statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, map[string]error{"-1": ErrNotFound})
 	}
 
 	return nil
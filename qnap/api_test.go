@@ -1,14 +1,26 @@
 package qnap
 
 import (
-	"fmt"
+	"context"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
 	"math/rand"
-	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/terrycain/qnap-csi/qnap/qnaptest"
 )
 
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+const (
+	letterBytes  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	testUsername = "admin"
+	testPassword = "password"
+)
 
 func RandStringBytes(n int) string {
 	b := make([]byte, n)
@@ -19,174 +31,332 @@ func RandStringBytes(n int) string {
 	return string(b)
 }
 
-func TestClient_Login(t *testing.T) {
-	username := os.Getenv("QNAP_USER")
-	password := os.Getenv("QNAP_PASS")
-	baseURL := os.Getenv("QNAP_URL")
+func newTestServer(t *testing.T) *qnaptest.Server {
+	t.Helper()
+
+	srv := qnaptest.NewServer(testUsername, testPassword)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func getLoggedInClient(t *testing.T, srv *qnaptest.Server) *Client {
+	t.Helper()
 
-	c, err := NewClient(username, password, baseURL)
+	ctx := context.Background()
+	c, err := NewClient(testUsername, testPassword, srv.URL)
 	if err != nil {
 		t.Fatalf("failed to init client: %#v", err)
 	}
 
-	if err = c.Login(); err != nil {
-		t.Fatalf("failed to init client: %#v", err)
+	if err = c.Login(ctx); err != nil {
+		t.Fatalf("failed to login: %#v", err)
+	}
+	return c
+}
+
+func waitForLUN(t *testing.T, c *Client, lunIndex int) StorageISCSILUNRespXML {
+	t.Helper()
+
+	ctx := context.Background()
+	for {
+		lunInfo, err := c.GetStorageISCSILun(ctx, lunIndex)
+		if err != nil {
+			t.Fatalf("failed to get lun info: %#v", err)
+		}
+		if lunInfo.StatusString() == "creating" {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		return lunInfo
 	}
 }
 
-func getLoggedInClient() (*Client, error) {
-	username := os.Getenv("QNAP_USER")
-	password := os.Getenv("QNAP_PASS")
-	baseURL := os.Getenv("QNAP_URL")
+func TestClient_Login(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
 
-	c, err := NewClient(username, password, baseURL)
+	c, err := NewClient(testUsername, testPassword, srv.URL)
 	if err != nil {
-		return &Client{}, err
+		t.Fatalf("failed to init client: %#v", err)
 	}
 
-	if err = c.Login(); err != nil {
-		return &Client{}, err
+	if err = c.Login(ctx); err != nil {
+		t.Fatalf("failed to login: %#v", err)
 	}
-	return c, nil
 }
 
-func TestClient_GetStoragePoolSubscription(t *testing.T) {
-	c, err := getLoggedInClient()
+func TestClient_LoginInvalidPassword(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+
+	c, err := NewClient(testUsername, "wrong", srv.URL)
 	if err != nil {
 		t.Fatalf("failed to init client: %#v", err)
 	}
 
-	_, err = c.GetStoragePoolSubscription(1)
+	if err = c.Login(ctx); !errors.Is(err, ErrAuth) {
+		t.Fatalf("login with an invalid password should return ErrAuth, got %#v", err)
+	}
+}
+
+func TestClient_TLS(t *testing.T) {
+	ctx := context.Background()
+	srv := qnaptest.NewTLSServer(testUsername, testPassword)
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	caBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caBytes, 0o600); err != nil {
+		t.Fatalf("failed to write CA bundle: %#v", err)
+	}
+
+	tests := []struct {
+		name    string
+		options TLSOptions
+		wantErr bool
+	}{
+		{name: "system roots", options: TLSOptions{}, wantErr: true},
+		{name: "ca bundle", options: TLSOptions{CAFile: caFile}},
+		{name: "insecure", options: TLSOptions{InsecureSkipVerify: true}},
+	}
+
+	for _, table := range tests {
+		c, err := NewClientWithTLS(testUsername, testPassword, srv.URL, table.options)
+		if err != nil {
+			t.Fatalf("%s: failed to init client: %#v", table.name, err)
+		}
+		if err = c.Login(ctx); (err != nil) != table.wantErr {
+			t.Fatalf("%s: unexpected login result: %#v", table.name, err)
+		}
+	}
+
+	if _, err := NewClientWithTLS(testUsername, testPassword, srv.URL, TLSOptions{MinVersion: "1.4"}); err == nil {
+		t.Fatal("invalid minimum TLS version should return an error")
+	}
+	if _, err := NewClientWithTLS(testUsername, testPassword, srv.URL, TLSOptions{CertFile: caFile}); err == nil {
+		t.Fatal("client certificate without a key should return an error")
+	}
+}
+
+func TestClient_DroppedConnection(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	srv.DropConnections(1)
+	if _, err := c.GetStorageISCSITargetList(ctx); err == nil {
+		t.Fatal("dropped connection should return an error")
+	}
+
+	if _, err := c.GetStorageISCSITargetList(ctx); err != nil {
+		t.Fatalf("failed to get target list: %#v", err)
+	}
+}
+
+func TestClient_GetStoragePoolSubscription(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	resp, err := c.GetStoragePoolSubscription(ctx, 1)
 	if err != nil {
-		t.Fatalf("failed to init client: %#v", err)
+		t.Fatalf("failed to get storage pool: %#v", err)
+	}
+	if resp.PoolSubscription.CapacityBytes != qnaptest.DefaultStoragePoolCapacity {
+		t.Fatalf("capacity %d != %d", resp.PoolSubscription.CapacityBytes, qnaptest.DefaultStoragePoolCapacity)
 	}
 
-	_, err = c.GetStoragePoolSubscription(2)
-	if err == nil {
-		t.Fatal("invalid storage pool should return an error")
+	_, err = c.GetStoragePoolSubscription(ctx, 2)
+	if !errors.Is(err, ErrInvalidPool) {
+		t.Fatalf("invalid storage pool should return ErrInvalidPool, got %#v", err)
 	}
 }
 
 func TestClient_GetStorageLogicalVolumes(t *testing.T) {
-	c, err := getLoggedInClient()
-	if err != nil {
-		t.Fatalf("failed to init client: %#v", err)
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	if _, err := c.CreateStorageISCSIBlockLUN(ctx, "test1", 1, 10, false, 512, false, false, false, false); err != nil {
+		t.Fatalf("failed to create lun: %#v", err)
 	}
 
-	_, err = c.GetStorageLogicalVolumes()
+	resp, err := c.GetStorageLogicalVolumes(ctx)
 	if err != nil {
 		t.Fatalf("failed to get logical volumes: %#v", err)
 	}
+	if len(resp.Volumes) != 1 {
+		t.Fatalf("expected 1 logical volume, got %d", len(resp.Volumes))
+	}
 }
 
 func TestClient_GetStorageISCSILuns(t *testing.T) {
-	c, err := getLoggedInClient()
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	lunInfo, err := c.GetStorageISCSILun(ctx, 0)
 	if err != nil {
-		t.Fatalf("failed to init client: %#v", err)
+		t.Fatalf("failed to get lun info: %#v", err)
+	}
+	if lunInfo.StatusString() != "not_found" {
+		t.Fatalf("missing lun status %s != not_found", lunInfo.StatusString())
 	}
 
-	_, err = c.GetStorageISCSILun(0)
+	resp, err := c.CreateStorageISCSIBlockLUN(ctx, "test1", 1, 10, false, 512, false, false, false, false)
 	if err != nil {
-		t.Fatalf("failed to get lun info: %#v", err)
+		t.Fatalf("failed to create lun: %#v", err)
+	}
+
+	lunInfo = waitForLUN(t, c, resp.Result)
+	if lunInfo.Name != "test1" {
+		t.Fatalf("lun name %s != test1", lunInfo.Name)
+	}
+	// The NAS adds a newline to the capacity which should be stripped
+	if lunInfo.Capacity != "10" {
+		t.Fatalf("lun capacity %q != 10", lunInfo.Capacity)
 	}
 }
 
 func TestClient_GetStorageISCSITargetList(t *testing.T) {
-	c, err := getLoggedInClient()
-	if err != nil {
-		t.Fatalf("failed to init client: %#v", err)
-	}
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
 
-	_, err = c.GetStorageISCSITargetList()
+	_, err := c.GetStorageISCSITargetList(ctx)
 	if err != nil {
 		t.Fatalf("failed to get target list: %#v", err)
 	}
 }
 
 func TestClient_CreateDeleteStorageISCSITarget(t *testing.T) {
-	c, err := getLoggedInClient()
-	if err != nil {
-		t.Fatalf("failed to init client: %#v", err)
-	}
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
 
-	targetIndex, err := c.CreateStorageISCSITarget("test1", false, false, true)
+	targetIndex, err := c.CreateStorageISCSITarget(ctx, "test1", false, false, true)
 	if err != nil {
 		t.Fatalf("failed to create target: %#v", err)
 	}
-	err = c.CreateStorageISCSIInitiator(targetIndex, false, "", "", false, "", "")
+	err = c.CreateStorageISCSIInitiator(ctx, targetIndex, false, "", "", false, "", "")
 	if err != nil {
 		t.Fatalf("failed to create initiator: %#v", err)
 	}
 
-	if err = c.DeleteStorageISCSITarget(targetIndex); err != nil {
-		t.Fatalf("failed to delete initiator: %#v", err)
+	if err = c.DeleteStorageISCSITarget(ctx, targetIndex); err != nil {
+		t.Fatalf("failed to delete target: %#v", err)
+	}
+
+	if len(srv.Targets()) != 0 {
+		t.Fatal("target was not deleted")
 	}
 }
 
 func TestClient_CreateDeleteStorageISCSIBlockLun(t *testing.T) {
-	c, err := getLoggedInClient()
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	resp, err := c.CreateStorageISCSIBlockLUN(ctx, "test2", 1, 10, false, 512, false, false, false, false)
 	if err != nil {
-		t.Fatalf("failed to init client: %#v", err)
+		t.Fatalf("failed to create lun: %#v", err)
 	}
 
-	resp, err := c.CreateStorageISCSIBlockLUN("test2", 1, 10, false, 512, false, false, false, false)
+	waitForLUN(t, c, resp.Result)
+
+	listResp, err := c.GetStorageISCSILunList(ctx)
 	if err != nil {
-		t.Fatalf("failed to create target: %#v", err)
+		t.Fatalf("failed to list luns: %#v", err)
+	}
+	if len(listResp.LUNs) != 1 || listResp.LUNs[0].Index != resp.Result || listResp.LUNs[0].Name != "test2" || listResp.LUNs[0].Capacity != "10" {
+		t.Fatalf("unexpected lun list %#v", listResp.LUNs)
 	}
 
-	for {
-		lunInfo, err2 := c.GetStorageISCSILun(resp.Result)
-		if err2 != nil {
-			t.Fatalf("failed to create target: %#v", err2)
-		}
-		if lunInfo.StatusString() == "creating" {
-			fmt.Println("lun still creating")
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		break
+	if err = c.DeleteStorageISCSIBlockLUN(ctx, resp.Result, false); err != nil {
+		t.Fatalf("failed to delete lun: %#v", err)
 	}
 
-	if err = c.DeleteStorageISCSIBlockLUN(resp.Result, false); err != nil {
-		t.Fatalf("failed to delete initiator: %#v", err)
+	if len(srv.LUNs()) != 0 {
+		t.Fatal("lun was not deleted")
 	}
 }
 
-func TestClient_CreateAttachStorageISCSITargetBlockLun(t *testing.T) {
-	c, err := getLoggedInClient()
+func TestClient_CreateDuplicateStorageISCSIBlockLun(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	if _, err := c.CreateStorageISCSIBlockLUN(ctx, "test2", 1, 10, false, 512, false, false, false, false); err != nil {
+		t.Fatalf("failed to create lun: %#v", err)
+	}
+
+	if _, err := c.CreateStorageISCSIBlockLUN(ctx, "test2", 1, 10, false, 512, false, false, false, false); err == nil {
+		t.Fatal("creating a lun with a duplicate name should return an error")
+	}
+}
+
+func TestClient_ExpandStorageISCSIBlockLun(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	resp, err := c.CreateStorageISCSIBlockLUN(ctx, "test3", 1, 10, false, 512, false, false, false, false)
 	if err != nil {
-		t.Fatalf("failed to init client: %#v", err)
+		t.Fatalf("failed to create lun: %#v", err)
+	}
+	waitForLUN(t, c, resp.Result)
+
+	if err = c.ExpandStorageISCSIBlockLUN(ctx, resp.Result, 20); err != nil {
+		t.Fatalf("failed to expand lun: %#v", err)
 	}
 
+	lunInfo := waitForLUN(t, c, resp.Result)
+	if lunInfo.CapacityBytes != "21474836480" {
+		t.Fatalf("lun capacity %s != 21474836480", lunInfo.CapacityBytes)
+	}
+
+	if err = c.ExpandStorageISCSIBlockLUN(ctx, resp.Result, 5); err == nil {
+		t.Fatal("shrinking a lun should return an error")
+	}
+}
+
+func TestClient_CreateAttachStorageISCSITargetBlockLun(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
 	name := "apitest" + RandStringBytes(5)
 
-	targetIndex, err := c.CreateStorageISCSITarget(name, false, false, true)
+	targetIndex, err := c.CreateStorageISCSITarget(ctx, name, false, false, true)
 	if err != nil {
 		t.Fatalf("failed to create target: %#v", err)
 	}
-	err = c.CreateStorageISCSIInitiator(targetIndex, false, "", "", false, "", "")
+	err = c.CreateStorageISCSIInitiator(ctx, targetIndex, false, "", "", false, "", "")
 	if err != nil {
 		t.Fatalf("failed to create initiator: %#v", err)
 	}
 
-	lunResp, err := c.CreateStorageISCSIBlockLUN(name, 1, 10, false, 512, false, false, false, false)
+	lunResp, err := c.CreateStorageISCSIBlockLUN(ctx, name, 1, 10, false, 512, false, false, false, false)
 	if err != nil {
-		t.Fatalf("failed to create target: %#v", err)
+		t.Fatalf("failed to create lun: %#v", err)
 	}
 
-	err = c.AttachStorageISCSITargetLUN(lunResp.Result, targetIndex)
+	err = c.AttachStorageISCSITargetLUN(ctx, lunResp.Result, targetIndex)
 	if err != nil {
-		t.Fatalf("failed to create target: %#v", err)
+		t.Fatalf("failed to attach lun: %#v", err)
 	}
 
-	targetResp, err := c.GetStorageISCSITargetList()
+	targetResp, err := c.GetStorageISCSITargetList(ctx)
 	if err != nil {
-		t.Fatalf("failed to create target: %#v", err)
+		t.Fatalf("failed to get target list: %#v", err)
 	}
 	found := false
 	for _, target := range targetResp.Targets {
 		if target.TargetIndex == targetIndex {
 			found = true
+			if !strings.Contains(target.IQN, name) {
+				t.Fatalf("target iqn %s does not contain %s", target.IQN, name)
+			}
 			if len(target.TargetLUNs) != 1 {
 				t.Fatal("target luns list is not 1")
 			}
@@ -199,23 +369,326 @@ func TestClient_CreateAttachStorageISCSITargetBlockLun(t *testing.T) {
 		t.Fatal("failed to find target")
 	}
 
-	for {
-		lunInfo, err2 := c.GetStorageISCSILun(lunResp.Result)
-		if err2 != nil {
-			t.Fatalf("failed to create target: %#v", err2)
-		}
-		if lunInfo.StatusString() == "creating" {
-			time.Sleep(1 * time.Second)
-			continue
-		}
-		break
+	lunInfo := waitForLUN(t, c, lunResp.Result)
+	if len(lunInfo.Targets) != 1 || lunInfo.Targets[0].TargetIndex != strconv.Itoa(targetIndex) {
+		t.Fatalf("lun targets %#v do not contain %d", lunInfo.Targets, targetIndex)
+	}
+
+	if err = c.DeleteStorageISCSITarget(ctx, targetIndex); err != nil {
+		t.Fatalf("failed to delete target: %#v", err)
+	}
+
+	if err = c.DeleteStorageISCSIBlockLUN(ctx, lunResp.Result, false); err != nil {
+		t.Fatalf("failed to delete lun: %#v", err)
+	}
+}
+
+func TestClient_CreateCloneDeleteStorageISCSISnapshot(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	lunResp, err := c.CreateStorageISCSIBlockLUN(ctx, "test4", 1, 10, false, 512, false, false, false, false)
+	if err != nil {
+		t.Fatalf("failed to create lun: %#v", err)
 	}
+	waitForLUN(t, c, lunResp.Result)
 
-	if err = c.DeleteStorageISCSITarget(targetIndex); err != nil {
-		t.Fatalf("failed to delete initiator: %#v", err)
+	snapshotID, err := c.CreateStorageISCSISnapshot(ctx, lunResp.Result, "snap1", true)
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %#v", err)
 	}
 
-	if err = c.DeleteStorageISCSIBlockLUN(lunResp.Result, false); err != nil {
-		t.Fatalf("failed to delete initiator: %#v", err)
+	snapshotResp, err := c.GetStorageISCSISnapshotList(ctx, lunResp.Result)
+	if err != nil {
+		t.Fatalf("failed to list snapshots: %#v", err)
+	}
+	if len(snapshotResp.Snapshots) != 1 || snapshotResp.Snapshots[0].ID != snapshotID || snapshotResp.Snapshots[0].Name != "snap1" {
+		t.Fatalf("unexpected snapshot list %#v", snapshotResp.Snapshots)
+	}
+
+	cloneIndex, err := c.CloneStorageISCSISnapshot(ctx, snapshotID, "test4clone")
+	if err != nil {
+		t.Fatalf("failed to clone snapshot: %#v", err)
+	}
+	cloneInfo := waitForLUN(t, c, cloneIndex)
+	if cloneInfo.Name != "test4clone" || cloneInfo.Capacity != "10" {
+		t.Fatalf("unexpected clone %s with capacity %s", cloneInfo.Name, cloneInfo.Capacity)
+	}
+
+	if err = c.DeleteStorageISCSISnapshot(ctx, snapshotID); err != nil {
+		t.Fatalf("failed to delete snapshot: %#v", err)
+	}
+	if len(srv.Snapshots()) != 0 {
+		t.Fatal("snapshot was not deleted")
+	}
+}
+
+func TestClient_StorageISCSIPolicies(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	lunResp, err := c.CreateStorageISCSIBlockLUN(ctx, "test5", 1, 10, false, 512, false, false, false, false)
+	if err != nil {
+		t.Fatalf("failed to create lun: %#v", err)
+	}
+	waitForLUN(t, c, lunResp.Result)
+
+	const iqn = "iqn.1993-08.org.debian:01:node1"
+	policyIndex, err := c.CreateStorageISCSIPolicy(ctx, "node1", iqn)
+	if err != nil {
+		t.Fatalf("failed to create policy: %#v", err)
+	}
+	if _, err = c.CreateStorageISCSIPolicy(ctx, "node1again", iqn); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected ErrAlreadyExists for a second policy, got %#v", err)
+	}
+
+	if err = c.SetStorageISCSILUNPermission(ctx, DefaultPolicyIndex, lunResp.Result, LUNPermissionDeny); err != nil {
+		t.Fatalf("failed to set default permission: %#v", err)
+	}
+	if err = c.SetStorageISCSILUNPermission(ctx, policyIndex, lunResp.Result, LUNPermissionReadWrite); err != nil {
+		t.Fatalf("failed to set permission: %#v", err)
+	}
+	if err = c.SetStorageISCSILUNPermission(ctx, policyIndex+1, lunResp.Result, LUNPermissionReadWrite); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing policy, got %#v", err)
+	}
+
+	policyResp, err := c.GetStorageISCSIPolicyList(ctx)
+	if err != nil {
+		t.Fatalf("failed to list policies: %#v", err)
+	}
+	if len(policyResp.Policies) != 2 {
+		t.Fatalf("expected 2 policies, got %#v", policyResp.Policies)
+	}
+	if permission, ok := policyResp.Policies[0].LUNPermission(lunResp.Result); !ok || permission != LUNPermissionDeny {
+		t.Fatalf("expected: %v, got: %v", LUNPermissionDeny, permission)
+	}
+	if permission, ok := policyResp.Policies[1].LUNPermission(lunResp.Result); policyResp.Policies[1].InitiatorIQN != iqn || !ok || permission != LUNPermissionReadWrite {
+		t.Fatalf("unexpected policy %#v", policyResp.Policies[1])
+	}
+}
+
+func TestClient_APIErrors(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	_, err := c.CreateStorageISCSIBlockLUN(ctx, "test5", 2, 10, false, 512, false, false, false, false)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an APIError, got %#v", err)
+	}
+	if apiErr.Endpoint != "iscsi_lun_setting.cgi" || apiErr.Func != "add_lun" || apiErr.Result != "-1" || !errors.Is(err, ErrInvalidPool) {
+		t.Fatalf("unexpected error %#v", apiErr)
+	}
+
+	if err = c.DeleteStorageISCSITarget(ctx, 1234); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting a missing target should return ErrNotFound, got %#v", err)
+	}
+	if err = c.DeleteStorageISCSISnapshot(ctx, 1234); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting a missing snapshot should return ErrNotFound, got %#v", err)
+	}
+
+	lunResp, err := c.CreateStorageISCSIBlockLUN(ctx, "test5", 1, 10, false, 512, false, false, false, false)
+	if err != nil {
+		t.Fatalf("failed to create lun: %#v", err)
+	}
+	waitForLUN(t, c, lunResp.Result)
+
+	if _, err = c.CreateStorageISCSISnapshot(ctx, lunResp.Result, "snap1", false); err != nil {
+		t.Fatalf("failed to create snapshot: %#v", err)
+	}
+	if _, err = c.CreateStorageISCSISnapshot(ctx, lunResp.Result, "snap1", false); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("duplicate snapshot should return ErrAlreadyExists, got %#v", err)
+	}
+
+	// Shrinking fails with a result code the client doesn't know about
+	err = c.ExpandStorageISCSIBlockLUN(ctx, lunResp.Result, 5)
+	if !errors.As(err, &apiErr) || apiErr.Err != nil || apiErr.Func != "edit_lun" {
+		t.Fatalf("unexpected error %#v", err)
+	}
+}
+
+func TestClient_APIErrorsDuplicateTargetMissingLUN(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	srv.RejectDuplicateTargets = true
+	srv.RejectMissingLUNs = true
+	c := getLoggedInClient(t, srv)
+
+	if _, err := c.CreateStorageISCSITarget(ctx, "test6", false, false, true); err != nil {
+		t.Fatalf("failed to create target: %#v", err)
+	}
+	if _, err := c.CreateStorageISCSITarget(ctx, "test6", false, false, true); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("duplicate target should return ErrAlreadyExists, got %#v", err)
+	}
+	if len(srv.Targets()) != 1 {
+		t.Fatalf("expected 1 target, got %d", len(srv.Targets()))
+	}
+
+	if err := c.DeleteStorageISCSIBlockLUN(ctx, 1234, false); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting a missing lun should return ErrNotFound, got %#v", err)
+	}
+}
+
+func TestClient_SessionRenewal(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+
+	c, err := NewClient(testUsername, testPassword, srv.URL)
+	if err != nil {
+		t.Fatalf("failed to init client: %#v", err)
+	}
+
+	// No explicit login, the client should start a session itself
+	if _, err = c.GetStorageISCSITargetList(ctx); err != nil {
+		t.Fatalf("failed to get target list: %#v", err)
+	}
+	if count := srv.RequestCount("authLogin.cgi"); count != 1 {
+		t.Fatalf("expected 1 login, got %d", count)
+	}
+
+	srv.ExpireSessions()
+	if _, err = c.GetStorageISCSITargetList(ctx); err != nil {
+		t.Fatalf("failed to get target list after session expired: %#v", err)
+	}
+	if count := srv.RequestCount("authLogin.cgi"); count != 2 {
+		t.Fatalf("expected 2 logins, got %d", count)
+	}
+}
+
+func TestClient_ConcurrentSessionRenewal(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	srv.ExpireSessions()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.GetStorageISCSITargetList(ctx); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("failed to get target list: %#v", err)
+	}
+
+	// One login from getLoggedInClient, then only one more no matter how many requests saw the expired sid
+	if count := srv.RequestCount("authLogin.cgi"); count != 2 {
+		t.Fatalf("expected 2 logins, got %d", count)
+	}
+}
+
+func TestClient_SessionRenewalInvalidPassword(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+
+	c, err := NewClient(testUsername, "wrong", srv.URL)
+	if err != nil {
+		t.Fatalf("failed to init client: %#v", err)
+	}
+
+	if _, err = c.GetStorageISCSITargetList(ctx); !errors.Is(err, ErrAuth) {
+		t.Fatalf("request with an invalid password should return ErrAuth, got %#v", err)
+	}
+}
+
+func TestClient_ContextDeadline(t *testing.T) {
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	srv.SetDelay(5 * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.GetStorageISCSITargetList(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %#v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("request did not honour the context deadline")
+	}
+}
+
+type observedRequest struct {
+	cgi        string
+	function   string
+	statusCode int
+}
+
+type recordingObserver struct {
+	mu       sync.Mutex
+	requests []observedRequest
+	errors   []*APIError
+	logins   int
+}
+
+func (o *recordingObserver) ObserveRequest(cgi, function string, statusCode int, duration time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests = append(o.requests, observedRequest{cgi: cgi, function: function, statusCode: statusCode})
+}
+
+func (o *recordingObserver) ObserveError(err *APIError) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.errors = append(o.errors, err)
+}
+
+func (o *recordingObserver) ObserveLogin(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.logins++
+}
+
+func TestClient_Observer(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+
+	c, err := NewClient(testUsername, testPassword, srv.URL)
+	if err != nil {
+		t.Fatalf("failed to init client: %#v", err)
+	}
+	observer := &recordingObserver{}
+	c.SetObserver(observer)
+
+	if _, err = c.GetStorageISCSITargetList(ctx); err != nil {
+		t.Fatalf("failed to get target list: %#v", err)
+	}
+
+	expected := []observedRequest{
+		{cgi: "authLogin.cgi", function: "login", statusCode: 200},
+		{cgi: "iscsi_portal_setting.cgi", function: "extra_get", statusCode: 200},
+	}
+	if len(observer.requests) != len(expected) {
+		t.Fatalf("expected: %v, got: %v", expected, observer.requests)
+	}
+	for i := range expected {
+		if observer.requests[i] != expected[i] {
+			t.Fatalf("expected: %v, got: %v", expected[i], observer.requests[i])
+		}
+	}
+	if observer.logins != 1 {
+		t.Fatalf("expected: %v, got: %v", 1, observer.logins)
+	}
+
+	// Failures reported with a 200 status are observed once they're APIErrors
+	if err = c.DeleteStorageISCSITarget(ctx, 1234); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %#v", err)
+	}
+	if len(observer.errors) != 1 || observer.errors[0] != err {
+		t.Fatalf("expected the error to be observed, got %v", observer.errors)
 	}
 }
@@ -0,0 +1,87 @@
+package qnap
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+)
+
+// maxErrorBodyLength is how much of a response body is kept in an APIError.
+const maxErrorBodyLength = 256
+
+var (
+	// ErrAuth means the NAS rejected the credentials, or kept rejecting the session after logging in again.
+	ErrAuth = errors.New("authentication failed")
+	// ErrInvalidPool means the storage pool does not exist.
+	ErrInvalidPool = errors.New("invalid storage pool")
+	// ErrInvalidVolume means the volume a shared folder was to be created on does not exist.
+	ErrInvalidVolume = errors.New("invalid volume")
+	// ErrNotFound means the target, LUN, snapshot or shared folder being operated on does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists means something with the same name already exists.
+	ErrAlreadyExists = errors.New("already exists")
+)
+
+// APIError is returned when the NAS responds with a non 200 status code or a result code indicating failure. Err is
+// one of the sentinel errors above when the result code is known, so errors.Is can be used to tell failures apart.
+type APIError struct {
+	// Endpoint is the CGI script, e.g. iscsi_lun_setting.cgi
+	Endpoint string
+	// Func is the function the CGI script was asked to perform, e.g. add_lun
+	Func       string
+	StatusCode int
+	// Result is the raw result code from the response, if there was one
+	Result string
+	// Body is the start of the response body
+	Body string
+	Err  error
+}
+
+func (e *APIError) Error() string {
+	msg := e.Endpoint + " " + e.Func
+	switch {
+	case e.Err != nil:
+		msg += ": " + e.Err.Error()
+	case e.StatusCode != 200:
+		msg += fmt.Sprintf(": status code %d not 200", e.StatusCode)
+	default:
+		msg += ": unknown error occurred"
+	}
+
+	if e.Result != "" {
+		msg += fmt.Sprintf(" (result %s)", e.Result)
+	}
+
+	return msg
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// newAPIError builds an APIError for a failed request and tells the observer about it, knownResults maps the result
+// codes the caller understands to sentinel errors.
+func (c *Client) newAPIError(endpoint, fn string, statusCode int, result string, body []byte, knownResults map[string]error) *APIError {
+	cgi := endpoint
+	if parsedURL, err := url.Parse(endpoint); err == nil {
+		cgi = path.Base(parsedURL.Path)
+	}
+
+	if len(body) > maxErrorBodyLength {
+		body = body[:maxErrorBodyLength]
+	}
+
+	apiErr := &APIError{
+		Endpoint:   cgi,
+		Func:       fn,
+		StatusCode: statusCode,
+		Result:     result,
+		Body:       string(body),
+		Err:        knownResults[result],
+	}
+	if c.observer != nil {
+		c.observer.ObserveError(apiErr)
+	}
+	return apiErr
+}
@@ -0,0 +1,1006 @@
+// Package qnaptest provides a fake QNAP NAS which speaks enough of the CGI API for the qnap client to be tested
+// without real hardware.
+package qnaptest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultStoragePoolID is the storage pool every new Server starts with.
+	DefaultStoragePoolID = 1
+	// DefaultStoragePoolCapacity is the size of the default storage pool in bytes.
+	DefaultStoragePoolCapacity uint64 = 1 << 40
+	// DefaultVolumeIndex is the volume shared folders can be created on in every new Server.
+	DefaultVolumeIndex = 1
+
+	giB = 1 << 30
+)
+
+// Target is an iSCSI target held by the fake NAS.
+type Target struct {
+	Index int
+	Name  string
+	IQN   string
+	LUNs  []int
+
+	// CHAP credentials initiators have to log in with, and mutual CHAP ones the target logs in to initiators with
+	CHAPUsername       string
+	CHAPPassword       string
+	MutualCHAPUsername string
+	MutualCHAPPassword string
+
+	// Connections are the IQNs of the initiators logged in to the target, one per session
+	Connections []string
+	Offline     bool
+}
+
+// LUN is a block based LUN held by the fake NAS.
+type LUN struct {
+	Index         int
+	Name          string
+	CapacityGB    int
+	StoragePoolID int
+	ThinAllocate  bool
+	SectorSize    int
+
+	// Number of lun_info polls left before the LUN stops reporting that it's creating
+	creatingPolls int
+}
+
+// Snapshot is a LUN snapshot held by the fake NAS.
+type Snapshot struct {
+	ID         int
+	Name       string
+	LUNIndex   int
+	CreateTime time.Time
+	Vital      bool
+}
+
+// Policy is an iSCSI ACL policy held by the fake NAS, LUNs maps LUN indexes to the permission the policy gives. The
+// default policy has index 0 and no initiator.
+type Policy struct {
+	Index        int
+	Name         string
+	InitiatorIQN string
+	LUNs         map[int]int
+}
+
+// SharedFolder is a shared folder held by the fake NAS, NFSHosts are who it is exported to, none if NFS is off, and
+// UserAccess the access each user has been given, e.g. "rw".
+type SharedFolder struct {
+	Name        string
+	VolumeIndex int
+	QuotaGB     int
+	NFSHosts    []string
+	NFSSquash   string
+	UserAccess  map[string]string
+}
+
+// Server is a fake QNAP NAS. It keeps targets, LUNs and snapshots in memory and mimics the quirks of the real thing,
+// like dropping the connection when a LUN name is reused.
+type Server struct {
+	*httptest.Server
+
+	// LUNCreatingPolls is how many times a new LUN reports it is still being created before becoming ready.
+	LUNCreatingPolls int
+	// RejectDuplicateTargets makes add_target fail with result -2 for a name that's already taken, instead of creating
+	// another target with it.
+	RejectDuplicateTargets bool
+	// RejectMissingLUNs makes remove_lun fail with result -1 for a LUN that doesn't exist, instead of succeeding.
+	RejectMissingLUNs bool
+	// FailClones makes clone_snapshot fail with a result code the client doesn't know, like running out of space would.
+	FailClones bool
+
+	username string
+	password string
+
+	mu             sync.Mutex
+	sessions       map[string]bool
+	pools          map[int]uint64
+	targets        map[int]*Target
+	luns           map[int]*LUN
+	snapshots      map[int]*Snapshot
+	policies       map[int]*Policy
+	volumes        map[int]bool
+	sharedFolders  map[string]*SharedFolder
+	users          map[string]string
+	nextTarget     int
+	nextLUN        int
+	nextSnapshot   int
+	nextPolicy     int
+	dropNext       int
+	delay          time.Duration
+	requestCounter map[string]int
+}
+
+// NewServer starts a fake NAS which accepts the given credentials, call Close when done.
+func NewServer(username, password string) *Server {
+	s := newServer(username, password)
+	s.Server = httptest.NewServer(s.mux())
+	return s
+}
+
+// NewTLSServer is NewServer over HTTPS, the server's certificate is self signed and available from Certificate().
+func NewTLSServer(username, password string) *Server {
+	s := newServer(username, password)
+	s.Server = httptest.NewTLSServer(s.mux())
+	return s
+}
+
+func newServer(username, password string) *Server {
+	return &Server{
+		LUNCreatingPolls: 1,
+		username:         username,
+		password:         password,
+		sessions:         map[string]bool{},
+		pools:            map[int]uint64{DefaultStoragePoolID: DefaultStoragePoolCapacity},
+		targets:          map[int]*Target{},
+		luns:             map[int]*LUN{},
+		snapshots:        map[int]*Snapshot{},
+		policies:         map[int]*Policy{0: {Index: 0, Name: "Default Policy", LUNs: map[int]int{}}},
+		nextPolicy:       1,
+		volumes:          map[int]bool{DefaultVolumeIndex: true},
+		sharedFolders:    map[string]*SharedFolder{},
+		users:            map[string]string{},
+		requestCounter:   map[string]int{},
+	}
+}
+
+func (s *Server) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/authLogin.cgi", s.handleLogin)
+	mux.HandleFunc("/cgi-bin/disk/disk_manage.cgi", s.authed(s.handleDiskManage))
+	mux.HandleFunc("/cgi-bin/disk/iscsi_portal_setting.cgi", s.authed(s.handlePortalSetting))
+	mux.HandleFunc("/cgi-bin/disk/iscsi_target_setting.cgi", s.authed(s.handleTargetSetting))
+	mux.HandleFunc("/cgi-bin/disk/iscsi_lun_setting.cgi", s.authed(s.handleLUNSetting))
+	mux.HandleFunc("/cgi-bin/disk/snapshot.cgi", s.authed(s.handleSnapshot))
+	mux.HandleFunc("/cgi-bin/disk/iscsi_policy_setting.cgi", s.authed(s.handlePolicySetting))
+	mux.HandleFunc("/cgi-bin/priv/privRights.cgi", s.authed(s.handlePrivRights))
+	return mux
+}
+
+// AddStoragePool adds (or resizes) a storage pool.
+func (s *Server) AddStoragePool(poolID int, capacityBytes uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pools[poolID] = capacityBytes
+}
+
+// ConnectInitiator adds a session from an initiator to a target, as if it had logged in.
+func (s *Server) ConnectInitiator(targetIndex int, initiatorIQN string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if target, ok := s.targets[targetIndex]; ok {
+		target.Connections = append(target.Connections, initiatorIQN)
+	}
+}
+
+// SetTargetOffline takes a target offline, or brings it back.
+func (s *Server) SetTargetOffline(targetIndex int, offline bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if target, ok := s.targets[targetIndex]; ok {
+		target.Offline = offline
+	}
+}
+
+// ExpireSessions invalidates every sid handed out so far, like the NAS does after a while.
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]bool{}
+}
+
+// DropConnections makes the next n requests have their connection closed without a response.
+func (s *Server) DropConnections(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropNext = n
+}
+
+// SetDelay makes every request wait before being handled, like a NAS that's struggling. Requests still return early if
+// the client goes away.
+func (s *Server) SetDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = delay
+}
+
+// wait sleeps for the configured delay or until the client goes away, returning false in the latter case.
+func (s *Server) wait(r *http.Request) bool {
+	s.mu.Lock()
+	delay := s.delay
+	s.mu.Unlock()
+
+	if delay == 0 {
+		return true
+	}
+
+	select {
+	case <-time.After(delay):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// RequestCount returns how many requests have been made to an endpoint, e.g. "authLogin.cgi".
+func (s *Server) RequestCount(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requestCounter[endpoint]
+}
+
+// Targets returns a copy of all targets ordered by index.
+func (s *Server) Targets() []Target {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]Target, 0, len(s.targets))
+	for _, target := range s.sortedTargets() {
+		t := *target
+		t.LUNs = append([]int{}, target.LUNs...)
+		t.Connections = append([]string{}, target.Connections...)
+		result = append(result, t)
+	}
+	return result
+}
+
+// LUNs returns a copy of all LUNs ordered by index.
+func (s *Server) LUNs() []LUN {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]LUN, 0, len(s.luns))
+	for _, lun := range s.sortedLUNs() {
+		result = append(result, *lun)
+	}
+	return result
+}
+
+// Snapshots returns a copy of all snapshots ordered by ID.
+func (s *Server) Snapshots() []Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]Snapshot, 0, len(s.snapshots))
+	for _, snapshot := range s.sortedSnapshots() {
+		result = append(result, *snapshot)
+	}
+	return result
+}
+
+// Policies returns a copy of all ACL policies ordered by index.
+func (s *Server) Policies() []Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]Policy, 0, len(s.policies))
+	for _, policy := range s.sortedPolicies() {
+		p := *policy
+		p.LUNs = map[int]int{}
+		for lunIndex, permission := range policy.LUNs {
+			p.LUNs[lunIndex] = permission
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// SharedFolders returns a copy of all shared folders ordered by name.
+func (s *Server) SharedFolders() []SharedFolder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]SharedFolder, 0, len(s.sharedFolders))
+	for _, folder := range s.sortedSharedFolders() {
+		f := *folder
+		f.NFSHosts = append([]string{}, folder.NFSHosts...)
+		f.UserAccess = map[string]string{}
+		for user, access := range folder.UserAccess {
+			f.UserAccess[user] = access
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+// Users returns the passwords of the users created through the API, by username.
+func (s *Server) Users() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make(map[string]string, len(s.users))
+	for name, password := range s.users {
+		result[name] = password
+	}
+	return result
+}
+
+// writeXML sends a response the same way the NAS does, always a 200.
+func writeXML(w http.ResponseWriter, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(body)
+}
+
+func writeResult(w http.ResponseWriter, result int) {
+	writeXML(w, resultXML{qdocRoot: authPassed, Result: result})
+}
+
+// dropConnection closes the connection without responding, which is what the NAS does when a CGI falls over.
+func dropConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic("qnaptest: response writer does not support hijacking")
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(err)
+	}
+	_ = conn.Close()
+}
+
+// countAndMaybeDrop records the request and returns true if its connection has been dropped. Expects s.mu to be held.
+func (s *Server) countAndMaybeDrop(w http.ResponseWriter, r *http.Request) bool {
+	s.requestCounter[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]++
+	if s.dropNext > 0 {
+		s.dropNext--
+		dropConnection(w)
+		return true
+	}
+	return false
+}
+
+// authed wraps handlers which need a valid sid, parameters can come from either the query string or the body.
+func (s *Server) authed(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.wait(r) {
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.countAndMaybeDrop(w, r) {
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !s.sessions[r.FormValue("sid")] {
+			writeXML(w, resultXML{qdocRoot: authFailed, Result: -1})
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if !s.wait(r) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.countAndMaybeDrop(w, r) {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.FormValue("user") != s.username || r.FormValue("pwd") != base64.StdEncoding.EncodeToString([]byte(s.password)) {
+		writeXML(w, loginXML{qdocRoot: authFailed})
+		return
+	}
+
+	sid := randomHex(8)
+	s.sessions[sid] = true
+	writeXML(w, loginXML{qdocRoot: authPassed, AuthSid: sid})
+}
+
+func (s *Server) handleDiskManage(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("func") != "extra_get" {
+		writeResult(w, -1)
+		return
+	}
+
+	switch r.FormValue("store") {
+	case "poolSubsc":
+		poolID, _ := strconv.Atoi(r.FormValue("poolID"))
+		capacity, ok := s.pools[poolID]
+		if !ok {
+			writeResult(w, -1)
+			return
+		}
+
+		resp := poolSubscriptionXML{qdocRoot: authPassed}
+		resp.PoolSubscription.PoolID = poolID
+		resp.PoolSubscription.CapacityBytes = capacity
+		var thick, thin uint64
+		for _, lun := range s.luns {
+			if lun.StoragePoolID != poolID {
+				continue
+			}
+			if lun.ThinAllocate {
+				thin += uint64(lun.CapacityGB) * giB
+			} else {
+				thick += uint64(lun.CapacityGB) * giB
+			}
+		}
+		resp.PoolSubscription.ThickLUNTotal = thick
+		resp.PoolSubscription.ThinLUNTotal = thin
+		if thick < capacity {
+			resp.PoolSubscription.FreesizeBytes = capacity - thick
+			resp.PoolSubscription.MaxThickCreateSizeBytes = capacity - thick
+		}
+		writeXML(w, resp)
+	case "lvList":
+		resp := logicalVolumeListXML{qdocRoot: authPassed}
+		for _, lun := range s.sortedLUNs() {
+			resp.Volumes = append(resp.Volumes, logicalVolumeRowXML{
+				Index:         lun.Index + 1,
+				Status:        0,
+				Label:         lun.Name,
+				LUNIndex:      lun.Index,
+				Type:          3, // Block-based thick LUN
+				StoragePoolID: lun.StoragePoolID,
+			})
+		}
+		writeXML(w, resp)
+	default:
+		writeResult(w, -1)
+	}
+}
+
+func (s *Server) handlePortalSetting(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("func") != "extra_get" {
+		writeResult(w, -1)
+		return
+	}
+
+	switch {
+	case r.FormValue("lun_info") == "1":
+		lunID, _ := strconv.Atoi(r.FormValue("lunID"))
+		lun, ok := s.luns[lunID]
+		if !ok {
+			// Missing LUNs aren't an error, they just have a not found status
+			writeXML(w, lunInfoXML{qdocRoot: authPassed, LUNs: []lunRowXML{{Index: lunID, Status: -2}}})
+			return
+		}
+
+		status := 1
+		if lun.creatingPolls > 0 {
+			lun.creatingPolls--
+			status = 0
+		}
+		writeXML(w, lunInfoXML{qdocRoot: authPassed, LUNs: []lunRowXML{s.lunRow(lun, status)}})
+	case r.FormValue("lunList") == "1":
+		resp := lunInfoXML{qdocRoot: authPassed}
+		for _, lun := range s.sortedLUNs() {
+			status := 1
+			if lun.creatingPolls > 0 {
+				status = 0
+			}
+			resp.LUNs = append(resp.LUNs, s.lunRow(lun, status))
+		}
+		writeXML(w, resp)
+	case r.FormValue("targetList") == "1":
+		resp := targetListXML{qdocRoot: authPassed}
+		for _, target := range s.sortedTargets() {
+			info := targetInfoXML{
+				TargetIndex: target.Index,
+				Name:        target.Name,
+				IQN:         target.IQN,
+				Alias:       target.Name,
+				Status:      0,
+				TargetLUNs:  target.LUNs,
+			}
+			for _, initiatorIQN := range target.Connections {
+				info.InitiatorConnections = append(info.InitiatorConnections, initiatorConnXML{ConnectionType: "iSCSI", InitiatorIQN: initiatorIQN, IP: "127.0.0.1", ConnectionStatus: "1"})
+			}
+			switch {
+			case target.Offline:
+				info.Status = -1
+			case len(target.Connections) > 0:
+				info.Status = 1
+			}
+			resp.Targets = append(resp.Targets, info)
+		}
+		writeXML(w, resp)
+	default:
+		writeResult(w, -1)
+	}
+}
+
+func (s *Server) lunRow(lun *LUN, status int) lunRowXML {
+	row := lunRowXML{
+		Index: lun.Index,
+		Name:  lun.Name,
+		Path:  lun.Name,
+		// The NAS puts a stray newline in here
+		Capacity:      strconv.Itoa(lun.CapacityGB) + "\n",
+		Status:        status,
+		Enable:        1,
+		ThinAllocate:  b2i(lun.ThinAllocate),
+		CapacityBytes: uint64(lun.CapacityGB) * giB,
+		SectorSize:    lun.SectorSize,
+		SSDCache:      "no",
+		StoragePoolID: lun.StoragePoolID,
+	}
+
+	for _, snapshot := range s.snapshots {
+		if snapshot.LUNIndex == lun.Index {
+			row.SnapshotCount++
+		}
+	}
+
+	for _, target := range s.sortedTargets() {
+		for _, lunIndex := range target.LUNs {
+			if lunIndex == lun.Index {
+				row.Targets = append(row.Targets, lunTargetRowXML{TargetIndex: target.Index, LUNNumber: 0, LUNEnable: 1})
+			}
+		}
+	}
+
+	return row
+}
+
+func (s *Server) handleTargetSetting(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("func") {
+	case "add_target":
+		// The NAS happily creates targets with the same name
+		name := r.FormValue("targetName")
+		if s.RejectDuplicateTargets {
+			for _, target := range s.targets {
+				if target.Name == name {
+					writeResult(w, -2)
+					return
+				}
+			}
+		}
+		target := &Target{
+			Index: s.nextTarget,
+			Name:  name,
+			IQN:   fmt.Sprintf("iqn.2004-04.com.qnap:ts-1279u-rp:iscsi.%s.%s", name, randomHex(3)),
+		}
+		s.targets[target.Index] = target
+		s.nextTarget++
+		writeResult(w, target.Index)
+	case "add_init":
+		// Doesn't care if the target exists
+		targetIndex, _ := strconv.Atoi(r.FormValue("targetIndex"))
+		if target, ok := s.targets[targetIndex]; ok {
+			target.CHAPUsername, target.CHAPPassword = "", ""
+			if r.FormValue("bCHAPEnable") == "1" {
+				target.CHAPUsername, target.CHAPPassword = r.FormValue("CHAPUserName"), r.FormValue("CHAPPasswd")
+			}
+			target.MutualCHAPUsername, target.MutualCHAPPassword = "", ""
+			if r.FormValue("bMutualCHAPEnable") == "1" {
+				target.MutualCHAPUsername, target.MutualCHAPPassword = r.FormValue("mutualCHAPUserName"), r.FormValue("mutualCHAPPasswd")
+			}
+		}
+		writeResult(w, 0)
+	case "remove_target":
+		targetIndex, _ := strconv.Atoi(r.FormValue("targetIndex"))
+		if _, ok := s.targets[targetIndex]; !ok {
+			writeResult(w, -1)
+			return
+		}
+		delete(s.targets, targetIndex)
+		writeResult(w, targetIndex)
+	case "add_lun":
+		lunIndex, _ := strconv.Atoi(r.FormValue("LUNIndex"))
+		targetIndex, _ := strconv.Atoi(r.FormValue("targetIndex"))
+		target, ok := s.targets[targetIndex]
+		if _, lunOk := s.luns[lunIndex]; !ok || !lunOk {
+			writeResult(w, -1)
+			return
+		}
+		target.LUNs = append(target.LUNs, lunIndex)
+		writeResult(w, 0)
+	default:
+		writeResult(w, -1)
+	}
+}
+
+func (s *Server) handleLUNSetting(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("func") {
+	case "add_lun":
+		name := r.FormValue("LUNName")
+		for _, lun := range s.luns {
+			if lun.Name == name {
+				// The real NAS falls over when a LUN name is reused
+				dropConnection(w)
+				return
+			}
+		}
+
+		poolID, _ := strconv.Atoi(r.FormValue("poolID"))
+		if _, ok := s.pools[poolID]; !ok {
+			writeResult(w, -1)
+			return
+		}
+		capacity, err := strconv.Atoi(r.FormValue("LUNCapacity"))
+		if err != nil || capacity <= 0 {
+			writeResult(w, -3)
+			return
+		}
+		sectorSize, _ := strconv.Atoi(r.FormValue("LUNSectorSize"))
+
+		lun := s.addLUN(name, capacity, poolID)
+		lun.ThinAllocate = r.FormValue("LUNThinAllocate") == "1"
+		lun.SectorSize = sectorSize
+		writeResult(w, lun.Index)
+	case "edit_lun":
+		lunIndex, _ := strconv.Atoi(r.FormValue("LUNIndex"))
+		capacity, err := strconv.Atoi(r.FormValue("LUNCapacity"))
+		lun, ok := s.luns[lunIndex]
+		if !ok || err != nil || capacity < lun.CapacityGB {
+			writeResult(w, -1)
+			return
+		}
+		lun.CapacityGB = capacity
+		writeResult(w, lunIndex)
+	case "remove_lun":
+		// Removing a LUN that doesn't exist is apparently fine
+		lunIndex, _ := strconv.Atoi(r.FormValue("LUNIndex"))
+		if _, ok := s.luns[lunIndex]; !ok && s.RejectMissingLUNs {
+			writeResult(w, -1)
+			return
+		}
+		s.removeLUN(lunIndex)
+		writeResult(w, 0)
+	default:
+		writeResult(w, -1)
+	}
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("func") {
+	case "extra_get":
+		lunIndex, _ := strconv.Atoi(r.FormValue("LUNIndex"))
+		resp := snapshotListXML{qdocRoot: authPassed}
+		for _, snapshot := range s.sortedSnapshots() {
+			if snapshot.LUNIndex != lunIndex {
+				continue
+			}
+			resp.Snapshots = append(resp.Snapshots, snapshotRowXML{
+				ID:         snapshot.ID,
+				Name:       snapshot.Name,
+				LUNIndex:   snapshot.LUNIndex,
+				CreateTime: snapshot.CreateTime.Unix(),
+				Status:     1,
+				Vital:      b2i(snapshot.Vital),
+			})
+		}
+		writeXML(w, resp)
+	case "create_snapshot":
+		lunIndex, _ := strconv.Atoi(r.FormValue("LUNIndex"))
+		name := r.FormValue("snapshot_name")
+		if _, ok := s.luns[lunIndex]; !ok || name == "" {
+			writeResult(w, -1)
+			return
+		}
+		for _, snapshot := range s.snapshots {
+			if snapshot.LUNIndex == lunIndex && snapshot.Name == name {
+				writeResult(w, -2)
+				return
+			}
+		}
+		snapshot := &Snapshot{
+			ID:         s.nextSnapshot,
+			Name:       name,
+			LUNIndex:   lunIndex,
+			CreateTime: time.Now(),
+			Vital:      r.FormValue("vital") == "1",
+		}
+		s.snapshots[snapshot.ID] = snapshot
+		s.nextSnapshot++
+		writeResult(w, snapshot.ID)
+	case "del_snapshot":
+		snapshotID, _ := strconv.Atoi(r.FormValue("snapshotID"))
+		if _, ok := s.snapshots[snapshotID]; !ok {
+			writeResult(w, -1)
+			return
+		}
+		delete(s.snapshots, snapshotID)
+		writeResult(w, 0)
+	case "clone_snapshot":
+		snapshotID, _ := strconv.Atoi(r.FormValue("snapshotID"))
+		snapshot, ok := s.snapshots[snapshotID]
+		if !ok {
+			writeResult(w, -1)
+			return
+		}
+		if s.FailClones {
+			writeResult(w, -99)
+			return
+		}
+		source := s.luns[snapshot.LUNIndex]
+		lun := s.addLUN(r.FormValue("clone_name"), source.CapacityGB, source.StoragePoolID)
+		lun.ThinAllocate = source.ThinAllocate
+		lun.SectorSize = source.SectorSize
+		writeResult(w, lun.Index)
+	default:
+		writeResult(w, -1)
+	}
+}
+
+func (s *Server) handlePolicySetting(w http.ResponseWriter, r *http.Request) {
+	switch r.FormValue("func") {
+	case "extra_get":
+		if r.FormValue("policyList") != "1" {
+			writeResult(w, -1)
+			return
+		}
+		resp := policyListXML{qdocRoot: authPassed}
+		for _, policy := range s.sortedPolicies() {
+			row := policyRowXML{Index: policy.Index, Name: policy.Name, InitiatorIQN: policy.InitiatorIQN}
+			for _, lun := range s.sortedLUNs() {
+				if permission, ok := policy.LUNs[lun.Index]; ok {
+					row.LUNs = append(row.LUNs, policyLUNRowXML{LUNIndex: lun.Index, Permission: permission})
+				}
+			}
+			resp.Policies = append(resp.Policies, row)
+		}
+		writeXML(w, resp)
+	case "add_policy":
+		iqn := r.FormValue("initiatorIQN")
+		if iqn == "" {
+			writeResult(w, -1)
+			return
+		}
+		for _, policy := range s.policies {
+			if policy.InitiatorIQN == iqn {
+				writeResult(w, -2)
+				return
+			}
+		}
+		policy := &Policy{Index: s.nextPolicy, Name: r.FormValue("policyName"), InitiatorIQN: iqn, LUNs: map[int]int{}}
+		s.policies[policy.Index] = policy
+		s.nextPolicy++
+		writeResult(w, policy.Index)
+	case "set_lun_perm":
+		policyIndex, _ := strconv.Atoi(r.FormValue("policyIndex"))
+		lunIndex, _ := strconv.Atoi(r.FormValue("LUNIndex"))
+		permission, err := strconv.Atoi(r.FormValue("permission"))
+		policy, ok := s.policies[policyIndex]
+		if _, lunOk := s.luns[lunIndex]; !ok || !lunOk {
+			writeResult(w, -1)
+			return
+		}
+		if err != nil || permission < 0 || permission > 2 {
+			writeResult(w, -3)
+			return
+		}
+		policy.LUNs[lunIndex] = permission
+		writeResult(w, 0)
+	default:
+		writeResult(w, -1)
+	}
+}
+
+func (s *Server) handlePrivRights(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("sharename")
+	folder := s.sharedFolders[name]
+
+	switch r.FormValue("func") {
+	case "get_share_list":
+		resp := shareListXML{qdocRoot: authPassed}
+		for _, folder := range s.sortedSharedFolders() {
+			resp.SharedFolders = append(resp.SharedFolders, shareRowXML{
+				Name:         folder.Name,
+				Path:         fmt.Sprintf("/share/CACHEDEV%d_DATA/%s", folder.VolumeIndex, folder.Name),
+				VolumeIndex:  folder.VolumeIndex,
+				QuotaEnabled: 1,
+				QuotaBytes:   uint64(folder.QuotaGB) * giB,
+				NFSEnabled:   b2i(len(folder.NFSHosts) > 0),
+			})
+		}
+		writeXML(w, resp)
+	case "add_share":
+		volumeIndex, _ := strconv.Atoi(r.FormValue("vol_no"))
+		quotaGB, err := strconv.Atoi(r.FormValue("quota_size"))
+		switch {
+		case folder != nil:
+			writeResult(w, -2)
+		case !s.volumes[volumeIndex]:
+			writeResult(w, -3)
+		case name == "" || err != nil || r.FormValue("quota_unit") != "GB":
+			writeResult(w, -4)
+		default:
+			s.sharedFolders[name] = &SharedFolder{Name: name, VolumeIndex: volumeIndex, QuotaGB: quotaGB, UserAccess: map[string]string{}}
+			writeResult(w, 0)
+		}
+	case "set_share_quota":
+		quotaGB, err := strconv.Atoi(r.FormValue("quota_size"))
+		switch {
+		case folder == nil:
+			writeResult(w, -1)
+		case err != nil || r.FormValue("quota_unit") != "GB":
+			writeResult(w, -4)
+		default:
+			folder.QuotaGB = quotaGB
+			writeResult(w, 0)
+		}
+	case "set_nfs_access":
+		if folder == nil {
+			writeResult(w, -1)
+			return
+		}
+		folder.NFSHosts = nil
+		if r.FormValue("nfs_enable") == "1" {
+			folder.NFSHosts = append([]string{}, r.Form["host"]...)
+		}
+		folder.NFSSquash = r.FormValue("squash")
+		writeResult(w, 0)
+	case "remove_share":
+		if folder == nil {
+			writeResult(w, -1)
+			return
+		}
+		delete(s.sharedFolders, name)
+		writeResult(w, 0)
+	case "set_share_access":
+		user := r.FormValue("user_name")
+		if _, ok := s.users[user]; folder == nil || !ok {
+			writeResult(w, -1)
+			return
+		}
+		folder.UserAccess[user] = r.FormValue("access")
+		writeResult(w, 0)
+	case "add_user":
+		user := r.FormValue("user_name")
+		password, err := base64.StdEncoding.DecodeString(r.FormValue("pwd"))
+		if _, ok := s.users[user]; ok {
+			writeResult(w, -2)
+			return
+		}
+		if user == "" || len(user) > 32 || err != nil || len(password) == 0 {
+			writeResult(w, -4)
+			return
+		}
+		s.users[user] = string(password)
+		writeResult(w, 0)
+	case "remove_user":
+		user := r.FormValue("user_name")
+		if _, ok := s.users[user]; !ok {
+			writeResult(w, -1)
+			return
+		}
+		delete(s.users, user)
+		for _, folder := range s.sharedFolders {
+			delete(folder.UserAccess, user)
+		}
+		writeResult(w, 0)
+	default:
+		writeResult(w, -1)
+	}
+}
+
+func (s *Server) sortedSharedFolders() []*SharedFolder {
+	result := make([]*SharedFolder, 0, len(s.sharedFolders))
+	for _, folder := range s.sharedFolders {
+		result = append(result, folder)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (s *Server) sortedSnapshots() []*Snapshot {
+	result := make([]*Snapshot, 0, len(s.snapshots))
+	for _, snapshot := range s.snapshots {
+		result = append(result, snapshot)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// addLUN creates a LUN which will report as creating for a while. Expects s.mu to be held.
+func (s *Server) addLUN(name string, capacityGB, poolID int) *LUN {
+	lun := &LUN{
+		Index:         s.nextLUN,
+		Name:          name,
+		CapacityGB:    capacityGB,
+		StoragePoolID: poolID,
+		SectorSize:    512,
+		creatingPolls: s.LUNCreatingPolls,
+	}
+	s.luns[lun.Index] = lun
+	s.nextLUN++
+	return lun
+}
+
+// removeLUN deletes a LUN along with its snapshots, target mappings and ACL permissions. Expects s.mu to be held.
+func (s *Server) removeLUN(lunIndex int) {
+	delete(s.luns, lunIndex)
+
+	for id, snapshot := range s.snapshots {
+		if snapshot.LUNIndex == lunIndex {
+			delete(s.snapshots, id)
+		}
+	}
+
+	for _, policy := range s.policies {
+		delete(policy.LUNs, lunIndex)
+	}
+
+	for _, target := range s.targets {
+		luns := target.LUNs[:0]
+		for _, index := range target.LUNs {
+			if index != lunIndex {
+				luns = append(luns, index)
+			}
+		}
+		target.LUNs = luns
+	}
+}
+
+func (s *Server) sortedTargets() []*Target {
+	result := make([]*Target, 0, len(s.targets))
+	for _, target := range s.targets {
+		result = append(result, target)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Index < result[j].Index })
+	return result
+}
+
+func (s *Server) sortedPolicies() []*Policy {
+	result := make([]*Policy, 0, len(s.policies))
+	for _, policy := range s.policies {
+		result = append(result, policy)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Index < result[j].Index })
+	return result
+}
+
+func (s *Server) sortedLUNs() []*LUN {
+	result := make([]*LUN, 0, len(s.luns))
+	for _, lun := range s.luns {
+		result = append(result, lun)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Index < result[j].Index })
+	return result
+}
+
+func b2i(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,165 @@
+package qnaptest
+
+import "encoding/xml"
+
+// These mirror what the NAS sends over the wire, they are deliberately separate from the types in the qnap package so
+// that the client's parsing is actually tested.
+
+// qdocRoot is embedded in every response, the NAS always says whether the sid was valid.
+type qdocRoot struct {
+	XMLName    xml.Name `xml:"QDocRoot"`
+	Version    string   `xml:"version,attr"`
+	AuthPassed int      `xml:"authPassed"`
+}
+
+var (
+	authPassed = qdocRoot{Version: "1.0", AuthPassed: 1}
+	authFailed = qdocRoot{Version: "1.0", AuthPassed: 0}
+)
+
+type loginXML struct {
+	qdocRoot
+	AuthSid string `xml:"authSid"`
+}
+
+type resultXML struct {
+	qdocRoot
+	Result int `xml:"result"`
+}
+
+type poolSubscriptionXML struct {
+	qdocRoot
+	Result           int `xml:"result"`
+	PoolSubscription struct {
+		PoolID                  int    `xml:"poolID"`
+		CapacityBytes           uint64 `xml:"capacity_bytes"`
+		FreesizeBytes           uint64 `xml:"freesize_bytes"`
+		MaxThickCreateSizeBytes uint64 `xml:"max_thick_create_size_bytes"`
+		ThinVolumeTotal         uint64 `xml:"thinVolTotal"`
+		ThinLUNTotal            uint64 `xml:"thinLUNTotal"`
+		ThickVolumeTotal        uint64 `xml:"thickVolTotal"`
+		ThickLUNTotal           uint64 `xml:"thickLUNTotal"`
+		VaultTotal              uint64 `xml:"vaultTotal"`
+		SnapshotBytes           uint64 `xml:"snapshot_bytes"`
+	} `xml:"PoolSubscription"`
+}
+
+type logicalVolumeRowXML struct {
+	Index         int    `xml:"vol_no"`
+	Status        int    `xml:"vol_status"`
+	Label         string `xml:"vol_label"`
+	LUNIndex      int    `xml:"LUNIndex"`
+	Type          int    `xml:"volume_type"`
+	StoragePoolID int    `xml:"poolID"`
+}
+
+type logicalVolumeListXML struct {
+	qdocRoot
+	Result                int                   `xml:"result"`
+	VolumeCreatingProcess int                   `xml:"vol_creating_process"`
+	Volumes               []logicalVolumeRowXML `xml:"Volume_Index>row"`
+}
+
+type lunTargetRowXML struct {
+	TargetIndex int `xml:"targetIndex"`
+	LUNNumber   int `xml:"LUNNumber"`
+	LUNEnable   int `xml:"LUNEnable"`
+}
+
+type lunRowXML struct {
+	Index         int               `xml:"LUNIndex"`
+	Name          string            `xml:"LUNName"`
+	Path          string            `xml:"LUNPath"`
+	Capacity      string            `xml:"LUNCapacity"`
+	Status        int               `xml:"LUNStatus"`
+	Enable        int               `xml:"LUNEnable"`
+	ThinAllocate  int               `xml:"LUNThinAllocate"`
+	IsSnap        int               `xml:"isSnap"`
+	CapacityBytes uint64            `xml:"capacity_bytes"`
+	WCEnable      int               `xml:"WCEnable"`
+	FUAEnable     int               `xml:"FUAEnable"`
+	SectorSize    int               `xml:"LUNSectorSize"`
+	SSDCache      string            `xml:"ssd_cache"`
+	StoragePoolID int               `xml:"poolID"`
+	SnapshotCount int               `xml:"snapshot_count"`
+	Targets       []lunTargetRowXML `xml:"LUNTargetList>row"`
+}
+
+type lunInfoXML struct {
+	qdocRoot
+	Result int         `xml:"result"`
+	LUNs   []lunRowXML `xml:"LUNInfo>row"`
+}
+
+type initiatorConnXML struct {
+	ConnectionType   string `xml:"connection_type"`
+	InitiatorIQN     string `xml:"initiatorIQN"`
+	IP               string `xml:"IP"`
+	ConnectionStatus string `xml:"connection_status"`
+}
+
+type targetInfoXML struct {
+	TargetIndex          int                `xml:"targetIndex"`
+	Name                 string             `xml:"targetName"`
+	IQN                  string             `xml:"targetIQN"`
+	Alias                string             `xml:"targetAlias"`
+	Status               int                `xml:"targetStatus"`
+	TargetLUNs           []int              `xml:"targetLUNList>LUNIndex"`
+	InitiatorConnections []initiatorConnXML `xml:"initiatorConnList>initiatorConnInfo"`
+}
+
+type targetListXML struct {
+	qdocRoot
+	Result  int             `xml:"result"`
+	Targets []targetInfoXML `xml:"iSCSITargetList>targetInfo"`
+}
+
+type snapshotRowXML struct {
+	ID         int    `xml:"snapshotID"`
+	Name       string `xml:"snapshot_name"`
+	LUNIndex   int    `xml:"LUNIndex"`
+	CreateTime int64  `xml:"create_time"`
+	Status     int    `xml:"status"`
+	SizeBytes  uint64 `xml:"size_bytes"`
+	Vital      int    `xml:"vital"`
+}
+
+type snapshotListXML struct {
+	qdocRoot
+	Result    int              `xml:"result"`
+	Snapshots []snapshotRowXML `xml:"SnapshotList>row"`
+}
+
+type policyLUNRowXML struct {
+	LUNIndex   int `xml:"LUNIndex"`
+	Permission int `xml:"permission"`
+}
+
+type policyRowXML struct {
+	Index        int               `xml:"policyIndex"`
+	Name         string            `xml:"policyName"`
+	InitiatorIQN string            `xml:"initiatorIQN"`
+	LUNs         []policyLUNRowXML `xml:"LUNPermList>row"`
+}
+
+type policyListXML struct {
+	qdocRoot
+	Result   int            `xml:"result"`
+	Policies []policyRowXML `xml:"policyInfo>row"`
+}
+
+type shareRowXML struct {
+	Name         string `xml:"sharename"`
+	Path         string `xml:"path"`
+	VolumeIndex  int    `xml:"vol_no"`
+	QuotaEnabled int    `xml:"quota_enable"`
+	QuotaBytes   uint64 `xml:"quota_size_bytes"`
+	UsedBytes    uint64 `xml:"used_size_bytes"`
+	NFSEnabled   int    `xml:"nfs_enable"`
+}
+
+type shareListXML struct {
+	qdocRoot
+	Result        int           `xml:"result"`
+	SharedFolders []shareRowXML `xml:"Share_List>row"`
+}
@@ -0,0 +1,135 @@
+package qnap
+
+import (
+	"context"
+	"encoding/xml"
+	"net/url"
+	"strconv"
+)
+
+// Shared folders are managed through privRights.cgi, the same as the Control Panel's Shared Folders page. The folder
+// size limit and NFS host access are separate calls there too.
+
+// NFSSquashNone is the NFS squash option which keeps client root as root, pods often need to chown their volumes.
+const NFSSquashNone = "no_root_squash"
+
+type SharedFolderInfoXML struct {
+	Name         string `xml:"sharename"`
+	Path         string `xml:"path"`
+	VolumeIndex  int    `xml:"vol_no"`
+	QuotaEnabled int    `xml:"quota_enable"`
+	QuotaBytes   uint64 `xml:"quota_size_bytes"`
+	UsedBytes    uint64 `xml:"used_size_bytes"`
+	NFSEnabled   int    `xml:"nfs_enable"`
+}
+
+type SharedFolderListRespXML struct {
+	AuthPassed    string                `xml:"authPassed"`
+	Result        string                `xml:"result"`
+	SharedFolders []SharedFolderInfoXML `xml:"Share_List>row"`
+}
+
+func (c *Client) GetSharedFolderList(ctx context.Context) (SharedFolderListRespXML, error) {
+	params := url.Values{}
+	params.Add("func", "get_share_list")
+
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.shareEndpoint, params, "")
+	if err != nil {
+		return SharedFolderListRespXML{}, err
+	}
+	if statusCode != 200 {
+		return SharedFolderListRespXML{}, c.newAPIError(c.shareEndpoint, "get_share_list", statusCode, "", xmlBytes, nil)
+	}
+
+	var xmlStruct SharedFolderListRespXML
+	if err = xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return SharedFolderListRespXML{}, err
+	}
+
+	if xmlStruct.Result != "0" {
+		return SharedFolderListRespXML{}, c.newAPIError(c.shareEndpoint, "get_share_list", statusCode, xmlStruct.Result, xmlBytes, nil)
+	}
+
+	return xmlStruct, nil
+}
+
+type SharedFolderRespXML struct {
+	AuthPassed string `xml:"authPassed"`
+	Result     int    `xml:"result"`
+}
+
+// shareRequest sends one of the shared folder calls which only return a result code, knownResults maps result codes
+// to sentinel errors.
+func (c *Client) shareRequest(ctx context.Context, fn string, data url.Values, knownResults map[string]error) error {
+	data.Set("func", fn)
+
+	xmlBytes, statusCode, err := c.authedPostFormReq(ctx, c.shareEndpoint, url.Values{}, data.Encode())
+	if err != nil {
+		return err
+	}
+	if statusCode != 200 {
+		return c.newAPIError(c.shareEndpoint, fn, statusCode, "", xmlBytes, nil)
+	}
+
+	var xmlStruct SharedFolderRespXML
+	if err = xml.Unmarshal(xmlBytes, &xmlStruct); err != nil {
+		return err
+	}
+
+	if xmlStruct.Result != 0 {
+		return c.newAPIError(c.shareEndpoint, fn, statusCode, strconv.Itoa(xmlStruct.Result), xmlBytes, knownResults)
+	}
+
+	return nil
+}
+
+// CreateSharedFolder creates a shared folder on a volume, limited to quotaGB. Only administrators get access to it, NFS
+// access is given separately with SetSharedFolderNFSAccess.
+func (c *Client) CreateSharedFolder(ctx context.Context, name string, volumeIndex int, quotaGB int) error {
+	data := url.Values{}
+	data.Add("sharename", name)
+	data.Add("comment", "")
+	data.Add("vol_no", strconv.Itoa(volumeIndex))
+	data.Add("access_r", "setup_users")
+	data.Add("quota_enable", "1")
+	data.Add("quota_size", strconv.Itoa(quotaGB))
+	data.Add("quota_unit", "GB")
+
+	return c.shareRequest(ctx, "add_share", data, map[string]error{"-2": ErrAlreadyExists, "-3": ErrInvalidVolume})
+}
+
+// SetSharedFolderQuota changes a shared folder's size limit.
+func (c *Client) SetSharedFolderQuota(ctx context.Context, name string, quotaGB int) error {
+	data := url.Values{}
+	data.Add("sharename", name)
+	data.Add("quota_enable", "1")
+	data.Add("quota_size", strconv.Itoa(quotaGB))
+	data.Add("quota_unit", "GB")
+
+	return c.shareRequest(ctx, "set_share_quota", data, map[string]error{"-1": ErrNotFound})
+}
+
+// SetSharedFolderNFSAccess exports a shared folder over NFS, read-write to the given hosts, which can be IPs or
+// networks in CIDR form, and to nothing else. The NFS service itself has to be enabled on the NAS.
+func (c *Client) SetSharedFolderNFSAccess(ctx context.Context, name string, hosts []string, squash string) error {
+	data := url.Values{}
+	data.Add("sharename", name)
+	data.Add("nfs_enable", "1")
+	for _, host := range hosts {
+		data.Add("host", host)
+		data.Add("host_access", "rw")
+	}
+	data.Add("squash", squash)
+	data.Add("sync", "1")
+
+	return c.shareRequest(ctx, "set_nfs_access", data, map[string]error{"-1": ErrNotFound})
+}
+
+// DeleteSharedFolder removes a shared folder along with its data.
+func (c *Client) DeleteSharedFolder(ctx context.Context, name string) error {
+	data := url.Values{}
+	data.Add("sharename", name)
+	data.Add("del_data", "1")
+
+	return c.shareRequest(ctx, "remove_share", data, map[string]error{"-1": ErrNotFound})
+}
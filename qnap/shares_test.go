@@ -0,0 +1,97 @@
+package qnap
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/terrycain/qnap-csi/qnap/qnaptest"
+)
+
+func TestClient_CreateDeleteSharedFolder(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	if err := c.CreateSharedFolder(ctx, "share1", qnaptest.DefaultVolumeIndex, 10); err != nil {
+		t.Fatalf("failed to create shared folder: %#v", err)
+	}
+	if err := c.CreateSharedFolder(ctx, "share1", qnaptest.DefaultVolumeIndex, 10); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected already exists, got %#v", err)
+	}
+	if err := c.CreateSharedFolder(ctx, "share2", 99, 10); !errors.Is(err, ErrInvalidVolume) {
+		t.Fatalf("expected invalid volume, got %#v", err)
+	}
+
+	if err := c.SetSharedFolderQuota(ctx, "share1", 20); err != nil {
+		t.Fatalf("failed to set quota: %#v", err)
+	}
+	if err := c.SetSharedFolderNFSAccess(ctx, "share1", []string{"10.0.0.0/24", "10.0.1.5"}, NFSSquashNone); err != nil {
+		t.Fatalf("failed to set NFS access: %#v", err)
+	}
+
+	listResp, err := c.GetSharedFolderList(ctx)
+	if err != nil {
+		t.Fatalf("failed to list shared folders: %#v", err)
+	}
+	if len(listResp.SharedFolders) != 1 {
+		t.Fatalf("unexpected shared folder list %#v", listResp.SharedFolders)
+	}
+	folder := listResp.SharedFolders[0]
+	if folder.Name != "share1" || folder.VolumeIndex != qnaptest.DefaultVolumeIndex || folder.QuotaBytes != 20<<30 || folder.NFSEnabled != 1 {
+		t.Fatalf("unexpected shared folder %#v", folder)
+	}
+	if hosts := srv.SharedFolders()[0].NFSHosts; len(hosts) != 2 || hosts[0] != "10.0.0.0/24" || hosts[1] != "10.0.1.5" {
+		t.Fatalf("unexpected NFS hosts %v", hosts)
+	}
+
+	if err = c.DeleteSharedFolder(ctx, "share1"); err != nil {
+		t.Fatalf("failed to delete shared folder: %#v", err)
+	}
+	if err = c.DeleteSharedFolder(ctx, "share1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %#v", err)
+	}
+	if len(srv.SharedFolders()) != 0 {
+		t.Fatal("shared folder was not deleted")
+	}
+}
+
+func TestClient_SharedFolderUsers(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	c := getLoggedInClient(t, srv)
+
+	if err := c.CreateSharedFolder(ctx, "share1", qnaptest.DefaultVolumeIndex, 10); err != nil {
+		t.Fatalf("failed to create shared folder: %#v", err)
+	}
+	if err := c.SetSharedFolderUserAccess(ctx, "share1", "user1", SharedFolderAccessReadWrite); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found for a missing user, got %#v", err)
+	}
+
+	if err := c.CreateUser(ctx, "user1", "secret"); err != nil {
+		t.Fatalf("failed to create user: %#v", err)
+	}
+	if err := c.CreateUser(ctx, "user1", "secret"); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected already exists, got %#v", err)
+	}
+	if password := srv.Users()["user1"]; password != "secret" {
+		t.Fatalf("expected: secret, got: %s", password)
+	}
+
+	if err := c.SetSharedFolderUserAccess(ctx, "share1", "user1", SharedFolderAccessReadWrite); err != nil {
+		t.Fatalf("failed to set user access: %#v", err)
+	}
+	if access := srv.SharedFolders()[0].UserAccess["user1"]; access != SharedFolderAccessReadWrite {
+		t.Fatalf("expected: %s, got: %s", SharedFolderAccessReadWrite, access)
+	}
+
+	if err := c.DeleteUser(ctx, "user1"); err != nil {
+		t.Fatalf("failed to delete user: %#v", err)
+	}
+	if err := c.DeleteUser(ctx, "user1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got %#v", err)
+	}
+	if len(srv.SharedFolders()[0].UserAccess) != 0 {
+		t.Fatal("deleted user still has access to the shared folder")
+	}
+}
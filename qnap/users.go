@@ -0,0 +1,44 @@
+package qnap
+
+import (
+	"context"
+	"encoding/base64"
+	"net/url"
+)
+
+// Users are managed through privRights.cgi too, they're only needed to give SMB clients access to shared folders.
+
+// MaxUsernameLength is the longest username the NAS accepts.
+const MaxUsernameLength = 32
+
+// SharedFolderAccessReadWrite is the access level which lets a user read and write a shared folder.
+const SharedFolderAccessReadWrite = "rw"
+
+// CreateUser creates a local user with no access to anything, see SetSharedFolderUserAccess.
+func (c *Client) CreateUser(ctx context.Context, name, password string) error {
+	data := url.Values{}
+	data.Add("user_name", name)
+	// Passwords are sent base64'd, the same as when logging in
+	data.Add("pwd", base64.StdEncoding.EncodeToString([]byte(password)))
+	data.Add("description", "")
+
+	return c.shareRequest(ctx, "add_user", data, map[string]error{"-2": ErrAlreadyExists})
+}
+
+// DeleteUser removes a local user, along with its access to shared folders.
+func (c *Client) DeleteUser(ctx context.Context, name string) error {
+	data := url.Values{}
+	data.Add("user_name", name)
+
+	return c.shareRequest(ctx, "remove_user", data, map[string]error{"-1": ErrNotFound})
+}
+
+// SetSharedFolderUserAccess gives a user access to a shared folder, over SMB as well as everything else.
+func (c *Client) SetSharedFolderUserAccess(ctx context.Context, share, user, access string) error {
+	data := url.Values{}
+	data.Add("sharename", share)
+	data.Add("user_name", user)
+	data.Add("access", access)
+
+	return c.shareRequest(ctx, "set_share_access", data, map[string]error{"-1": ErrNotFound})
+}